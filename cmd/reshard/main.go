@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"go-url-shortener/internal/app/storage"
+	"log"
+	"os"
+	"strings"
+)
+
+// reshard переносит строки между шардами после изменения DATABASE_SHARDS.
+// В -shards передается новая полная карта шардов, включая добавленные.
+func main() {
+	var shardsFlag string
+	var batchSize int
+	flag.StringVar(&shardsFlag, "shards", os.Getenv("DATABASE_SHARDS"), "shards map: name=dsn,name=dsn")
+	flag.IntVar(&batchSize, "batch", 1000, "rows per batch")
+	flag.Parse()
+
+	if shardsFlag == "" {
+		log.Fatal("shards map is empty")
+	}
+	shardDSNs, err := storage.ParseShards(strings.Split(shardsFlag, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shards := make(map[string]*storage.PG, len(shardDSNs))
+	for name, dsn := range shardDSNs {
+		if shards[name], err = storage.NewPG(dsn, storage.PGOptions{}); err != nil {
+			log.Fatalf("shard %v: %v", name, err)
+		}
+		defer shards[name].Close()
+	}
+
+	moved, err := storage.Reshard(context.Background(), shards, batchSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("resharding done, moved %v urls", moved)
+}
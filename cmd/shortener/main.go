@@ -1,12 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/caarlos0/env/v6"
 	"go-url-shortener/internal/app/config"
+	"go-url-shortener/internal/app/handlers"
+	"go-url-shortener/internal/app/idempotency"
+	"go-url-shortener/internal/app/preview"
+	"go-url-shortener/internal/app/ratelimit"
 	"go-url-shortener/internal/app/server"
 	"go-url-shortener/internal/app/storage"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -20,23 +31,181 @@ func main() {
 	flag.StringVar(&cfg.BaseURL, "b", cfg.BaseURL, "base url for short urls")
 	flag.StringVar(&cfg.FileStoragePath, "f", cfg.FileStoragePath, "file for save/load urls")
 	flag.StringVar(&cfg.DatabaseDSN, "d", cfg.DatabaseDSN, "database DSN")
+	flag.StringVar(&cfg.RedisURL, "r", cfg.RedisURL, "redis url")
 	flag.Parse()
 
-	var db storage.Repository
+	storageOpts, err := storage.OptionsFromConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := storage.Open(storageOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// перепроверка правил читает ссылки мимо кэша
+	records, _ := db.(storage.Transferable)
 
-	if cfg.DatabaseDSN != "" {
-		if db, err = storage.NewPG(cfg.DatabaseDSN); err != nil {
-			log.Fatal(err)
+	// базы, изменения в которых надо слушать для сброса кэша
+	listenDSNs := []string{cfg.DatabaseDSN}
+	if len(storageOpts.Shards) > 0 {
+		listenDSNs = listenDSNs[:0]
+		for _, dsn := range storageOpts.Shards {
+			listenDSNs = append(listenDSNs, dsn)
 		}
-		log.Println("use postgres conn " + cfg.DatabaseDSN + " as db")
-	} else if cfg.FileStoragePath != "" {
-		if db, err = storage.NewFileStorage(cfg.FileStoragePath); err != nil {
+	}
+
+	if cfg.CacheSize > 0 {
+		cache := storage.NewCache(db, cfg.CacheSize, cfg.CacheTTL, cfg.CacheNegativeTTL)
+		log.Printf("use cache for %v urls", cfg.CacheSize)
+		// изменения, сделанные другими инстансами, приходят через LISTEN/NOTIFY
+		for _, dsn := range listenDSNs {
+			if dsn == "" {
+				continue
+			}
+			go storage.NewPGListener(dsn, cache).Run(context.Background())
+		}
+		db = cache
+	}
+
+	policyCfg := storage.PolicyFromConfig(cfg)
+	if !policyCfg.IsEmpty() {
+		policy, err := storage.NewURLPolicy(db, records, policyCfg)
+		if err != nil {
 			log.Fatal(err)
 		}
-		log.Println("use file " + cfg.FileStoragePath + " as db")
-	} else {
-		db = storage.NewMemoryMap()
+		go reloadPolicy(context.Background(), policy, cfg.PolicyReloadInterval)
+		db = policy
+	}
+
+	// заголовки новых ссылок загружаются в фоне, только если задан PREVIEW_WORKERS: сервис ходит по чужим ссылкам
+	var previews handlers.PreviewQueue
+	if cfg.PreviewWorkers > 0 {
+		fetcher := preview.NewFetcher(db, preview.Options{
+			Timeout:      cfg.PreviewTimeout,
+			MaxBodySize:  cfg.PreviewMaxBytes,
+			AllowPrivate: cfg.PreviewAllowPrivate,
+			Workers:      cfg.PreviewWorkers,
+		})
+		go fetcher.Run(context.Background())
+		previews = fetcher
 	}
 
-	log.Fatal(server.Serve(cfg.ServerAddress, cfg.BaseURL, db))
+	rateStore, err := makeRateStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits, err := makeLimits(cfg, rateStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	idempotencyStore, err := makeIdempotencyStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idempotent := handlers.Idempotency{Store: idempotencyStore, Window: cfg.IdempotencyWindow}
+
+	log.Fatal(server.Serve(cfg.ServerAddress, cfg.BaseURL, db, previews, limits, idempotent, cfg.ValidateRequests))
+}
+
+// makeIdempotencyStore выбирает, где хранить ответы на запросы с Idempotency-Key: memory - в инстансе
+// до перезапуска, postgres - общие для всех инстансов (по умолчанию в базе DATABASE_DSN).
+func makeIdempotencyStore(cfg config.Config) (idempotency.Store, error) {
+	switch cfg.IdempotencyStore {
+	case "memory", "":
+		return idempotency.NewMemoryStore(), nil
+	case "postgres":
+		dsn := cfg.IdempotencyStoreDSN
+		if dsn == "" {
+			dsn = cfg.DatabaseDSN
+		}
+		if dsn == "" {
+			return nil, errors.New("IDEMPOTENCY_STORE=postgres needs IDEMPOTENCY_STORE_DSN or DATABASE_DSN")
+		}
+		return storage.NewPGIdempotencyStore(dsn, storage.PGOptions{MaxConns: cfg.DatabaseMaxConns, MigrateMode: cfg.DatabaseMigrate})
+	}
+	return nil, fmt.Errorf("unknown idempotency store %q: expected memory or postgres", cfg.IdempotencyStore)
+}
+
+// makeRateStore выбирает, где считать лимиты: memory - в каждом инстансе отдельно,
+// postgres - общие для всех инстансов (по умолчанию в базе DATABASE_DSN).
+func makeRateStore(cfg config.Config) (ratelimit.Store, error) {
+	switch cfg.RateStore {
+	case "memory", "":
+		return ratelimit.NewMemoryStore(), nil
+	case "postgres":
+		dsn := cfg.RateStoreDSN
+		if dsn == "" {
+			dsn = cfg.DatabaseDSN
+		}
+		if dsn == "" {
+			return nil, errors.New("RATE_STORE=postgres needs RATE_STORE_DSN or DATABASE_DSN")
+		}
+		return storage.NewPGRateStore(dsn, storage.PGOptions{MaxConns: cfg.DatabaseMaxConns, MigrateMode: cfg.DatabaseMigrate})
+	}
+	return nil, fmt.Errorf("unknown rate store %q: expected memory or postgres", cfg.RateStore)
+}
+
+// makeLimits разбирает лимиты запросов из настроек: "0" или пустая строка - без лимита.
+func makeLimits(cfg config.Config, store ratelimit.Store) (handlers.Limits, error) {
+	limits := handlers.Limits{
+		Rates:        make(map[string]handlers.RateLimit),
+		DailyUser:    cfg.QuotaDailyUser,
+		DailyIP:      cfg.QuotaDailyIP,
+		BatchMaxSize: cfg.BatchMaxSize,
+	}
+	for class, rates := range map[string][2]string{
+		handlers.RouteShorten:  {cfg.RateShortenUser, cfg.RateShortenIP},
+		handlers.RouteBatch:    {cfg.RateBatchUser, cfg.RateBatchIP},
+		handlers.RouteRedirect: {cfg.RateRedirectUser, cfg.RateRedirectIP},
+	} {
+		user, err := ratelimit.ParseRate(rates[0])
+		if err != nil {
+			return handlers.Limits{}, err
+		}
+		ip, err := ratelimit.ParseRate(rates[1])
+		if err != nil {
+			return handlers.Limits{}, err
+		}
+		limits.Rates[class] = handlers.RateLimit{
+			User: ratelimit.NewLimiter(class+":user", user, store),
+			IP:   ratelimit.NewLimiter(class+":ip", ip, store),
+		}
+	}
+	return limits, nil
+}
+
+// reloadPolicy перепроверяет ссылки при старте, а затем перечитывает правила
+// по SIGHUP и, если interval > 0, периодически.
+func reloadPolicy(ctx context.Context, policy *storage.URLPolicy, interval time.Duration) {
+	disabled, err := policy.Recheck(ctx)
+	if err != nil {
+		log.Println("cant recheck urls", err)
+	} else if disabled > 0 {
+		log.Printf("policy disabled %v urls", disabled)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		disabled, err = policy.Reload(ctx)
+		if err != nil {
+			log.Println("cant reload policy", err)
+			continue
+		}
+		log.Printf("policy reloaded, disabled %v urls", disabled)
+	}
 }
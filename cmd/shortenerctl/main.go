@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/caarlos0/env/v6"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go-url-shortener/internal/app/config"
+	"go-url-shortener/internal/app/dump"
+	"go-url-shortener/internal/app/storage"
+	"go-url-shortener/internal/app/storage/migrations"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `usage: shortenerctl [-d dsn | -r redis url | -f file] <command>
+
+commands:
+  migrate status                        show current and latest schema revision
+  migrate up [-dry-run] [version]       apply migrations up to version (default latest)
+  migrate down [-dry-run] <version>     roll back migrations down to version
+  links list -user <uuid>               list user's links
+  links create -user <uuid> <url>...    shorten urls for user
+  links delete -user <uuid> <short>...  mark user's links deleted
+  links restore -user <uuid> <short>... restore user's deleted links
+  links info <short>...                 show link owner and status
+  export [-format jsonl|csv] [file]     write all links to file (default stdout)
+  import [-format jsonl|csv] [-policy skip|overwrite|fail] [-batch n] [file]
+                                        load links from file (default stdin)
+  import-foreign -user <uuid> [-format csv|json] [-policy skip|overwrite|fail] [-dry-run] <file>
+                                        load another shortener's export keeping its codes;
+                                        click counts are not imported
+
+backend is chosen by the same environment variables as the server
+`
+
+func main() {
+	var cfg config.Config
+	if err := env.Parse(&cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	flag.StringVar(&cfg.FileStoragePath, "f", cfg.FileStoragePath, "file for save/load urls")
+	flag.StringVar(&cfg.DatabaseDSN, "d", cfg.DatabaseDSN, "database DSN")
+	flag.StringVar(&cfg.RedisURL, "r", cfg.RedisURL, "redis url")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 || (len(args) < 2 && (args[0] == "migrate" || args[0] == "links")) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "migrate":
+		err = runMigrate(cfg, args[1], args[2:])
+	case "links":
+		err = runLinks(cfg, args[1], args[2:])
+	case "export":
+		err = runExport(cfg, args[1:])
+	case "import":
+		err = runImport(cfg, args[1:])
+	case "import-foreign":
+		err = runImportForeign(cfg, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrationDSNs возвращает базы, которые надо мигрировать: все шарды или DATABASE_DSN.
+func migrationDSNs(cfg config.Config) ([]string, error) {
+	if len(cfg.DatabaseShards) > 0 {
+		shards, err := storage.ParseShards(cfg.DatabaseShards)
+		if err != nil {
+			return nil, err
+		}
+		dsns := make([]string, 0, len(shards))
+		for _, dsn := range shards {
+			dsns = append(dsns, dsn)
+		}
+		return dsns, nil
+	}
+	if cfg.DatabaseDSN == "" {
+		return nil, errors.New("migrations need postgres: set DATABASE_DSN or -d")
+	}
+	return []string{cfg.DatabaseDSN}, nil
+}
+
+func runMigrate(cfg config.Config, command string, args []string) error {
+	fs := flag.NewFlagSet("migrate "+command, flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print sql that would be executed")
+	fs.Parse(args)
+
+	target := 0
+	switch command {
+	case "status":
+	case "up":
+		if fs.NArg() > 0 {
+			v, err := strconv.Atoi(fs.Arg(0))
+			if err != nil {
+				return fmt.Errorf("bad version %q: %w", fs.Arg(0), err)
+			}
+			target = v
+		}
+	case "down":
+		if fs.NArg() != 1 {
+			return errors.New("migrate down needs target version")
+		}
+		v, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("bad version %q: %w", fs.Arg(0), err)
+		}
+		target = v
+	default:
+		return fmt.Errorf("unknown migrate command %q", command)
+	}
+
+	dsns, err := migrationDSNs(cfg)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	for _, dsn := range dsns {
+		pool, err := pgxpool.Connect(ctx, dsn)
+		if err != nil {
+			return fmt.Errorf("unable to connect to database(dsn=%v): %w", dsn, err)
+		}
+		m, err := migrations.NewMigrator(pool)
+		if err != nil {
+			pool.Close()
+			return err
+		}
+		m.DryRun = *dryRun
+		m.Logf = func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		}
+
+		switch command {
+		case "status":
+			var version int
+			if version, err = m.Version(ctx); err == nil {
+				fmt.Printf("%v: revision %v, latest %v\n", dsn, version, m.Latest())
+			}
+		case "up":
+			err = m.Up(ctx, target)
+		case "down":
+			err = m.Down(ctx, target)
+		}
+		pool.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %w", dsn, err)
+		}
+	}
+	return nil
+}
+
+// openRepo открывает хранилище без применения миграций:
+// служебная утилита не должна неявно менять схему базы.
+func openRepo(cfg config.Config) (storage.Repository, func(), error) {
+	cfg.DatabaseMigrate = storage.MigrateCheck
+	opts, err := storage.OptionsFromConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, err := storage.Open(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	closeRepo := func() {
+		if closer, ok := repo.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return repo, closeRepo, nil
+}
+
+func openTransferable(cfg config.Config) (storage.Transferable, func(), error) {
+	repo, closeRepo, err := openRepo(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	transferable, ok := repo.(storage.Transferable)
+	if !ok {
+		closeRepo()
+		return nil, nil, fmt.Errorf("storage %T does not support export and import", repo)
+	}
+	return transferable, closeRepo, nil
+}
+
+func runExport(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "", "jsonl or csv (default by file extension, jsonl for stdout)")
+	fs.Parse(args)
+
+	repo, closeRepo, err := openTransferable(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeRepo()
+
+	out := os.Stdout
+	if fs.NArg() > 0 {
+		if out, err = os.Create(fs.Arg(0)); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if *format == "" {
+		*format = dump.FormatFromName(fs.Arg(0))
+	}
+
+	n, err := dump.Export(context.Background(), repo, out, *format)
+	if err != nil {
+		return fmt.Errorf("export failed after %v links: %w", n, err)
+	}
+	log.Printf("exported %v links", n)
+	return nil
+}
+
+func runImport(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "jsonl or csv (default by file extension, jsonl for stdin)")
+	policyName := fs.String("policy", string(storage.ConflictSkip), "on existing short url: skip, overwrite or fail")
+	batchSize := fs.Int("batch", dump.DefaultBatchSize, "links per storage write")
+	fs.Parse(args)
+
+	policy, err := storage.ParseConflictPolicy(*policyName)
+	if err != nil {
+		return err
+	}
+	repo, closeRepo, err := openTransferable(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeRepo()
+
+	in := os.Stdin
+	if fs.NArg() > 0 {
+		if in, err = os.Open(fs.Arg(0)); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	if *format == "" {
+		*format = dump.FormatFromName(fs.Arg(0))
+	}
+
+	result, err := dump.Import(context.Background(), repo, in, *format, policy, *batchSize)
+	log.Printf("imported: created %v, overwritten %v, skipped %v",
+		result.Created, result.Overwritten, result.Skipped)
+	return err
+}
+
+func runImportForeign(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("import-foreign", flag.ExitOnError)
+	userID := fs.String("user", "", "owner of imported links")
+	format := fs.String("format", "", "csv or json (default by file extension)")
+	policyName := fs.String("policy", string(storage.ConflictSkip), "on existing short code: skip, overwrite or fail")
+	dryRun := fs.Bool("dry-run", false, "only report conflicts and invalid rows")
+	fs.Parse(args)
+
+	if *userID == "" || fs.NArg() != 1 {
+		return errors.New("import-foreign needs -user and export file")
+	}
+	policy, err := storage.ParseConflictPolicy(*policyName)
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = dump.FormatJSON
+		if dump.FormatFromName(fs.Arg(0)) == dump.FormatCSV {
+			*format = dump.FormatCSV
+		}
+	}
+
+	repo, closeRepo, err := openRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeRepo()
+	target, ok := repo.(dump.ForeignTarget)
+	if !ok {
+		return fmt.Errorf("storage %T does not support import", repo)
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	opts := dump.ForeignOptions{UserID: *userID, Policy: policy, DryRun: *dryRun}
+	report, err := dump.ImportForeign(context.Background(), target, in, *format, opts)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	if len(report.Conflicts) > 0 {
+		fmt.Fprintln(w, "CONFLICT\tIMPORTED URL\tEXISTING URL\tEXISTING OWNER")
+		for _, c := range report.Conflicts {
+			code := c.Code
+			if c.Same {
+				code += " (same)"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", code, c.Destination, c.ExistingURL, c.ExistingOwner)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, row := range report.Invalid {
+		fmt.Fprintf(w, "line %v: %v\n", row.Line, row.Reason)
+	}
+	fmt.Fprintf(w, "rows: %v, invalid: %v, conflicts: %v, clicks in export (not imported): %v\n",
+		report.Total, len(report.Invalid), len(report.Conflicts), report.Clicks)
+	if report.Clicks > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %v clicks from the export are ignored, click counts are not stored\n", report.Clicks)
+	}
+	if !*dryRun {
+		fmt.Fprintf(w, "created: %v, overwritten: %v, skipped: %v\n",
+			report.Result.Created, report.Result.Overwritten, report.Result.Skipped)
+	}
+	return err
+}
+
+func runLinks(cfg config.Config, command string, args []string) error {
+	fs := flag.NewFlagSet("links "+command, flag.ExitOnError)
+	userID := fs.String("user", "", "user uuid")
+	fs.Parse(args)
+
+	if command != "info" && *userID == "" {
+		return fmt.Errorf("links %v needs -user", command)
+	}
+	if command != "list" && fs.NArg() == 0 {
+		return fmt.Errorf("links %v needs arguments", command)
+	}
+
+	repo, closeRepo, err := openRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeRepo()
+	// те же правила, что у сервиса: заблокированные ссылки нельзя создать и восстановить
+	if policyCfg := storage.PolicyFromConfig(cfg); !policyCfg.IsEmpty() {
+		records, _ := repo.(storage.Transferable)
+		policy, err := storage.NewURLPolicy(repo, records, policyCfg)
+		if err != nil {
+			return err
+		}
+		repo = policy
+	}
+
+	shorts := make([]storage.URL, 0, fs.NArg())
+	for _, arg := range fs.Args() {
+		shorts = append(shorts, storage.URL(arg))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	switch command {
+	case "list":
+		page, err := repo.ListUserURLs(context.Background(), *userID, storage.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("cannot list links: %w", err)
+		}
+		fmt.Fprintln(w, "SHORT\tSTATUS\tFOLDER\tTAGS\tLONG")
+		for _, rec := range page.Records {
+			status := "active"
+			if rec.Deleted {
+				status = "deleted"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", rec.ShortURL, status, rec.Folder, strings.Join(rec.Tags, ","), rec.LongURL)
+		}
+	case "create":
+		fmt.Fprintln(w, "SHORT\tRESULT\tLONG")
+		for _, arg := range fs.Args() {
+			long, err := storage.NormalizeLongURL(storage.URL(arg))
+			if err != nil {
+				return fmt.Errorf("cannot shorten %v: %w", arg, err)
+			}
+			short, err := repo.SaveLongURL(long, *userID)
+			result := "created"
+			if errors.Is(err, storage.ErrConflictURL) {
+				result = "exists"
+			} else if err != nil {
+				return fmt.Errorf("cannot shorten %v: %w", long, err)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\n", short, result, long)
+		}
+	case "delete":
+		return repo.DeleteUsersURLs(*userID, shorts...)
+	case "restore":
+		return repo.RestoreUsersURLs(*userID, shorts...)
+	case "info":
+		fmt.Fprintln(w, "SHORT\tOWNER\tSTATUS\tLONG")
+		for _, short := range shorts {
+			info, err := repo.GetURLInfo(short)
+			if errors.Is(err, storage.ErrNotFoundURL) {
+				fmt.Fprintf(w, "%v\t-\tnot found\t-\n", short)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("cannot get %v: %w", short, err)
+			}
+			status := "active"
+			if info.Deleted {
+				status = "deleted"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", info.ShortURL, info.UserID, status, info.LongURL)
+		}
+	default:
+		return fmt.Errorf("unknown links command %q", command)
+	}
+	return nil
+}
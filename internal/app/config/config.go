@@ -1,8 +1,47 @@
 package config
 
+import "time"
+
 type Config struct {
-	ServerAddress   string `env:"SERVER_ADDRESS" envDefault:"localhost:8080"`
-	BaseURL         string `env:"BASE_URL" envDefault:"http://localhost:8080/"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	DatabaseDSN     string `env:"DATABASE_DSN"`
+	ServerAddress           string        `env:"SERVER_ADDRESS" envDefault:"localhost:8080"`
+	BaseURL                 string        `env:"BASE_URL" envDefault:"http://localhost:8080/"`
+	FileStoragePath         string        `env:"FILE_STORAGE_PATH"`
+	DatabaseDSN             string        `env:"DATABASE_DSN"`
+	DatabaseReplicaDSNs     []string      `env:"DATABASE_REPLICA_DSN" envSeparator:","`
+	DatabaseMaxConns        int32         `env:"DATABASE_MAX_CONNS" envDefault:"10"`
+	DatabaseReplicaMaxConns int32         `env:"DATABASE_REPLICA_MAX_CONNS" envDefault:"10"`
+	DatabaseReadYourWrites  time.Duration `env:"DATABASE_READ_YOUR_WRITES" envDefault:"5s"`
+	DatabaseMigrate         string        `env:"DATABASE_MIGRATE" envDefault:"auto"`
+	DatabaseShards          []string      `env:"DATABASE_SHARDS" envSeparator:","`
+	RedisURL                string        `env:"REDIS_URL"`
+	RedisKeyPrefix          string        `env:"REDIS_KEY_PREFIX" envDefault:"shortener:"`
+	RedisTTL                time.Duration `env:"REDIS_TTL"`
+	CacheSize               int           `env:"CACHE_SIZE"`
+	CacheTTL                time.Duration `env:"CACHE_TTL" envDefault:"1m"`
+	CacheNegativeTTL        time.Duration `env:"CACHE_NEGATIVE_TTL" envDefault:"5s"`
+	PreviewWorkers          int           `env:"PREVIEW_WORKERS"`
+	PreviewTimeout          time.Duration `env:"PREVIEW_TIMEOUT" envDefault:"5s"`
+	PreviewMaxBytes         int64         `env:"PREVIEW_MAX_BYTES" envDefault:"1048576"`
+	PreviewAllowPrivate     bool          `env:"PREVIEW_ALLOW_PRIVATE"`
+	PolicyBlocklist         []string      `env:"POLICY_BLOCKLIST" envSeparator:","`
+	PolicyBlocklistFile     string        `env:"POLICY_BLOCKLIST_FILE"`
+	PolicyAllowlist         []string      `env:"POLICY_ALLOWLIST" envSeparator:","`
+	PolicyAllowlistFile     string        `env:"POLICY_ALLOWLIST_FILE"`
+	PolicyThreatFeed        string        `env:"POLICY_THREAT_FEED"`
+	PolicyReloadInterval    time.Duration `env:"POLICY_RELOAD_INTERVAL"`
+	RateShortenUser         string        `env:"RATE_SHORTEN_USER" envDefault:"60/m"`
+	RateShortenIP           string        `env:"RATE_SHORTEN_IP" envDefault:"300/m"`
+	RateBatchUser           string        `env:"RATE_BATCH_USER" envDefault:"10/m"`
+	RateBatchIP             string        `env:"RATE_BATCH_IP" envDefault:"30/m"`
+	RateRedirectUser        string        `env:"RATE_REDIRECT_USER" envDefault:"600/m"`
+	RateRedirectIP          string        `env:"RATE_REDIRECT_IP" envDefault:"1200/m"`
+	RateStore               string        `env:"RATE_STORE" envDefault:"memory"`
+	RateStoreDSN            string        `env:"RATE_STORE_DSN"`
+	QuotaDailyUser          int           `env:"QUOTA_DAILY_USER" envDefault:"1000"`
+	QuotaDailyIP            int           `env:"QUOTA_DAILY_IP" envDefault:"10000"`
+	BatchMaxSize            int           `env:"BATCH_MAX_SIZE" envDefault:"1000"`
+	IdempotencyWindow       time.Duration `env:"IDEMPOTENCY_WINDOW" envDefault:"24h"`
+	IdempotencyStore        string        `env:"IDEMPOTENCY_STORE" envDefault:"memory"`
+	IdempotencyStoreDSN     string        `env:"IDEMPOTENCY_STORE_DSN"`
+	ValidateRequests        bool          `env:"VALIDATE_REQUESTS"`
 }
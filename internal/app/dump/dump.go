@@ -0,0 +1,323 @@
+// Package dump выгружает ссылки из хранилища и загружает их обратно
+// в форматах JSON Lines и CSV.
+package dump
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-url-shortener/internal/app/storage"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatJSONLines = "jsonl"
+	FormatCSV       = "csv"
+)
+
+// csvHeader - колонки CSV, теги в колонке tags через запятую.
+// При чтении порядок колонок берется из заголовка.
+var csvHeader = []string{"short_url", "original_url", "user_id", "deleted", "created_at", "tags", "folder",
+	"updated_at", "title", "notes", "image_url"}
+
+// record - строка выгрузки в JSON Lines.
+type record struct {
+	ShortURL  storage.URL `json:"short_url"`
+	LongURL   storage.URL `json:"original_url"`
+	UserID    string      `json:"user_id,omitempty"`
+	Deleted   bool        `json:"deleted"`
+	CreatedAt *time.Time  `json:"created_at,omitempty"`
+	UpdatedAt *time.Time  `json:"updated_at,omitempty"`
+	Tags      []string    `json:"tags,omitempty"`
+	Folder    string      `json:"folder,omitempty"`
+	Title     string      `json:"title,omitempty"`
+	Notes     string      `json:"notes,omitempty"`
+	ImageURL  string      `json:"image_url,omitempty"`
+}
+
+// FormatFromName определяет формат по расширению файла, по умолчанию JSON Lines.
+func FormatFromName(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".csv") {
+		return FormatCSV
+	}
+	return FormatJSONLines
+}
+
+type Encoder interface {
+	Encode(rec storage.URLRecord) error
+	Flush() error
+}
+
+func NewEncoder(w io.Writer, format string) (Encoder, error) {
+	switch format {
+	case FormatJSONLines:
+		return &jsonEncoder{enc: json.NewEncoder(w)}, nil
+	case FormatCSV:
+		return &csvEncoder{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonEncoder) Encode(rec storage.URLRecord) error {
+	r := record{ShortURL: rec.ShortURL, LongURL: rec.LongURL, UserID: rec.UserID, Deleted: rec.Deleted,
+		Tags: rec.Tags, Folder: rec.Folder, Title: rec.Title, Notes: rec.Notes, ImageURL: rec.ImageURL}
+	if !rec.CreatedAt.IsZero() {
+		createdAt := rec.CreatedAt.UTC()
+		r.CreatedAt = &createdAt
+	}
+	if !rec.UpdatedAt.IsZero() {
+		updatedAt := rec.UpdatedAt.UTC()
+		r.UpdatedAt = &updatedAt
+	}
+	return e.enc.Encode(r)
+}
+
+func (e *jsonEncoder) Flush() error {
+	return nil
+}
+
+type csvEncoder struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (e *csvEncoder) Encode(rec storage.URLRecord) error {
+	if !e.headerWritten {
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+	return e.w.Write([]string{
+		rec.ShortURL.S(), rec.LongURL.S(), rec.UserID, strconv.FormatBool(rec.Deleted), formatTime(rec.CreatedAt),
+		strings.Join(rec.Tags, ","), rec.Folder, formatTime(rec.UpdatedAt), rec.Title, rec.Notes,
+		rec.ImageURL,
+	})
+}
+
+// formatTime - время в колонке CSV, нулевое - пустая строка.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (e *csvEncoder) Flush() error {
+	if !e.headerWritten {
+		// пустая выгрузка - все равно валидный CSV с заголовком
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// Decoder читает записи по одной; в конце возвращает io.EOF.
+type Decoder interface {
+	Decode() (storage.URLRecord, error)
+}
+
+func NewDecoder(r io.Reader, format string) (Decoder, error) {
+	switch format {
+	case FormatJSONLines:
+		return &jsonDecoder{dec: json.NewDecoder(r)}, nil
+	case FormatCSV:
+		return newCSVDecoder(r)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type jsonDecoder struct {
+	dec  *json.Decoder
+	line int
+}
+
+func (d *jsonDecoder) Decode() (storage.URLRecord, error) {
+	var r record
+	d.line++
+	if err := d.dec.Decode(&r); err != nil {
+		if errors.Is(err, io.EOF) {
+			return storage.URLRecord{}, io.EOF
+		}
+		return storage.URLRecord{}, fmt.Errorf("record %v: %w", d.line, err)
+	}
+	rec := storage.URLRecord{ShortURL: r.ShortURL, LongURL: r.LongURL, UserID: r.UserID, Deleted: r.Deleted,
+		Tags: r.Tags, Folder: r.Folder, Title: r.Title, Notes: r.Notes, ImageURL: r.ImageURL}
+	if r.CreatedAt != nil {
+		rec.CreatedAt = *r.CreatedAt
+	}
+	if r.UpdatedAt != nil {
+		rec.UpdatedAt = *r.UpdatedAt
+	}
+	return validate(rec, d.line)
+}
+
+type csvDecoder struct {
+	r       *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+func newCSVDecoder(r io.Reader) (*csvDecoder, error) {
+	d := &csvDecoder{r: csv.NewReader(r), columns: make(map[string]int)}
+	header, err := d.r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read csv header: %w", err)
+	}
+	for i, name := range header {
+		d.columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range csvHeader[:2] {
+		if _, found := d.columns[name]; !found {
+			return nil, fmt.Errorf("csv header has no %q column", name)
+		}
+	}
+	d.line = 1
+	return d, nil
+}
+
+func (d *csvDecoder) field(row []string, name string) string {
+	if i, found := d.columns[name]; found && i < len(row) {
+		return strings.TrimSpace(row[i])
+	}
+	return ""
+}
+
+func (d *csvDecoder) Decode() (storage.URLRecord, error) {
+	row, err := d.r.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return storage.URLRecord{}, io.EOF
+		}
+		return storage.URLRecord{}, err
+	}
+	d.line++
+
+	rec := storage.URLRecord{
+		ShortURL: storage.URL(d.field(row, "short_url")),
+		LongURL:  storage.URL(d.field(row, "original_url")),
+		UserID:   d.field(row, "user_id"),
+		Folder:   d.field(row, "folder"),
+		Title:    d.field(row, "title"),
+		Notes:    d.field(row, "notes"),
+		ImageURL: d.field(row, "image_url"),
+	}
+	if tags := d.field(row, "tags"); tags != "" {
+		rec.Tags = strings.Split(tags, ",")
+	}
+	if deleted := d.field(row, "deleted"); deleted != "" {
+		if rec.Deleted, err = strconv.ParseBool(deleted); err != nil {
+			return storage.URLRecord{}, fmt.Errorf("line %v: bad deleted: %w", d.line, err)
+		}
+	}
+	if createdAt := d.field(row, "created_at"); createdAt != "" {
+		if rec.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return storage.URLRecord{}, fmt.Errorf("line %v: bad created_at: %w", d.line, err)
+		}
+	}
+	if updatedAt := d.field(row, "updated_at"); updatedAt != "" {
+		if rec.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+			return storage.URLRecord{}, fmt.Errorf("line %v: bad updated_at: %w", d.line, err)
+		}
+	}
+	return validate(rec, d.line)
+}
+
+// validate проверяет запись и нормализует теги, папку, заголовок, заметки и картинку.
+func validate(rec storage.URLRecord, line int) (storage.URLRecord, error) {
+	if rec.ShortURL == "" || rec.LongURL == "" {
+		return storage.URLRecord{}, fmt.Errorf("record %v: short_url and original_url are required", line)
+	}
+	var err error
+	if len(rec.Tags) > 0 {
+		if rec.Tags, err = storage.NormalizeTags(rec.Tags); err != nil {
+			return storage.URLRecord{}, fmt.Errorf("record %v: %w", line, err)
+		}
+	}
+	if rec.Folder, err = storage.NormalizeFolder(rec.Folder); err != nil {
+		return storage.URLRecord{}, fmt.Errorf("record %v: %w", line, err)
+	}
+	if rec.Title, err = storage.NormalizeTitle(rec.Title); err != nil {
+		return storage.URLRecord{}, fmt.Errorf("record %v: %w", line, err)
+	}
+	if rec.Notes, err = storage.NormalizeNotes(rec.Notes); err != nil {
+		return storage.URLRecord{}, fmt.Errorf("record %v: %w", line, err)
+	}
+	if rec.ImageURL, err = storage.NormalizeImageURL(rec.ImageURL); err != nil {
+		return storage.URLRecord{}, fmt.Errorf("record %v: %w", line, err)
+	}
+	return rec, nil
+}
+
+// Export пишет все ссылки src в w и возвращает их количество.
+func Export(ctx context.Context, src storage.Transferable, w io.Writer, format string) (int, error) {
+	enc, err := NewEncoder(w, format)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = src.ExportURLs(ctx, func(rec storage.URLRecord) error {
+		count++
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, enc.Flush()
+}
+
+// DefaultBatchSize - сколько записей Import передает хранилищу за раз.
+const DefaultBatchSize = 500
+
+// Import читает записи из r и сохраняет их в dst пачками по batchSize.
+// Пачки, сохраненные до ошибки, остаются в хранилище.
+func Import(ctx context.Context, dst storage.Transferable, r io.Reader, format string,
+	policy storage.ConflictPolicy, batchSize int) (storage.ImportResult, error) {
+	var result storage.ImportResult
+	dec, err := NewDecoder(r, format)
+	if err != nil {
+		return result, err
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	batch := make([]storage.URLRecord, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		batchResult, err := dst.ImportURLs(ctx, batch, policy)
+		result.Add(batchResult)
+		batch = batch[:0]
+		return err
+	}
+	for {
+		rec, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		batch = append(batch, rec)
+		if len(batch) == batchSize {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
@@ -0,0 +1,111 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-url-shortener/internal/app/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportAll(t *testing.T, src storage.Transferable) []storage.URLRecord {
+	var records []storage.URLRecord
+	err := src.ExportURLs(context.Background(), func(rec storage.URLRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	require.NoError(t, err)
+	return records
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	src := storage.NewMemoryMap()
+	createdAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	_, err := src.ImportURLs(context.Background(), []storage.URLRecord{
+		{ShortURL: "7d7cbdab", LongURL: "https://ya.ru", UserID: "u1", CreatedAt: createdAt,
+			Tags: []string{"deck", "q3"}, Folder: "campaigns/q3"},
+		{ShortURL: "2f82f1da", LongURL: "https://ya.ru/2?a=1,b=2", UserID: "u2", Deleted: true, CreatedAt: createdAt,
+			UpdatedAt: createdAt.Add(time.Hour), Title: "Second, with comma", Notes: "line one\nline \"two\""},
+	}, storage.ConflictFail)
+	require.NoError(t, err)
+
+	for _, format := range []string{FormatJSONLines, FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			n, err := Export(context.Background(), src, &buf, format)
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+
+			dst := storage.NewMemoryMap()
+			got, err := Import(context.Background(), dst, &buf, format, storage.ConflictFail, 1)
+			require.NoError(t, err)
+			assert.Equal(t, storage.ImportResult{Created: 2}, got)
+			assert.Equal(t, exportAll(t, src), exportAll(t, dst))
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		policy  storage.ConflictPolicy
+		want    storage.ImportResult
+		wantErr bool
+	}{
+		{
+			name:    "Test #1 csv columns in any order, optional columns missing",
+			format:  FormatCSV,
+			content: "original_url,short_url\nhttps://ya.ru/new,new1\nhttps://ya.ru,7d7cbdab\n",
+			policy:  storage.ConflictSkip,
+			want:    storage.ImportResult{Created: 1, Skipped: 1},
+		},
+		{
+			name:    "Test #2 csv without required column",
+			format:  FormatCSV,
+			content: "short_url,user_id\nnew1,u1\n",
+			policy:  storage.ConflictSkip,
+			wantErr: true,
+		},
+		{
+			name:    "Test #3 jsonl overwrite",
+			format:  FormatJSONLines,
+			content: `{"short_url":"7d7cbdab","original_url":"https://ya.ru/other","user_id":"u2"}` + "\n",
+			policy:  storage.ConflictOverwrite,
+			want:    storage.ImportResult{Overwritten: 1},
+		},
+		{
+			name:    "Test #4 jsonl record without long url",
+			format:  FormatJSONLines,
+			content: `{"short_url":"7d7cbdab"}` + "\n",
+			policy:  storage.ConflictSkip,
+			wantErr: true,
+		},
+		{
+			name:    "Test #5 fail on conflict",
+			format:  FormatJSONLines,
+			content: `{"short_url":"7d7cbdab","original_url":"https://ya.ru/other"}` + "\n",
+			policy:  storage.ConflictFail,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := storage.NewMemoryMap()
+			_, err := dst.SaveLongURL("https://ya.ru", "u1")
+			require.NoError(t, err)
+
+			got, err := Import(context.Background(), dst, strings.NewReader(tt.content), tt.format, tt.policy, 0)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package dump
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-url-shortener/internal/app/storage"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatJSON - выгрузка другого сервиса: JSON-массив объектов или объекты по одному на строку.
+const FormatJSON = "json"
+
+// foreignColumns - названия колонок (ключей) в выгрузках распространенных сокращателей
+// (Bitly, Rebrandly, Short.io, TinyURL, YOURLS). Сравниваются без регистра, пробелов, '_' и '-'.
+var foreignColumns = map[string][]string{
+	"code": {"custombackhalf", "backhalf", "slashtag", "alias", "keyword", "path",
+		"shortcode", "code", "shorturl", "shortlink", "link", "short"},
+	"destination": {"destination", "longurl", "originalurl", "destinationurl", "targeturl",
+		"target", "url", "long"},
+	"created": {"created", "createdat", "createdate", "datecreated", "creationdate", "timestamp", "date"},
+	"clicks":  {"clicks", "totalclicks", "clickcount", "clickscount", "hits", "visits"},
+}
+
+// foreignTimeLayouts - форматы дат, встречающиеся в выгрузках.
+var foreignTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"01/02/2006 15:04:05",
+	"01/02/2006 15:04",
+	"01/02/2006",
+}
+
+// codePattern - коды, которые можно отдать как путь /{short}.
+var codePattern = regexp.MustCompile(`^[A-Za-z0-9_.~-]+$`)
+
+// reservedCodes совпадают с путями самого сервиса.
+var reservedCodes = map[string]bool{"api": true, "ping": true}
+
+func normalizeColumn(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(name)
+}
+
+// ForeignRecord - ссылка из выгрузки другого сервиса.
+type ForeignRecord struct {
+	Line        int
+	Code        string
+	Destination string
+	CreatedAt   time.Time
+	Clicks      int64
+}
+
+// foreignRow - значения одной строки по нормализованным названиям колонок.
+type foreignRow map[string]string
+
+func (row foreignRow) get(field string) string {
+	for _, name := range foreignColumns[field] {
+		if v := strings.TrimSpace(row[name]); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func parseForeignRow(line int, row foreignRow) (ForeignRecord, error) {
+	rec := ForeignRecord{Line: line, Destination: row.get("destination")}
+
+	code := row.get("code")
+	// короткая ссылка целиком: https://bit.ly/abc или bit.ly/abc -> abc
+	if strings.Contains(code, "://") {
+		if u, err := url.Parse(code); err == nil {
+			code = u.Path
+		}
+	} else if host, path, found := strings.Cut(code, "/"); found && strings.Contains(host, ".") {
+		code = path
+	}
+	rec.Code = strings.Trim(code, "/")
+	switch {
+	case rec.Code == "":
+		return rec, errors.New("no short code")
+	case !codePattern.MatchString(rec.Code):
+		return rec, fmt.Errorf("short code %q has unsupported characters", rec.Code)
+	case reservedCodes[strings.ToLower(rec.Code)]:
+		return rec, fmt.Errorf("short code %q is reserved", rec.Code)
+	}
+
+	u, err := url.Parse(rec.Destination)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return rec, fmt.Errorf("bad destination %q", rec.Destination)
+	}
+
+	if created := row.get("created"); created != "" {
+		if rec.CreatedAt, err = parseForeignTime(created); err != nil {
+			return rec, err
+		}
+	}
+	if clicks := row.get("clicks"); clicks != "" {
+		if rec.Clicks, err = strconv.ParseInt(strings.ReplaceAll(clicks, ",", ""), 10, 64); err != nil {
+			return rec, fmt.Errorf("bad click count %q", clicks)
+		}
+	}
+	return rec, nil
+}
+
+func parseForeignTime(s string) (time.Time, error) {
+	for _, layout := range foreignTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if sec > 1e12 {
+			return time.UnixMilli(sec).UTC(), nil
+		}
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("bad created date %q", s)
+}
+
+// InvalidRow - строка выгрузки, которую нельзя импортировать.
+type InvalidRow struct {
+	Line   int
+	Reason string
+}
+
+// ReadForeign разбирает выгрузку в формате FormatCSV или FormatJSON.
+// Строки с ошибками не прерывают чтение, а возвращаются отдельно.
+func ReadForeign(r io.Reader, format string) ([]ForeignRecord, []InvalidRow, error) {
+	var records []ForeignRecord
+	var invalid []InvalidRow
+	add := func(line int, row foreignRow) {
+		rec, err := parseForeignRow(line, row)
+		if err != nil {
+			invalid = append(invalid, InvalidRow{Line: line, Reason: err.Error()})
+			return
+		}
+		records = append(records, rec)
+	}
+
+	switch format {
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read csv header: %w", err)
+		}
+		for i := range header {
+			header[i] = normalizeColumn(strings.TrimPrefix(header[i], "\ufeff"))
+		}
+		for line := 2; ; line++ {
+			values, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			row := make(foreignRow, len(header))
+			for i, v := range values {
+				if i < len(header) {
+					row[header[i]] = v
+				}
+			}
+			add(line, row)
+		}
+	case FormatJSON:
+		err := readJSONObjects(r, func(n int, obj map[string]interface{}) {
+			row := make(foreignRow, len(obj))
+			for k, v := range obj {
+				switch v := v.(type) {
+				case string:
+					row[normalizeColumn(k)] = v
+				case float64:
+					row[normalizeColumn(k)] = strconv.FormatFloat(v, 'f', -1, 64)
+				}
+			}
+			add(n, row)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown format %q", format)
+	}
+	return records, invalid, nil
+}
+
+// readJSONObjects читает JSON-массив объектов или поток объектов,
+// в том числе обернутый в объект с единственным ключом-массивом ({"links": [...]}).
+func readJSONObjects(r io.Reader, fn func(n int, obj map[string]interface{})) error {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return err
+	}
+	if first == '[' {
+		if _, err = dec.Token(); err != nil {
+			return err
+		}
+		for n := 1; dec.More(); n++ {
+			var obj map[string]interface{}
+			if err = dec.Decode(&obj); err != nil {
+				return fmt.Errorf("record %v: %w", n, err)
+			}
+			fn(n, obj)
+		}
+		return nil
+	}
+
+	for n := 1; ; n++ {
+		var obj map[string]interface{}
+		if err = dec.Decode(&obj); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %v: %w", n, err)
+		}
+		if list, ok := singleArray(obj); ok && n == 1 {
+			for i, item := range list {
+				if itemObj, ok := item.(map[string]interface{}); ok {
+					fn(i+1, itemObj)
+				}
+			}
+			continue
+		}
+		fn(n, obj)
+	}
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		}
+		return b[0], nil
+	}
+}
+
+func singleArray(obj map[string]interface{}) ([]interface{}, bool) {
+	if len(obj) != 1 {
+		return nil, false
+	}
+	for _, v := range obj {
+		list, ok := v.([]interface{})
+		return list, ok
+	}
+	return nil, false
+}
+
+// ForeignTarget - хранилище, в которое импортируются выгрузки других сервисов.
+type ForeignTarget interface {
+	storage.Transferable
+	GetURLInfo(short storage.URL) (storage.URLRecord, error)
+}
+
+// ForeignOptions - параметры импорта выгрузки другого сервиса.
+type ForeignOptions struct {
+	// UserID - владелец всех импортируемых ссылок.
+	UserID    string
+	Policy    storage.ConflictPolicy
+	DryRun    bool
+	BatchSize int
+}
+
+// ForeignConflict - код из выгрузки, который уже занят.
+type ForeignConflict struct {
+	Code          string
+	Destination   string
+	ExistingURL   storage.URL
+	ExistingOwner string
+	// Same - существующая ссылка ведет туда же и принадлежит тому же пользователю.
+	Same bool
+}
+
+// ForeignReport - итог импорта (или проверки при DryRun).
+type ForeignReport struct {
+	Total     int
+	Result    storage.ImportResult
+	Conflicts []ForeignConflict
+	Invalid   []InvalidRow
+	// Clicks - сумма переходов из выгрузки. Счетчиков переходов в сервисе нет, поэтому они
+	// не импортируются и попадают только в отчет.
+	Clicks int64
+}
+
+// ImportForeign импортирует ссылки из выгрузки другого сервиса, сохраняя их коды.
+// Переходы не импортируются, их сумма - в ForeignReport.Clicks. Повтор кода в выгрузке -
+// неверная строка, а при ConflictFail импорт не выполняется вовсе, как при занятом коде.
+// При DryRun только проверяет строки и ищет конфликты с существующими кодами.
+func ImportForeign(ctx context.Context, dst ForeignTarget, r io.Reader, format string, opts ForeignOptions) (ForeignReport, error) {
+	var report ForeignReport
+	if opts.UserID == "" {
+		return report, errors.New("owner user id is required")
+	}
+	records, invalid, err := ReadForeign(r, format)
+	if err != nil {
+		return report, err
+	}
+	report.Total = len(records) + len(invalid)
+	report.Invalid = invalid
+
+	seen := make(map[string]int, len(records))
+	toImport := make([]storage.URLRecord, 0, len(records))
+	var repeated error
+	for _, rec := range records {
+		if line, found := seen[rec.Code]; found {
+			reason := fmt.Sprintf("short code %q repeats line %v", rec.Code, line)
+			report.Invalid = append(report.Invalid, InvalidRow{Line: rec.Line, Reason: reason})
+			if repeated == nil {
+				repeated = fmt.Errorf("%w: line %v: %v", storage.ErrImportConflict, rec.Line, reason)
+			}
+			continue
+		}
+		seen[rec.Code] = rec.Line
+		report.Clicks += rec.Clicks
+
+		existing, err := dst.GetURLInfo(storage.URL(rec.Code))
+		switch {
+		case err == nil:
+			report.Conflicts = append(report.Conflicts, ForeignConflict{
+				Code:          rec.Code,
+				Destination:   rec.Destination,
+				ExistingURL:   existing.LongURL,
+				ExistingOwner: existing.UserID,
+				Same:          existing.LongURL.S() == rec.Destination && existing.UserID == opts.UserID,
+			})
+		case !errors.Is(err, storage.ErrNotFoundURL):
+			return report, fmt.Errorf("cannot check short code %q: %w", rec.Code, err)
+		}
+		toImport = append(toImport, storage.URLRecord{
+			ShortURL:  storage.URL(rec.Code),
+			LongURL:   storage.URL(rec.Destination),
+			UserID:    opts.UserID,
+			CreatedAt: rec.CreatedAt,
+		})
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+	if opts.Policy == storage.ConflictFail && repeated != nil {
+		return report, repeated
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	for start := 0; start < len(toImport); start += batchSize {
+		end := start + batchSize
+		if end > len(toImport) {
+			end = len(toImport)
+		}
+		result, err := dst.ImportURLs(ctx, toImport[start:end], opts.Policy)
+		report.Result.Add(result)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
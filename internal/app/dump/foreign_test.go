@@ -0,0 +1,114 @@
+package dump
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-url-shortener/internal/app/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadForeign(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		content     string
+		want        []ForeignRecord
+		wantInvalid []int
+	}{
+		{
+			name:   "Test #1 bitly-like csv",
+			format: FormatCSV,
+			content: "Created,Title,Link,Custom back-half,Long URL,Total Clicks\n" +
+				"2022-05-01 12:00:00,Ya,https://bit.ly/3abcDEF,,https://ya.ru,\"1,024\"\n" +
+				"2022-05-02 12:00:00,Go,https://bit.ly/xyz,golang,https://go.dev,7\n" +
+				"2022-05-03 12:00:00,Bad,https://bit.ly/bad,,ftp://ya.ru,1\n",
+			want: []ForeignRecord{
+				{Line: 2, Code: "3abcDEF", Destination: "https://ya.ru",
+					CreatedAt: time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC), Clicks: 1024},
+				{Line: 3, Code: "golang", Destination: "https://go.dev",
+					CreatedAt: time.Date(2022, 5, 2, 12, 0, 0, 0, time.UTC), Clicks: 7},
+			},
+			wantInvalid: []int{4},
+		},
+		{
+			name:   "Test #2 rebrandly-like json array",
+			format: FormatJSON,
+			content: `[{"slashtag": "promo", "destination": "https://ya.ru/promo", "createdAt": "2022-05-01T12:00:00Z", "clicks": 3},
+				{"slashtag": "a/b", "destination": "https://ya.ru"}]`,
+			want: []ForeignRecord{
+				{Line: 1, Code: "promo", Destination: "https://ya.ru/promo",
+					CreatedAt: time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC), Clicks: 3},
+			},
+			wantInvalid: []int{2},
+		},
+		{
+			name:    "Test #3 wrapped json with short.io keys",
+			format:  FormatJSON,
+			content: `{"links": [{"path": "/api", "originalURL": "https://ya.ru"}, {"shortURL": "sho.rt/x1", "originalURL": "https://ya.ru/x"}]}`,
+			want: []ForeignRecord{
+				{Line: 2, Code: "x1", Destination: "https://ya.ru/x"},
+			},
+			wantInvalid: []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, invalid, err := ReadForeign(strings.NewReader(tt.content), tt.format)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			var lines []int
+			for _, row := range invalid {
+				lines = append(lines, row.Line)
+			}
+			assert.Equal(t, tt.wantInvalid, lines)
+		})
+	}
+}
+
+func TestImportForeign(t *testing.T) {
+	content := "alias,url,hits\n" +
+		"taken,https://ya.ru/other,1\n" +
+		"mine,https://ya.ru/mine,2\n" +
+		"fresh,https://ya.ru/fresh,3\n" +
+		"fresh,https://ya.ru/again,4\n"
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+
+	dst := storage.NewMemoryMap()
+	dst.SetLongURL("https://ya.ru/taken", "taken", "someone")
+	dst.SetLongURL("https://ya.ru/mine", "mine", userID)
+
+	opts := ForeignOptions{UserID: userID, Policy: storage.ConflictSkip, DryRun: true}
+	report, err := ImportForeign(context.Background(), dst, strings.NewReader(content), FormatCSV, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Total)
+	assert.Equal(t, int64(6), report.Clicks)
+	assert.Equal(t, []ForeignConflict{
+		{Code: "taken", Destination: "https://ya.ru/other", ExistingURL: "https://ya.ru/taken", ExistingOwner: "someone"},
+		{Code: "mine", Destination: "https://ya.ru/mine", ExistingURL: "https://ya.ru/mine", ExistingOwner: userID, Same: true},
+	}, report.Conflicts)
+	require.Len(t, report.Invalid, 1)
+	assert.Equal(t, 5, report.Invalid[0].Line)
+	_, err = dst.GetLongURL("fresh")
+	assert.ErrorIs(t, err, storage.ErrNotFoundURL, "dry run must not write")
+
+	opts.DryRun = false
+	report, err = ImportForeign(context.Background(), dst, strings.NewReader(content), FormatCSV, opts)
+	require.NoError(t, err)
+	assert.Equal(t, storage.ImportResult{Created: 1, Skipped: 2}, report.Result)
+	long, err := dst.GetLongURL("fresh")
+	require.NoError(t, err)
+	assert.Equal(t, storage.URL("https://ya.ru/fresh"), long)
+	assert.Len(t, dst.GetUsersURLs(userID), 2)
+
+	// при fail повтор кода в файле - конфликт, ничего не импортируется
+	clean := storage.NewMemoryMap()
+	opts.Policy = storage.ConflictFail
+	report, err = ImportForeign(context.Background(), clean, strings.NewReader(content), FormatCSV, opts)
+	assert.ErrorIs(t, err, storage.ErrImportConflict)
+	require.Len(t, report.Invalid, 1)
+	_, err = clean.GetLongURL("fresh")
+	assert.ErrorIs(t, err, storage.ErrNotFoundURL)
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
@@ -15,6 +17,26 @@ type MainHandler struct {
 	*chi.Mux
 	Repository storage.Repository
 	Location   string
+	// Previews - фоновая загрузка заголовков новых ссылок, nil - выключена.
+	Previews    PreviewQueue
+	Limits      Limits
+	Idempotency Idempotency
+	// ValidateRequests - проверять JSON тела запросов по спецификации openapi.
+	ValidateRequests bool
+}
+
+// PreviewQueue - очередь загрузки заголовка и картинки страницы (preview.Fetcher).
+// Enqueue не должен блокировать запрос.
+type PreviewQueue interface {
+	Enqueue(userID string, short storage.URL, long storage.URL) bool
+}
+
+// enqueuePreview просит загрузить заголовок ссылки, если пользователь не задал его сам.
+func (h *MainHandler) enqueuePreview(userID string, short storage.URL, long storage.URL, title string) {
+	if h.Previews == nil || title != "" {
+		return
+	}
+	h.Previews.Enqueue(userID, short, long)
 }
 
 func NewMainHandler(repository storage.Repository, location string) *MainHandler {
@@ -29,18 +51,24 @@ func NewMainHandler(repository storage.Repository, location string) *MainHandler
 	h.Use(middleware.Logger)
 	h.Use(middleware.Recoverer)
 	h.Use(authMiddleware(secretKey))
-	h.Post("/", h.PostLongGetShort())
+	h.Use(h.validateRequest)
+	h.With(h.rateLimit(RouteShorten), h.idempotent).Post("/", h.PostLongGetShort())
 	h.Get("/ping", h.PingDB())
 	h.Route("/api", func(r chi.Router) {
 		r.Route("/shorten", func(r chi.Router) {
-			r.Post("/", h.PostLongGetShortJSON())
-			r.Post("/batch", h.PostLongGetShortBatchJSON())
+			r.With(h.rateLimit(RouteShorten), h.idempotent).Post("/", h.PostLongGetShortJSON())
+			r.With(h.rateLimit(RouteBatch), h.idempotent).Post("/batch", h.PostLongGetShortBatchJSON())
 		})
 		r.Get("/user/urls", h.GetUserUrlsJSON())
+		r.Get("/user/urls/search", h.SearchUserUrlsJSON())
+		r.Patch("/user/urls/{short}", h.EditUserURLJSON())
 		r.Delete("/user/urls", h.DeleteUserShortUrlsJSON())
+		r.Get("/openapi.json", h.OpenAPISpec())
+		r.Get("/docs", h.SwaggerUI())
+		r.Route("/v2", h.routeAPIv2)
 	})
 
-	h.Get("/{short}", h.GetLong())
+	h.With(h.rateLimit(RouteRedirect)).Get("/{short}", h.GetLong())
 
 	return h
 }
@@ -73,6 +101,42 @@ func (h *MainHandler) GetLong() http.HandlerFunc {
 	}
 }
 
+// ErrorResponse - тело ответа с ошибкой для клиентов, которые ждут json.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()}); err != nil {
+		log.Println("write answer error", err)
+	}
+}
+
+// maxBufferedBody - предельный размер тела запроса, которое middleware читает целиком (10 МиБ).
+// Тело больше - 413. Поэтому с Idempotency-Key или VALIDATE_REQUESTS пачка ссылок ограничена
+// этим размером и держится в памяти целиком, а потоковое чтение decodeBatch работает только без них.
+const maxBufferedBody = 10 << 20
+
+var ErrRequestTooLarge = errors.New("request body is too large")
+
+// bufferBody читает тело запроса целиком и подменяет r.Body копией, чтобы его прочитал и обработчик.
+// Если тело не прочитать, отвечает ошибкой и возвращает false.
+func bufferBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBufferedBody+1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if len(body) > maxBufferedBody {
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrRequestTooLarge)
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
 func (h *MainHandler) PostLongGetShort() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session := GetSession(r)
@@ -83,9 +147,18 @@ func (h *MainHandler) PostLongGetShort() http.HandlerFunc {
 			log.Println("string read error", err)
 			return
 		}
-		longStr := storage.URL(long)
+		longStr, err := storage.NormalizeLongURL(storage.URL(long))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		quota, ok := h.reserveQuota(w, r, 1)
+		if !ok {
+			return
+		}
 		status := http.StatusCreated
 		shortURL, err := h.Repository.SaveLongURL(longStr, session.UserID)
+		quota.keep(savedOne(err))
 		if err != nil {
 			if errors.Is(err, storage.ErrConflictURL) {
 				status = http.StatusConflict
@@ -94,12 +167,16 @@ func (h *MainHandler) PostLongGetShort() http.HandlerFunc {
 					shortURL = e.ShortURL
 				}
 
+			} else if errors.Is(err, storage.ErrBlockedURL) {
+				writeJSONError(w, http.StatusForbidden, err)
+				return
 			} else {
 				w.WriteHeader(http.StatusBadRequest)
 				log.Println("cant make short url", err)
 				return
 			}
 		}
+		h.enqueuePreview(session.UserID, shortURL, longStr, "")
 		w.WriteHeader(status)
 		_, err = fmt.Fprint(w, h.Location+shortURL.S())
 		if err != nil {
@@ -1,22 +1,93 @@
 package handlers
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
 	"go-url-shortener/internal/app/storage"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type GetUserUrlsJSONResponse []storage.URLPair
 
+const (
+	userUrlsFormatJSON   = "json"
+	userUrlsFormatCSV    = "csv"
+	userUrlsFormatNDJSON = "ndjson"
+)
+
+// userUrlsFormat выбирает формат списка ссылок: параметр format важнее заголовка Accept.
+func userUrlsFormat(r *http.Request) (string, bool) {
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case "":
+	case userUrlsFormatJSON, userUrlsFormatCSV, userUrlsFormatNDJSON:
+		return format, true
+	case "jsonl":
+		return userUrlsFormatNDJSON, true
+	default:
+		return "", false
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return userUrlsFormatCSV, true
+	case strings.Contains(accept, "application/x-ndjson"), strings.Contains(accept, "application/jsonl"):
+		return userUrlsFormatNDJSON, true
+	}
+	return userUrlsFormatJSON, true
+}
+
+// UserURLRecord - строка выгрузки ссылок пользователя в CSV и NDJSON.
+type UserURLRecord struct {
+	ShortURL  storage.URL `json:"short_url"`
+	LongURL   storage.URL `json:"original_url"`
+	CreatedAt *time.Time  `json:"created_at,omitempty"`
+	Deleted   bool        `json:"deleted"`
+	Tags      []string    `json:"tags,omitempty"`
+	Folder    string      `json:"folder,omitempty"`
+	UpdatedAt *time.Time  `json:"updated_at,omitempty"`
+	Title     string      `json:"title,omitempty"`
+	Notes     string      `json:"notes,omitempty"`
+	ImageURL  string      `json:"image_url,omitempty"`
+}
+
+// userUrlsCSVHeader - колонки CSV, теги в колонке tags через запятую.
+var userUrlsCSVHeader = []string{"short_url", "original_url", "created_at", "deleted", "tags", "folder",
+	"updated_at", "title", "notes", "image_url"}
+
 func (h *MainHandler) GetUserUrlsJSON() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var responseJSON GetUserUrlsJSONResponse
 		session := GetSession(r)
-		responseJSON = h.Repository.GetUsersURLs(session.UserID)
-		for indx, record := range responseJSON {
-			responseJSON[indx].ShortURL = storage.URL(h.Location + record.ShortURL.S())
+		format, ok := userUrlsFormat(r)
+		if !ok {
+			http.Error(w, "unsupported format, expected json, csv or ndjson", http.StatusBadRequest)
+			return
+		}
+		opts, err := userListOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if format != userUrlsFormatJSON {
+			h.streamUserUrls(w, r, session.UserID, format, opts)
+			return
+		}
+		page, err := h.Repository.ListUserURLs(r.Context(), session.UserID, opts)
+		if err != nil {
+			h.writeListError(w, r, err)
+			return
+		}
+		setNextPage(w, r, page.NextCursor)
+		for _, record := range page.Records {
+			responseJSON = append(responseJSON, h.urlPair(record))
 		}
 		encoder := json.NewEncoder(w)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -24,12 +95,301 @@ func (h *MainHandler) GetUserUrlsJSON() http.HandlerFunc {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		err := encoder.Encode(responseJSON)
+		err = encoder.Encode(responseJSON)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("write answer error", err)
+			return
+		}
+	}
+}
+
+// urlPair - ссылка пользователя в ответе API.
+func (h *MainHandler) urlPair(record storage.URLRecord) storage.URLPair {
+	return storage.URLPair{
+		ShortURL:  storage.URL(h.Location + record.ShortURL.S()),
+		LongURL:   record.LongURL,
+		Title:     record.Title,
+		Notes:     record.Notes,
+		ImageURL:  record.ImageURL,
+		Tags:      record.Tags,
+		Folder:    record.Folder,
+		CreatedAt: utcTime(record.CreatedAt),
+		UpdatedAt: utcTime(record.UpdatedAt),
+	}
+}
+
+// utcTime - время для ответа API, нулевое - nil, чтобы не попасть в JSON.
+func utcTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// csvTime - время в колонке CSV.
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// userListOptions разбирает параметры списка: limit, cursor, sort (created, short),
+// order (asc, desc), domain, q (подстрока ссылки), deleted (true, false), tag и folder
+// (пустой folder - ссылки без папки).
+func userListOptions(r *http.Request) (storage.ListOptions, error) {
+	query := r.URL.Query()
+	opts := storage.ListOptions{
+		Sort:     storage.SortField(query.Get("sort")),
+		Cursor:   query.Get("cursor"),
+		Domain:   query.Get("domain"),
+		Contains: query.Get("q"),
+		Tag:      query.Get("tag"),
+	}
+	if query.Has("folder") {
+		folder, err := storage.NormalizeFolder(query.Get("folder"))
+		if err != nil {
+			return opts, err
+		}
+		opts.Folder = &folder
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > storage.MaxListLimit {
+			return opts, fmt.Errorf("limit must be from 1 to %v", storage.MaxListLimit)
+		}
+		opts.Limit = n
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+	if deleted := query.Get("deleted"); deleted != "" {
+		v, err := strconv.ParseBool(deleted)
+		if err != nil {
+			return opts, errors.New("deleted must be true or false")
+		}
+		opts.Deleted = &v
+	}
+	return opts, opts.Validate()
+}
+
+// setNextPage сообщает курсор следующей страницы заголовками Link и X-Next-Cursor.
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor string) {
+	if cursor == "" {
+		return
+	}
+	next := *r.URL
+	query := next.Query()
+	query.Set("cursor", cursor)
+	next.RawQuery = query.Encode()
+	w.Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, next.RequestURI()))
+	w.Header().Set("X-Next-Cursor", cursor)
+}
+
+func (h *MainHandler) writeListError(w http.ResponseWriter, r *http.Request, err error) {
+	if isAPIv2(r) {
+		h.fail(w, r, err, nil)
+		return
+	}
+	if errors.Is(err, storage.ErrBadCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	log.Println("list user urls error", err)
+}
+
+// streamUserUrls пишет ссылки пользователя страница за страницей, не собирая их в памяти.
+// Без limit выдаются все страницы, с limit - одна, как в JSON.
+func (h *MainHandler) streamUserUrls(w http.ResponseWriter, r *http.Request, userID string, format string,
+	opts storage.ListOptions) {
+	var encode func(rec UserURLRecord) error
+	var flush func() error
+	var csvWriter *csv.Writer
+	switch format {
+	case userUrlsFormatCSV:
+		csvWriter = csv.NewWriter(w)
+		encode = func(rec UserURLRecord) error {
+			return csvWriter.Write([]string{rec.ShortURL.S(), rec.LongURL.S(), csvTime(rec.CreatedAt),
+				strconv.FormatBool(rec.Deleted), strings.Join(rec.Tags, ","), rec.Folder,
+				csvTime(rec.UpdatedAt), rec.Title, rec.Notes, rec.ImageURL})
+		}
+		flush = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	default:
+		encoder := json.NewEncoder(w)
+		encode = func(rec UserURLRecord) error { return encoder.Encode(rec) }
+		flush = func() error { return nil }
+	}
+
+	singlePage := opts.Limit > 0
+	if !singlePage {
+		opts.Limit = storage.MaxListLimit
+	}
+	page, err := h.Repository.ListUserURLs(r.Context(), userID, opts)
+	if err != nil {
+		h.writeListError(w, r, err)
+		return
+	}
+	if singlePage {
+		setNextPage(w, r, page.NextCursor)
+	}
+	if csvWriter != nil {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="urls.csv"`)
+		w.WriteHeader(http.StatusOK)
+		err = csvWriter.Write(userUrlsCSVHeader)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	for err == nil {
+		for _, rec := range page.Records {
+			out := UserURLRecord{ShortURL: storage.URL(h.Location) + rec.ShortURL, LongURL: rec.LongURL, Deleted: rec.Deleted,
+				Tags: rec.Tags, Folder: rec.Folder, Title: rec.Title, Notes: rec.Notes, ImageURL: rec.ImageURL,
+				CreatedAt: utcTime(rec.CreatedAt), UpdatedAt: utcTime(rec.UpdatedAt)}
+			if err = encode(out); err != nil {
+				break
+			}
+		}
+		if err != nil || singlePage || page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+		page, err = h.Repository.ListUserURLs(r.Context(), userID, opts)
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// ответ уже начат, статус не поменять - клиент получит обрезанный файл
+		log.Println("stream user urls error", err)
+	}
+}
+
+// SearchURLResult - найденная ссылка пользователя.
+type SearchURLResult struct {
+	ShortURL  storage.URL `json:"short_url"`
+	LongURL   storage.URL `json:"original_url"`
+	Title     string      `json:"title,omitempty"`
+	Tags      []string    `json:"tags,omitempty"`
+	CreatedAt *time.Time  `json:"created_at,omitempty"`
+	Rank      float64     `json:"rank"`
+}
+
+// searchLimit разбирает параметр limit поиска, 0 - по умолчанию.
+func searchLimit(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > storage.MaxSearchLimit {
+		return 0, fmt.Errorf("limit must be from 1 to %v", storage.MaxSearchLimit)
+	}
+	return n, nil
+}
+
+// searchURLResult - найденная ссылка в ответе API.
+func (h *MainHandler) searchURLResult(result storage.SearchResult) SearchURLResult {
+	return SearchURLResult{
+		ShortURL:  storage.URL(h.Location) + result.ShortURL,
+		LongURL:   result.LongURL,
+		Title:     result.Title,
+		Tags:      result.Tags,
+		CreatedAt: utcTime(result.CreatedAt),
+		Rank:      result.Rank,
+	}
+}
+
+// SearchUserUrlsJSON ищет ссылки пользователя по словам q, самые релевантные первыми.
+func (h *MainHandler) SearchUserUrlsJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := GetSession(r)
+		limit, err := searchLimit(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		results, err := h.Repository.SearchUserURLs(r.Context(), session.UserID, r.URL.Query().Get("q"), limit)
+		if errors.Is(err, storage.ErrEmptyQuery) {
+			http.Error(w, "q must contain letters or digits", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("search user urls error", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if len(results) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		responseJSON := make([]SearchURLResult, 0, len(results))
+		for _, result := range results {
+			responseJSON = append(responseJSON, h.searchURLResult(result))
+		}
+		if err = json.NewEncoder(w).Encode(responseJSON); err != nil {
 			log.Println("write answer error", err)
+		}
+	}
+}
+
+// EditURLRequest - правка ссылки; отсутствующее поле не меняется, "tags": [] снимает теги.
+type EditURLRequest struct {
+	Tags   *[]string `json:"tags"`
+	Folder *string   `json:"folder"`
+	Title  *string   `json:"title"`
+	Notes  *string   `json:"notes"`
+}
+
+// EditUserURLJSON меняет теги, папку, заголовок и заметки ссылки пользователя.
+func (h *MainHandler) EditUserURLJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := GetSession(r)
+		var requestJSON EditURLRequest
+		if err := json.NewDecoder(r.Body).Decode(&requestJSON); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		edit, err := storage.URLEdit{
+			Tags:   requestJSON.Tags,
+			Folder: requestJSON.Folder,
+			Title:  requestJSON.Title,
+			Notes:  requestJSON.Notes,
+		}.Normalize()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		short := storage.URL(chi.URLParam(r, "short"))
+		record, err := h.Repository.EditUserURL(r.Context(), session.UserID, short, edit)
+		if errors.Is(err, storage.ErrNotFoundURL) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("edit url error", err)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err = json.NewEncoder(w).Encode(h.urlPair(record)); err != nil {
+			log.Println("write answer error", err)
+		}
 	}
 }
 
@@ -53,7 +413,42 @@ func (h *MainHandler) DeleteUserShortUrlsJSON() http.HandlerFunc {
 }
 
 type PostLongJSONRequest struct {
-	URL storage.URL `json:"url"`
+	URL    storage.URL `json:"url"`
+	Title  string      `json:"title,omitempty"`
+	Notes  string      `json:"notes,omitempty"`
+	Tags   []string    `json:"tags,omitempty"`
+	Folder string      `json:"folder,omitempty"`
+}
+
+// shortenEdit - теги, папка, заголовок и заметки, переданные при сокращении, как правка ссылки.
+func shortenEdit(tags []string, folder string, title string, notes string) (storage.URLEdit, error) {
+	var edit storage.URLEdit
+	if len(tags) > 0 {
+		edit.Tags = &tags
+	}
+	if folder != "" {
+		edit.Folder = &folder
+	}
+	if title != "" {
+		edit.Title = &title
+	}
+	if notes != "" {
+		edit.Notes = &notes
+	}
+	return edit.Normalize()
+}
+
+// applyShortenEdit сохраняет метаданные новой или своей ссылки.
+// Ссылку другого пользователя (конфликт) не меняем.
+func (h *MainHandler) applyShortenEdit(r *http.Request, userID string, short storage.URL, edit storage.URLEdit) error {
+	if edit.IsEmpty() {
+		return nil
+	}
+	_, err := h.Repository.EditUserURL(r.Context(), userID, short, edit)
+	if errors.Is(err, storage.ErrNotFoundURL) {
+		return nil
+	}
+	return err
 }
 
 type PostLongJSONResponse struct {
@@ -71,10 +466,26 @@ func (h *MainHandler) PostLongGetShortJSON() http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		long, err := storage.NormalizeLongURL(requestJSON.URL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		requestJSON.URL = long
+		edit, err := shortenEdit(requestJSON.Tags, requestJSON.Folder, requestJSON.Title, requestJSON.Notes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		quota, ok := h.reserveQuota(w, r, 1)
+		if !ok {
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		status := http.StatusCreated
 		shortURL, err := h.Repository.SaveLongURL(requestJSON.URL, session.UserID)
+		quota.keep(savedOne(err))
 		if err != nil {
 			if errors.Is(err, storage.ErrConflictURL) {
 				status = http.StatusConflict
@@ -83,12 +494,21 @@ func (h *MainHandler) PostLongGetShortJSON() http.HandlerFunc {
 					shortURL = e.ShortURL
 				}
 
+			} else if errors.Is(err, storage.ErrBlockedURL) {
+				writeJSONError(w, http.StatusForbidden, err)
+				return
 			} else {
 				w.WriteHeader(http.StatusBadRequest)
 				log.Println("cant make short url", err)
 				return
 			}
 		}
+		if err = h.applyShortenEdit(r, session.UserID, shortURL, edit); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("cant save link metadata", err)
+			return
+		}
+		h.enqueuePreview(session.UserID, shortURL, requestJSON.URL, requestJSON.Title)
 		responseJSON.Result = storage.URL(h.Location) + shortURL
 		w.WriteHeader(status)
 		err = json.NewEncoder(w).Encode(responseJSON)
@@ -100,37 +520,147 @@ func (h *MainHandler) PostLongGetShortJSON() http.HandlerFunc {
 	}
 }
 
-func (h *MainHandler) PostLongGetShortBatchJSON() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var requestJSON []storage.CorrelationLongPair
-		var responseJSON []storage.CorrelationShortPair
+var (
+	ErrBatchTooLarge = errors.New("batch is too large")
+	ErrBatchEmpty    = errors.New("batch is empty")
+)
 
-		session := GetSession(r)
+// decodeBatch читает массив ссылок по одной, не держа в памяти все тело запроса,
+// и прекращает чтение, как только ссылок становится больше maxSize (0 - без ограничения).
+func decodeBatch(body io.Reader, maxSize int) ([]storage.CorrelationLongPair, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("expected json array of urls")
+	}
+	var batch []storage.CorrelationLongPair
+	for dec.More() {
+		if maxSize > 0 && len(batch) == maxSize {
+			return nil, fmt.Errorf("%w: more than %v urls", ErrBatchTooLarge, maxSize)
+		}
+		var p storage.CorrelationLongPair
+		if err := dec.Decode(&p); err != nil {
+			return nil, err
+		}
+		batch = append(batch, p)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if len(batch) == 0 {
+		return nil, ErrBatchEmpty
+	}
+	return batch, nil
+}
 
-		if err := json.NewDecoder(r.Body).Decode(&requestJSON); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+// PostLongGetShortBatchJSON сохраняет пачку ссылок и отвечает итогом по каждой (storage.BatchStatus)
+// в порядке запроса. Неверные ссылки не мешают сохранить остальные. У уже существовавших ссылок
+// owner говорит, чьи они: same_user или other_user. Как и раньше, ответ - 201 при любых итогах
+// по ссылкам, в том числе на пустую пачку; по статусу ответа их различает только /api/v2.
+func (h *MainHandler) PostLongGetShortBatchJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestJSON, err := decodeBatch(r.Body, h.Limits.BatchMaxSize)
+		if errors.Is(err, ErrBatchTooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, err)
 			return
 		}
-
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		var err error
-		responseJSON, err = h.Repository.SaveLongBatchURL(requestJSON, session.UserID)
+		if errors.Is(err, ErrBatchEmpty) {
+			err = nil
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			log.Println("cant make short url", err)
+			writeJSONError(w, http.StatusBadRequest, err)
 			return
 		}
-
-		for i := range responseJSON {
-			responseJSON[i].ShortURL = storage.URL(h.Location) + responseJSON[i].ShortURL
+		responseJSON, ok := h.shortenBatch(w, r, requestJSON)
+		if !ok {
+			return
 		}
 
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(http.StatusCreated)
 		err = json.NewEncoder(w).Encode(responseJSON)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
 			log.Println("write answer error", err)
 			return
 		}
 	}
 }
+
+var errCannotSaveURLs = errors.New("cannot save urls")
+
+// shortenBatch проверяет и сохраняет пачку ссылок пользователя запроса, общая часть
+// обеих версий API. Если пачку сохранить нельзя, отвечает ошибкой сам и возвращает false.
+func (h *MainHandler) shortenBatch(w http.ResponseWriter, r *http.Request,
+	requestJSON []storage.CorrelationLongPair) ([]storage.CorrelationShortPair, bool) {
+	session := GetSession(r)
+	responseJSON := make([]storage.CorrelationShortPair, len(requestJSON))
+	edits := make([]storage.URLEdit, len(requestJSON))
+	valid := make([]storage.CorrelationLongPair, 0, len(requestJSON))
+	indexes := make([]int, 0, len(requestJSON))
+	seen := make(map[string]bool, len(requestJSON))
+	for i, p := range requestJSON {
+		responseJSON[i] = storage.CorrelationShortPair{CorrelationID: p.CorrelationID, Status: storage.BatchInvalid}
+		if seen[p.CorrelationID] {
+			responseJSON[i].Error = "duplicate correlation_id"
+			continue
+		}
+		seen[p.CorrelationID] = true
+		long, err := storage.NormalizeLongURL(p.LongURL)
+		if err != nil {
+			responseJSON[i].Error = err.Error()
+			continue
+		}
+		edit, err := shortenEdit(p.Tags, p.Folder, p.Title, p.Notes)
+		if err != nil {
+			responseJSON[i].Error = err.Error()
+			continue
+		}
+		p.LongURL = long
+		requestJSON[i] = p
+		edits[i] = edit
+		valid = append(valid, p)
+		indexes = append(indexes, i)
+	}
+
+	if len(valid) > 0 {
+		quota, ok := h.reserveQuota(w, r, len(valid))
+		if !ok {
+			return nil, false
+		}
+		saved, err := h.Repository.SaveLongBatchURL(valid, session.UserID)
+		created := 0
+		for _, p := range saved {
+			if p.Status == storage.BatchCreated {
+				created++
+			}
+		}
+		quota.keep(created)
+		if err != nil {
+			log.Println("cant make short url", err)
+			writeError(w, r, http.StatusInternalServerError, errCannotSaveURLs)
+			return nil, false
+		}
+		for j, i := range indexes {
+			responseJSON[i] = saved[j]
+		}
+	}
+
+	for i, p := range responseJSON {
+		if p.Status != storage.BatchCreated && p.Status != storage.BatchConflict {
+			continue
+		}
+		responseJSON[i].ShortURL = storage.URL(h.Location) + p.ShortURL
+		// чужую ссылку пользователь не меняет
+		if p.Owner == storage.OwnerOtherUser {
+			continue
+		}
+		if err := h.applyShortenEdit(r, session.UserID, p.ShortURL, edits[i]); err != nil {
+			log.Println("cant save link metadata", err)
+			responseJSON[i].Status = storage.BatchError
+			responseJSON[i].Error = "cannot save link metadata"
+		}
+		h.enqueuePreview(session.UserID, p.ShortURL, requestJSON[i].LongURL, requestJSON[i].Title)
+	}
+	return responseJSON, true
+}
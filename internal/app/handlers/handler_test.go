@@ -1,16 +1,28 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go-url-shortener/internal/app/idempotency"
+	"go-url-shortener/internal/app/openapi"
+	"go-url-shortener/internal/app/ratelimit"
 	"go-url-shortener/internal/app/storage"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader, cookie *http.Cookie) (*http.Response, string) {
@@ -195,11 +207,6 @@ func TestMainHandlerApi(t *testing.T) {
 			ts := httptest.NewServer(r)
 			defer ts.Close()
 
-			authCookieVal := `eyJVc2VySUQiOiIzNzAyMzBkZi0xNTllLTRhZWMtOWYxOC05MjJmOWMwYmUzMjgiLCJTaWduIjoiMmJCakJNb2I3cEExWnptMDF4ZjJNK3pWeGhDWFZZK2tQbXpqaWFXSzBrZz0ifQ==`
-			authCookie := &http.Cookie{
-				Name:  "auth",
-				Value: authCookieVal,
-			}
 			var body io.Reader = nil
 			if tt.requestBody != "" {
 				body = strings.NewReader(tt.requestBody)
@@ -208,7 +215,7 @@ func TestMainHandlerApi(t *testing.T) {
 				tt.target = "/"
 			}
 
-			resp, respBody := testRequest(t, ts, tt.method, tt.target, body, authCookie)
+			resp, respBody := testRequest(t, ts, tt.method, tt.target, body, testAuthCookie())
 			resp.Body.Close() // statictest: internal/app/handlers/handler_test.go:111:33: response body must be closed
 			// проверяем код ответа
 			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
@@ -228,6 +235,10 @@ func TestMainHandlerApi(t *testing.T) {
 				assert.NoError(t, err)
 				err = json.Unmarshal([]byte(respBody), &respJSON)
 				assert.NoError(t, err)
+				// время создания берется из часов, сравниваем без него
+				for i := range respJSON {
+					respJSON[i].CreatedAt, respJSON[i].UpdatedAt = nil, nil
+				}
 				assert.ElementsMatch(t, wantJSON, respJSON)
 			default:
 				assert.Equal(t, tt.want.body, respBody,
@@ -237,3 +248,850 @@ func TestMainHandlerApi(t *testing.T) {
 		})
 	}
 }
+
+func TestMainHandler_GetUserUrlsFormats(t *testing.T) {
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	createdAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		target          string
+		accept          string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "Test case #1 CSV by query parameter",
+			target:          "/api/user/urls?format=csv",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/csv; charset=utf-8",
+			wantBody: "short_url,original_url,created_at,deleted,tags,folder,updated_at,title,notes,image_url\n" +
+				"http://localhost:8080/ac5a78ac,https://ya.ru/1123333,2022-05-01T12:00:00Z,true,\"deck,q3\",campaigns," +
+				"2022-05-02T12:00:00Z,Q3 deck,\"for sales, v2\",\n" +
+				"http://localhost:8080/b3f51159,https://ya.ru/1123,2022-05-01T12:00:00Z,false,,,2022-05-01T12:00:00Z,,,\n",
+		},
+		{
+			name:            "Test case #2 NDJSON by Accept",
+			target:          "/api/user/urls",
+			accept:          "application/x-ndjson",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/x-ndjson; charset=utf-8",
+			wantBody: `{"short_url":"http://localhost:8080/ac5a78ac","original_url":"https://ya.ru/1123333","created_at":"2022-05-01T12:00:00Z","deleted":true,"tags":["deck","q3"],"folder":"campaigns","updated_at":"2022-05-02T12:00:00Z","title":"Q3 deck","notes":"for sales, v2"}
+{"short_url":"http://localhost:8080/b3f51159","original_url":"https://ya.ru/1123","created_at":"2022-05-01T12:00:00Z","deleted":false,"updated_at":"2022-05-01T12:00:00Z"}
+`,
+		},
+		{
+			name:            "Test case #3 query parameter wins over Accept",
+			target:          "/api/user/urls?format=json",
+			accept:          "text/csv",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody: `[{"short_url":"http://localhost:8080/ac5a78ac","original_url":"https://ya.ru/1123333","title":"Q3 deck",` +
+				`"notes":"for sales, v2","tags":["deck","q3"],"folder":"campaigns",` +
+				`"created_at":"2022-05-01T12:00:00Z","updated_at":"2022-05-02T12:00:00Z"},` +
+				`{"short_url":"http://localhost:8080/b3f51159","original_url":"https://ya.ru/1123",` +
+				`"created_at":"2022-05-01T12:00:00Z","updated_at":"2022-05-01T12:00:00Z"}]` + "\n",
+		},
+		{
+			name:            "Test case #4 unknown format",
+			target:          "/api/user/urls?format=xml",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "unsupported format, expected json, csv or ndjson\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := storage.NewMemoryMap()
+			_, err := repo.ImportURLs(context.Background(), []storage.URLRecord{
+				{ShortURL: "ac5a78ac", LongURL: "https://ya.ru/1123333", UserID: userID, Deleted: true, CreatedAt: createdAt,
+					UpdatedAt: createdAt.Add(24 * time.Hour), Tags: []string{"deck", "q3"}, Folder: "campaigns",
+					Title: "Q3 deck", Notes: "for sales, v2"},
+				{ShortURL: "b3f51159", LongURL: "https://ya.ru/1123", UserID: userID, CreatedAt: createdAt},
+			}, storage.ConflictFail)
+			require.NoError(t, err)
+
+			var headers []string
+			if tt.accept != "" {
+				headers = []string{"Accept", tt.accept}
+			}
+			w := newTestServer(NewMainHandler(repo, "http://localhost:8080/"))(http.MethodGet, tt.target, "", headers...)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantContentType, w.Header().Get("Content-Type"))
+			if tt.wantContentType == "application/json; charset=utf-8" {
+				// порядок в v1 не гарантирован
+				var wantJSON, respJSON GetUserUrlsJSONResponse
+				require.NoError(t, json.Unmarshal([]byte(tt.wantBody), &wantJSON))
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &respJSON))
+				assert.ElementsMatch(t, wantJSON, respJSON)
+				return
+			}
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
+
+func TestMainHandler_GetUserUrlsPages(t *testing.T) {
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	createdAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	repo := storage.NewMemoryMap()
+	_, err := repo.ImportURLs(context.Background(), []storage.URLRecord{
+		{ShortURL: "ac5a78ac", LongURL: "https://ya.ru/1123333", UserID: userID, Deleted: true, CreatedAt: createdAt},
+		{ShortURL: "b3f51159", LongURL: "https://ya.ru/1123", UserID: userID, CreatedAt: createdAt.Add(time.Hour)},
+		{ShortURL: "c1d2e3f4", LongURL: "https://go.dev/doc", UserID: userID, CreatedAt: createdAt.Add(2 * time.Hour)},
+	}, storage.ConflictFail)
+	require.NoError(t, err)
+	handler := NewMainHandler(repo, "http://localhost:8080/")
+
+	serve := newTestServer(handler)
+
+	var got []storage.URL
+	target := "/api/user/urls?limit=2&order=desc"
+	for i := 0; target != ""; i++ {
+		require.Less(t, i, 3)
+		w := serve(http.MethodGet, target, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var page GetUserUrlsJSONResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		for _, pair := range page {
+			got = append(got, pair.ShortURL)
+		}
+		target = ""
+		if link := w.Header().Get("Link"); link != "" {
+			assert.NotEmpty(t, w.Header().Get("X-Next-Cursor"))
+			target = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	assert.Equal(t, []storage.URL{"http://localhost:8080/c1d2e3f4", "http://localhost:8080/b3f51159",
+		"http://localhost:8080/ac5a78ac"}, got)
+
+	w := serve(http.MethodGet, "/api/user/urls?domain=ya.ru&deleted=false", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"short_url":"http://localhost:8080/b3f51159","original_url":"https://ya.ru/1123",
+		"created_at":"2022-05-01T13:00:00Z","updated_at":"2022-05-01T13:00:00Z"}]`, w.Body.String())
+
+	for _, target := range []string{"/api/user/urls?limit=0", "/api/user/urls?limit=1001", "/api/user/urls?sort=long",
+		"/api/user/urls?order=up", "/api/user/urls?deleted=maybe", "/api/user/urls?cursor=garbage"} {
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, target, "").Code, target)
+	}
+}
+
+func TestMainHandler_SearchUserUrls(t *testing.T) {
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	createdAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	repo := storage.NewMemoryMap()
+	_, err := repo.ImportURLs(context.Background(), []storage.URLRecord{
+		{ShortURL: "ac5a78ac", LongURL: "https://docs.ya.ru/q3-deck", UserID: userID, CreatedAt: createdAt},
+		{ShortURL: "b3f51159", LongURL: "https://ya.ru/q4-deck", UserID: userID, CreatedAt: createdAt},
+		{ShortURL: "c1d2e3f4", LongURL: "https://ya.ru/q3-deck", UserID: "another-user", CreatedAt: createdAt},
+	}, storage.ConflictFail)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		want       []storage.URL
+	}{
+		{name: "Test case #1 found", target: "/api/user/urls/search?q=Q3+deck", wantStatus: http.StatusOK,
+			want: []storage.URL{"http://localhost:8080/ac5a78ac"}},
+		{name: "Test case #2 ranked", target: "/api/user/urls/search?q=deck", wantStatus: http.StatusOK,
+			want: []storage.URL{"http://localhost:8080/b3f51159", "http://localhost:8080/ac5a78ac"}},
+		{name: "Test case #3 nothing found", target: "/api/user/urls/search?q=budget", wantStatus: http.StatusNoContent},
+		{name: "Test case #4 empty query", target: "/api/user/urls/search?q=+", wantStatus: http.StatusBadRequest},
+		{name: "Test case #5 bad limit", target: "/api/user/urls/search?q=deck&limit=101", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestServer(NewMainHandler(repo, "http://localhost:8080/"))(http.MethodGet, tt.target, "")
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var results []SearchURLResult
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+			var got []storage.URL
+			for _, result := range results {
+				assert.Positive(t, result.Rank)
+				got = append(got, result.ShortURL)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// testAuthCookie - подписанная cookie пользователя 370230df-159e-4aec-9f18-922f9c0be328.
+func testAuthCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:  "auth",
+		Value: `eyJVc2VySUQiOiIzNzAyMzBkZi0xNTllLTRhZWMtOWYxOC05MjJmOWMwYmUzMjgiLCJTaWduIjoiMmJCakJNb2I3cEExWnptMDF4ZjJNK3pWeGhDWFZZK2tQbXpqaWFXSzBrZz0ifQ==`,
+	}
+}
+
+// newAuthRequest - запрос с cookie пользователя testAuthCookie.
+func newAuthRequest(method, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.AddCookie(testAuthCookie())
+	return req
+}
+
+// newTestServer выполняет запросы newAuthRequest к handler. headers - пары имя, значение.
+func newTestServer(handler http.Handler) func(method, target string, body string, headers ...string) *httptest.ResponseRecorder {
+	return func(method, target string, body string, headers ...string) *httptest.ResponseRecorder {
+		req := newAuthRequest(method, target, body)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+}
+
+// untimedPairs разбирает ответ со ссылками без времени создания и изменения: оно берется из часов.
+func untimedPairs(t *testing.T, body []byte) []storage.URLPair {
+	var pairs []storage.URLPair
+	require.NoError(t, json.Unmarshal(body, &pairs))
+	for i := range pairs {
+		pairs[i].CreatedAt, pairs[i].UpdatedAt = nil, nil
+	}
+	return pairs
+}
+
+func TestMainHandler_TagsAndFolders(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	serve := newTestServer(handler)
+
+	w := serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/deck","tags":["Q3","deck"],"folder":"/campaigns/"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = serve(http.MethodPost, "/api/shorten/batch", `[
+		{"correlation_id":"1","original_url":"https://ya.ru/plan","tags":["q4"]},
+		{"correlation_id":"2","original_url":"https://ya.ru/notes"}]`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var batch []storage.CorrelationShortPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batch))
+	require.Len(t, batch, 2)
+
+	assert.Equal(t, http.StatusBadRequest,
+		serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/x","tags":["two words"]}`).Code)
+	// в пачке неверные теги - итог по ссылке, ответ по-прежнему 201
+	w = serve(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://ya.ru/x","tags":[""]}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var invalid []storage.CorrelationShortPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &invalid))
+	require.Len(t, invalid, 1)
+	assert.Equal(t, storage.BatchInvalid, invalid[0].Status)
+
+	w = serve(http.MethodGet, "/api/user/urls?tag=q3", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []storage.URLPair{{ShortURL: "http://localhost:8080/eebdcaa5", LongURL: "https://ya.ru/deck",
+		Tags: []string{"deck", "q3"}, Folder: "campaigns"}}, untimedPairs(t, w.Body.Bytes()))
+
+	short := strings.TrimPrefix(batch[1].ShortURL.S(), "http://localhost:8080/")
+	w = serve(http.MethodPatch, "/api/user/urls/"+short, `{"folder":"campaigns","tags":["notes"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []storage.URLPair{{ShortURL: batch[1].ShortURL, LongURL: "https://ya.ru/notes",
+		Tags: []string{"notes"}, Folder: "campaigns"}}, untimedPairs(t, []byte("["+w.Body.String()+"]")))
+
+	w = serve(http.MethodGet, "/api/user/urls?folder=campaigns&sort=short", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list GetUserUrlsJSONResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list, 2)
+	w = serve(http.MethodGet, "/api/user/urls?folder=", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []storage.URLPair{{ShortURL: batch[0].ShortURL, LongURL: "https://ya.ru/plan", Tags: []string{"q4"}}},
+		untimedPairs(t, w.Body.Bytes()))
+
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPatch, "/api/user/urls/missing", `{"tags":[]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPatch, "/api/user/urls/"+short, `{"tags":["a,b"]}`).Code)
+}
+
+func TestMainHandler_TitlesAndNotes(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	serve := newTestServer(handler)
+
+	w := serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/deck","title":" Q3 deck ","notes":"for sales"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = serve(http.MethodPost, "/api/shorten/batch",
+		`[{"correlation_id":"1","original_url":"https://ya.ru/plan","title":"Plan"}]`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/api/shorten",
+		`{"url":"https://ya.ru/x","title":"`+strings.Repeat("a", storage.MaxTitleLength+1)+`"}`).Code)
+
+	w = serve(http.MethodGet, "/api/user/urls?sort=short", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list GetUserUrlsJSONResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list, 2)
+	for _, pair := range list {
+		require.NotNil(t, pair.CreatedAt)
+		require.NotNil(t, pair.UpdatedAt)
+		assert.False(t, pair.UpdatedAt.Before(*pair.CreatedAt))
+	}
+	assert.Equal(t, []storage.URLPair{
+		{ShortURL: "http://localhost:8080/9b7527f", LongURL: "https://ya.ru/plan", Title: "Plan"},
+		{ShortURL: "http://localhost:8080/eebdcaa5", LongURL: "https://ya.ru/deck", Title: "Q3 deck", Notes: "for sales"},
+	}, untimedPairs(t, w.Body.Bytes()))
+
+	// пустая строка очищает заметки, заголовок без изменений
+	w = serve(http.MethodPatch, "/api/user/urls/eebdcaa5", `{"notes":""}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var edited storage.URLPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &edited))
+	assert.Equal(t, "Q3 deck", edited.Title)
+	assert.Empty(t, edited.Notes)
+
+	w = serve(http.MethodGet, "/api/user/urls?format=csv&sort=short", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, []string{"updated_at", "title", "notes"}, rows[0][6:9])
+	assert.Equal(t, "Q3 deck", rows[2][7])
+}
+
+// previewQueue запоминает ссылки, поставленные в очередь загрузки заголовков.
+type previewQueue struct {
+	shorts []storage.URL
+}
+
+func (q *previewQueue) Enqueue(userID string, short storage.URL, long storage.URL) bool {
+	q.shorts = append(q.shorts, short)
+	return true
+}
+
+func TestMainHandler_NormalizeURL(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	serve := newTestServer(handler)
+
+	w := serve(http.MethodPost, "/", "https://ya.ru/deck")
+	require.Equal(t, http.StatusCreated, w.Code)
+	short := w.Body.String()
+	// та же ссылка в другой записи получает тот же короткий адрес
+	w = serve(http.MethodPost, "/", " HTTPS://YA.ru:443/deck\n")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, short, w.Body.String())
+	w = serve(http.MethodPost, "/api/shorten", `{"url":"https://Ya.Ru:443/deck"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"result":"`+short+`"}`, w.Body.String())
+
+	for _, tt := range []struct {
+		target string
+		body   string
+	}{
+		{target: "/", body: "ya.ru/deck"},
+		{target: "/", body: "ftp://ya.ru/file"},
+		{target: "/api/shorten", body: `{"url":"javascript:alert(1)"}`},
+		{target: "/api/shorten", body: `{"url":"https:///deck"}`},
+	} {
+		w = serve(http.MethodPost, tt.target, tt.body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.body)
+		assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Contains(t, resp.Error, storage.ErrInvalidURL.Error())
+	}
+
+	// в пачке неверная ссылка получает свой статус
+	w = serve(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"not a url"},
+		{"correlation_id":"2","original_url":"HTTPS://YA.RU/deck"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var batch []storage.CorrelationShortPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batch))
+	require.Len(t, batch, 2)
+	assert.Equal(t, storage.BatchInvalid, batch[0].Status)
+	assert.Contains(t, batch[0].Error, storage.ErrInvalidURL.Error())
+	assert.Equal(t, storage.CorrelationShortPair{CorrelationID: "2", ShortURL: storage.URL(short), Status: storage.BatchConflict, Owner: storage.OwnerSameUser}, batch[1])
+
+	w = serve(http.MethodGet, "/api/user/urls", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []storage.URLPair{{ShortURL: storage.URL(short), LongURL: "https://ya.ru/deck"}},
+		untimedPairs(t, w.Body.Bytes()))
+}
+
+func TestMainHandler_BlockedURL(t *testing.T) {
+	policy, err := storage.NewURLPolicy(storage.NewMemoryMap(), nil, storage.PolicyConfig{Blocklist: []string{".evil.com"}})
+	require.NoError(t, err)
+	handler := NewMainHandler(policy, "http://localhost:8080/")
+	serve := newTestServer(handler)
+
+	for target, body := range map[string]string{
+		"/":            "https://evil.com/login",
+		"/api/shorten": `{"url":"https://www.evil.com/login"}`,
+	} {
+		w := serve(http.MethodPost, target, body)
+		assert.Equal(t, http.StatusForbidden, w.Code, target)
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Contains(t, resp.Error, storage.ErrBlockedURL.Error())
+	}
+	w := serve(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://evil.com/2"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var batch []storage.CorrelationShortPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batch))
+	require.Len(t, batch, 1)
+	assert.Equal(t, storage.BatchInvalid, batch[0].Status)
+	assert.Contains(t, batch[0].Error, storage.ErrBlockedURL.Error())
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodGet, "/api/user/urls", "").Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/", "https://ya.ru/1").Code)
+}
+
+func TestMainHandler_RateLimits(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	handler.Limits = Limits{Rates: map[string]RateLimit{
+		RouteShorten:  {IP: ratelimit.NewLimiter("shorten:ip", ratelimit.Rate{N: 2, Per: time.Minute}, nil)},
+		RouteRedirect: {User: ratelimit.NewLimiter("redirect:user", ratelimit.Rate{N: 1, Per: time.Hour}, nil)},
+	}}
+	serve := newTestServer(handler)
+
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/", "https://ya.ru/1", "X-Real-IP", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/2"}`, "X-Real-IP", "10.0.0.1").Code)
+	w := serve(http.MethodPost, "/", "https://ya.ru/3", "X-Real-IP", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, ErrTooManyRequests.Error(), resp.Error)
+	// у другого адреса свой лимит, пачка ограничена отдельно
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/", "https://ya.ru/3", "X-Real-IP", "10.0.0.2").Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten/batch",
+		`[{"correlation_id":"1","original_url":"https://ya.ru/4"}]`, "X-Real-IP", "10.0.0.1").Code)
+
+	assert.Equal(t, http.StatusTemporaryRedirect, serve(http.MethodGet, "/2e82f047", "", "X-Real-IP", "10.0.0.1").Code)
+	w = serve(http.MethodGet, "/2e82f047", "", "X-Real-IP", "10.0.0.3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+}
+
+func TestMainHandler_DailyQuota(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	handler.Limits = Limits{DailyUser: 3, DailyIP: 100}
+	serve := newTestServer(handler)
+
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten/batch",
+		`[{"correlation_id":"1","original_url":"https://ya.ru/1"},{"correlation_id":"2","original_url":"https://ya.ru/2"}]`).Code)
+	// пачка не влезает в остаток квоты целиком
+	w := serve(http.MethodPost, "/api/shorten/batch",
+		`[{"correlation_id":"3","original_url":"https://ya.ru/3"},{"correlation_id":"4","original_url":"https://ya.ru/4"}]`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 24*60*60)
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Contains(t, resp.Error, storage.ErrQuotaExceeded.Error())
+
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/", "https://ya.ru/3").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/4"}`).Code)
+	// невалидная ссылка квоту не тратит и получает свою ошибку
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/", "ya.ru").Code)
+}
+
+func TestMainHandler_DailyQuotaRefund(t *testing.T) {
+	repo := conflictRepo{storage.NewMemoryMap(), make(map[storage.URL]bool)}
+	handler := NewMainHandler(repo, "http://localhost:8080/")
+	handler.Limits = Limits{DailyUser: 3, DailyIP: 10}
+	serve := newTestServer(handler)
+	ipUsed := func() int {
+		used, err := repo.ConsumeDailyQuota(context.Background(), "ip:192.0.2.1", time.Now(), 0, 10)
+		require.NoError(t, err)
+		return used
+	}
+
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/", "https://ya.ru/1").Code)
+	// конфликт ничего не создал - квота возвращается
+	assert.Equal(t, http.StatusConflict, serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/1"}`).Code)
+	assert.Equal(t, http.StatusConflict, serve(http.MethodPost, "/api/v2/shorten", `{"url":"https://ya.ru/1"}`).Code)
+	// из пачки списывается только созданная ссылка
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten/batch",
+		`[{"correlation_id":"1","original_url":"https://ya.ru/1"},{"correlation_id":"2","original_url":"https://ya.ru/2"}]`).Code)
+	assert.Equal(t, 2, ipUsed())
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/", "https://ya.ru/3").Code)
+	// квота пользователя кончилась - квота адреса не тратится
+	assert.Equal(t, http.StatusTooManyRequests, serve(http.MethodPost, "/", "https://ya.ru/4").Code)
+	assert.Equal(t, 3, ipUsed())
+}
+
+func TestMainHandler_Previews(t *testing.T) {
+	queue := &previewQueue{}
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	handler.Previews = queue
+	serve := newTestServer(handler)
+
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/", "https://ya.ru/text").Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/deck"}`).Code)
+	// заголовок задан пользователем - загружать нечего
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/x","title":"X"}`).Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten/batch", `[
+		{"correlation_id":"1","original_url":"https://ya.ru/plan"},
+		{"correlation_id":"2","original_url":"https://ya.ru/notes","title":"Notes"}]`).Code)
+	assert.Equal(t, []storage.URL{"17ce1c0b", "eebdcaa5", "9b7527f"}, queue.shorts)
+}
+
+func TestMainHandler_BatchLimits(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	handler.Limits = Limits{BatchMaxSize: 2}
+	serve := newTestServer(handler)
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "too large", code: http.StatusRequestEntityTooLarge, body: `[
+			{"correlation_id":"1","original_url":"https://ya.ru/1"},
+			{"correlation_id":"2","original_url":"https://ya.ru/2"},
+			{"correlation_id":"3","original_url":"https://ya.ru/3"}]`},
+		{name: "not array", code: http.StatusBadRequest, body: `{"correlation_id":"1","original_url":"https://ya.ru/1"}`},
+		{name: "broken", code: http.StatusBadRequest, body: `[{"correlation_id":"1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(http.MethodPost, "/api/shorten/batch", tt.body)
+			assert.Equal(t, tt.code, w.Code)
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.NotEmpty(t, resp.Error)
+		})
+	}
+
+	w := serve(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://ya.ru/1"},{"correlation_id":"1","original_url":"https://ya.ru/2"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var items []storage.CorrelationShortPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+	require.Len(t, items, 2)
+	assert.Equal(t, storage.BatchCreated, items[0].Status)
+	assert.Equal(t, storage.BatchInvalid, items[1].Status)
+	assert.Empty(t, items[1].ShortURL)
+
+	// все ссылки уже есть - тоже 201, короткие адреса и итоги в теле
+	w = serve(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://ya.ru/1"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+	assert.Equal(t, []storage.CorrelationShortPair{
+		{CorrelationID: "1", ShortURL: "http://localhost:8080/2e82f047", Status: storage.BatchConflict, Owner: storage.OwnerSameUser},
+	}, items)
+
+	// пустая пачка - 201 и пустой список, как до ограничений
+	w = serve(http.MethodPost, "/api/shorten/batch", `[]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+}
+
+func TestMainHandler_BatchOwner(t *testing.T) {
+	repo := storage.NewMemoryMap()
+	_, err := repo.SaveLongURL("https://ya.ru/1", "other")
+	require.NoError(t, err)
+	serve := newTestServer(NewMainHandler(repo, "http://localhost:8080/"))
+
+	w := serve(http.MethodPost, "/api/shorten/batch", `[
+		{"correlation_id":"1","original_url":"https://ya.ru/1","tags":["mine"]},
+		{"correlation_id":"2","original_url":"https://ya.ru/2"},
+		{"correlation_id":"3","original_url":"https://ya.ru/2"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var items []storage.CorrelationShortPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+	assert.Equal(t, []storage.CorrelationShortPair{
+		{CorrelationID: "1", ShortURL: "http://localhost:8080/2e82f047", Status: storage.BatchConflict, Owner: storage.OwnerOtherUser},
+		{CorrelationID: "2", ShortURL: "http://localhost:8080/2f82f1da", Status: storage.BatchCreated},
+		{CorrelationID: "3", ShortURL: "http://localhost:8080/2f82f1da", Status: storage.BatchConflict, Owner: storage.OwnerSameUser},
+	}, items)
+
+	// теги чужой ссылки не меняются
+	info, err := repo.GetURLInfo("2e82f047")
+	require.NoError(t, err)
+	assert.Equal(t, "other", info.UserID)
+	assert.Empty(t, info.Tags)
+}
+
+func TestMainHandler_Idempotency(t *testing.T) {
+	store := idempotency.NewMemoryStore()
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	// квота на одну ссылку: повтор, выполненный заново, получил бы 429
+	handler.Limits = Limits{DailyUser: 1}
+	handler.Idempotency = Idempotency{Store: store, Window: time.Hour}
+	serve := newTestServer(handler)
+
+	w := serve(http.MethodPost, "/", "https://ya.ru/1", IdempotencyKeyHeader, "k1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "http://localhost:8080/2e82f047", w.Body.String())
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	w = serve(http.MethodPost, "/", "https://ya.ru/1", IdempotencyKeyHeader, "k1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "http://localhost:8080/2e82f047", w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+	tests := []struct {
+		name   string
+		target string
+		key    string
+		body   string
+		code   int
+	}{
+		{name: "other payload", target: "/", key: "k1", body: "https://ya.ru/2", code: http.StatusUnprocessableEntity},
+		{name: "other endpoint", target: "/api/shorten", key: "k1", body: `{"url":"https://ya.ru/1"}`, code: http.StatusUnprocessableEntity},
+		{name: "too long key", target: "/", key: strings.Repeat("k", 256), body: "https://ya.ru/1", code: http.StatusBadRequest},
+		// квота кончилась, 429 не сохраняется
+		{name: "new key", target: "/", key: "k2", body: "https://ya.ru/2", code: http.StatusTooManyRequests},
+		{name: "no key", target: "/", body: "https://ya.ru/2", code: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(http.MethodPost, tt.target, tt.body, IdempotencyKeyHeader, tt.key)
+			assert.Equal(t, tt.code, w.Code)
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.NotEmpty(t, resp.Error)
+		})
+	}
+
+	// после 429 ключ свободен: тот же запрос выполняется заново
+	handler.Limits = Limits{}
+	w = serve(http.MethodPost, "/", "https://ya.ru/2", IdempotencyKeyHeader, "k2")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	// пачка отдает тот же ответ со статусами ссылок
+	batch := `[{"correlation_id":"1","original_url":"https://ya.ru/3"}]`
+	first := serve(http.MethodPost, "/api/shorten/batch", batch, IdempotencyKeyHeader, "k3")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	again := serve(http.MethodPost, "/api/shorten/batch", batch, IdempotencyKeyHeader, "k3")
+	assert.Equal(t, http.StatusCreated, again.Code)
+	assert.Equal(t, first.Body.String(), again.Body.String())
+	assert.Equal(t, "application/json; charset=utf-8", again.Header().Get("Content-Type"))
+
+	// ключ, занятый выполняющимся запросом
+	fingerprint := sha256.Sum256([]byte("POST /\nhttps://ya.ru/4"))
+	_, ok, err := store.Begin(context.Background(), "user:370230df-159e-4aec-9f18-922f9c0be328:k4",
+		hex.EncodeToString(fingerprint[:]), time.Now(), time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+	w = serve(http.MethodPost, "/", "https://ya.ru/4", IdempotencyKeyHeader, "k4")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestMainHandler_RoutesInOpenAPI(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	doc := openapi.Default()
+	routes := make(map[string]bool)
+	err := chi.Walk(handler.Mux, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		path := openAPIPath(route)
+		routes[strings.ToLower(method)+" "+path] = true
+		assert.NotNil(t, doc.Operation(path, method), "route %v %v is not in openapi.json", method, path)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// и в спецификации нет операций без маршрута
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			assert.True(t, routes[method+" "+path], "openapi.json has %v %v without route", method, path)
+		}
+	}
+}
+
+func TestMainHandler_OpenAPI(t *testing.T) {
+	handler := NewMainHandler(storage.NewMemoryMap(), "http://localhost:8080/")
+	serve := newTestServer(handler)
+
+	w := serve(http.MethodGet, "/api/openapi.json", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, string(openapi.Spec()), w.Body.String())
+
+	w = serve(http.MethodGet, "/api/docs", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "SwaggerUIBundle")
+
+	// без проверки тело доходит до обработчика
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/api/shorten", `{"url":1}`).Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/1","extra":1}`).Code)
+
+	handler.ValidateRequests = true
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		code    int
+		wantErr string
+	}{
+		{name: "shorten", method: http.MethodPost, target: "/api/shorten", body: `{"url":"https://ya.ru/2"}`, code: http.StatusCreated},
+		{name: "shorten url type", method: http.MethodPost, target: "/api/shorten", body: `{"url":1}`,
+			code: http.StatusBadRequest, wantErr: "body.url: must be a string"},
+		{name: "batch without url", method: http.MethodPost, target: "/api/shorten/batch", body: `[{"correlation_id":"1"}]`,
+			code: http.StatusBadRequest, wantErr: "body[0]: original_url is required"},
+		{name: "edit", method: http.MethodPatch, target: "/api/user/urls/2e82f047", body: `{"folder":7}`,
+			code: http.StatusBadRequest, wantErr: "body.folder: must be a string"},
+		{name: "delete", method: http.MethodDelete, target: "/api/user/urls", body: `["2e82f047"]`, code: http.StatusAccepted},
+		// текстовое тело не проверяется
+		{name: "text", method: http.MethodPost, target: "/", body: "https://ya.ru/3", code: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.method, tt.target, tt.body)
+			assert.Equal(t, tt.code, w.Code)
+			if tt.wantErr != "" {
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Contains(t, resp.Error, tt.wantErr)
+			}
+		})
+	}
+}
+
+// conflictRepo сообщает о повторном сохранении ссылки, как Redis и Postgres.
+type conflictRepo struct {
+	*storage.MemoryMap
+	saved map[storage.URL]bool
+}
+
+func (r conflictRepo) SaveLongURL(long storage.URL, userID string) (storage.URL, error) {
+	short, err := r.MemoryMap.SaveLongURL(long, userID)
+	if err != nil {
+		return "", err
+	}
+	if r.saved[short] {
+		return short, storage.NewConflictURLError(short, storage.ErrConflictURL)
+	}
+	r.saved[short] = true
+	return short, nil
+}
+
+func TestMainHandler_APIv2(t *testing.T) {
+	handler := NewMainHandler(conflictRepo{storage.NewMemoryMap(), make(map[storage.URL]bool)}, "http://localhost:8080/")
+	handler.Limits = Limits{BatchMaxSize: 2}
+	serve := newTestServer(handler)
+
+	// пустой список - 200 и [], а не 204
+	w := serve(http.MethodGet, "/api/v2/user/urls", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	w = serve(http.MethodGet, "/api/v2/user/urls/search?q=ya", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	w = serve(http.MethodPost, "/api/v2/shorten", `{"url":"https://ya.ru/1"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"result":"http://localhost:8080/2e82f047"}`, w.Body.String())
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		code    int
+		errCode string
+		details string
+	}{
+		{name: "conflict", method: http.MethodPost, target: "/api/v2/shorten", body: `{"url":"https://ya.ru/1"}`,
+			code: http.StatusConflict, errCode: "conflict", details: `{"result":"http://localhost:8080/2e82f047"}`},
+		{name: "invalid url", method: http.MethodPost, target: "/api/v2/shorten", body: `{"url":"ftp://ya.ru"}`,
+			code: http.StatusBadRequest, errCode: "invalid_url"},
+		{name: "broken json", method: http.MethodPost, target: "/api/v2/shorten", body: `{"url":`,
+			code: http.StatusBadRequest, errCode: "bad_request"},
+		{name: "batch empty", method: http.MethodPost, target: "/api/v2/shorten/batch", body: `[]`,
+			code: http.StatusBadRequest, errCode: "batch_empty"},
+		{name: "batch too large", method: http.MethodPost, target: "/api/v2/shorten/batch",
+			body: `[{"correlation_id":"1","original_url":"https://ya.ru/1"},{"correlation_id":"2","original_url":"https://ya.ru/2"},
+				{"correlation_id":"3","original_url":"https://ya.ru/3"}]`,
+			code: http.StatusRequestEntityTooLarge, errCode: "batch_too_large", details: `{"max_size":2}`},
+		{name: "bad cursor", method: http.MethodGet, target: "/api/v2/user/urls?cursor=x",
+			code: http.StatusBadRequest, errCode: "bad_cursor"},
+		{name: "bad format", method: http.MethodGet, target: "/api/v2/user/urls?format=xml",
+			code: http.StatusBadRequest, errCode: "bad_request"},
+		{name: "empty query", method: http.MethodGet, target: "/api/v2/user/urls/search",
+			code: http.StatusBadRequest, errCode: "empty_query"},
+		{name: "edit not found", method: http.MethodPatch, target: "/api/v2/user/urls/ffffffff", body: `{"folder":"a"}`,
+			code: http.StatusNotFound, errCode: "not_found"},
+		{name: "delete not array", method: http.MethodDelete, target: "/api/v2/user/urls", body: `{}`,
+			code: http.StatusBadRequest, errCode: "bad_request"},
+		{name: "unknown route", method: http.MethodGet, target: "/api/v2/unknown",
+			code: http.StatusNotFound, errCode: "not_found"},
+		{name: "wrong method", method: http.MethodGet, target: "/api/v2/shorten",
+			code: http.StatusMethodNotAllowed, errCode: "method_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.method, tt.target, tt.body)
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+			var p struct {
+				Problem
+				Details json.RawMessage `json:"details"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tt.code, p.Status)
+			assert.Equal(t, tt.errCode, p.Code)
+			assert.NotEmpty(t, p.Message)
+			assert.NotEmpty(t, p.RequestID)
+			if tt.details != "" {
+				assert.JSONEq(t, tt.details, string(p.Details))
+			}
+		})
+	}
+
+	// статус пачки - о запросе целиком, итоги по ссылкам в теле
+	w = serve(http.MethodPost, "/api/v2/shorten/batch", `[{"correlation_id":"1","original_url":"https://ya.ru/1"}]`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"correlation_id":"1","short_url":"http://localhost:8080/2e82f047","status":"conflict","owner":"same_user"}]`,
+		w.Body.String())
+	w = serve(http.MethodPost, "/api/v2/shorten/batch", `[{"correlation_id":"1","original_url":"https://ya.ru/2"},
+		{"correlation_id":"2","original_url":"ftp://ya.ru"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = serve(http.MethodPatch, "/api/v2/user/urls/2e82f047", `{"folder":"a"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var pair storage.URLPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pair))
+	assert.Equal(t, "a", pair.Folder)
+	assert.Equal(t, http.StatusAccepted, serve(http.MethodDelete, "/api/v2/user/urls", `["2e82f047"]`).Code)
+
+	// общие middleware тоже отвечают Problem, а v1 - как раньше
+	handler.Limits = Limits{Rates: map[string]RateLimit{
+		RouteShorten: {User: ratelimit.NewLimiter("shorten:user", ratelimit.Rate{N: 1, Per: time.Minute}, nil)},
+	}}
+	handler.ValidateRequests = true
+	w = serve(http.MethodPost, "/api/v2/shorten", `{"url":1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"invalid_request"`)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/api/v2/shorten", `{"url":"https://ya.ru/5"}`).Code)
+	w = serve(http.MethodPost, "/api/v2/shorten", `{"url":"https://ya.ru/6"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"rate_limited"`)
+	w = serve(http.MethodPost, "/api/shorten", `{"url":"https://ya.ru/6"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"error":"`+ErrTooManyRequests.Error()+`"}`, w.Body.String())
+}
+
+func Test_problemFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{name: "wrapped", err: fmt.Errorf("save: %w", storage.ErrBlockedURL), status: http.StatusForbidden, code: "blocked_url"},
+		{name: "deleted", err: storage.ErrDeletedURL, status: http.StatusGone, code: "deleted"},
+		{name: "quota", err: storage.ErrQuotaExceeded, status: http.StatusTooManyRequests, code: "quota_exceeded"},
+		{name: "bad request", err: badRequest(errors.New("x")), status: http.StatusBadRequest, code: "bad_request"},
+		{name: "known under bad request", err: badRequest(storage.ErrInvalidEdit), status: http.StatusBadRequest, code: "invalid_edit"},
+		{name: "unknown", err: errors.New("connection refused"), status: http.StatusInternalServerError, code: "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code := problemFor(tt.err)
+			assert.Equal(t, tt.status, status)
+			assert.Equal(t, tt.code, code)
+		})
+	}
+}
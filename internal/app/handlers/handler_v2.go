@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"go-url-shortener/internal/app/storage"
+	"net/http"
+)
+
+// routeAPIv2 - вторая версия API: те же операции, что в /api, но любая ошибка - Problem
+// (application/problem+json), а пустой список - [] со статусом 200. /api остается как был.
+func (h *MainHandler) routeAPIv2(r chi.Router) {
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		h.fail(w, r, ErrNotFound, nil)
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		h.fail(w, r, ErrMethodNotAllowed, nil)
+	})
+	r.Route("/shorten", func(r chi.Router) {
+		r.With(h.rateLimit(RouteShorten), h.idempotent).Post("/", h.ShortenV2())
+		r.With(h.rateLimit(RouteBatch), h.idempotent).Post("/batch", h.ShortenBatchV2())
+	})
+	r.Get("/user/urls", h.GetUserURLsV2())
+	r.Get("/user/urls/search", h.SearchUserURLsV2())
+	r.Patch("/user/urls/{short}", h.EditUserURLV2())
+	r.Delete("/user/urls", h.DeleteUserURLsV2())
+}
+
+// ShortenV2 сокращает ссылку. Если ссылка уже была - 409 conflict, короткая ссылка в details.result.
+func (h *MainHandler) ShortenV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := GetSession(r)
+		var requestJSON PostLongJSONRequest
+		if err := json.NewDecoder(r.Body).Decode(&requestJSON); err != nil {
+			h.fail(w, r, badRequest(err), nil)
+			return
+		}
+		long, err := storage.NormalizeLongURL(requestJSON.URL)
+		if err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		edit, err := shortenEdit(requestJSON.Tags, requestJSON.Folder, requestJSON.Title, requestJSON.Notes)
+		if err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		quota, ok := h.reserveQuota(w, r, 1)
+		if !ok {
+			return
+		}
+
+		shortURL, err := h.Repository.SaveLongURL(long, session.UserID)
+		quota.keep(savedOne(err))
+		conflict := errors.Is(err, storage.ErrConflictURL)
+		if err != nil && !conflict {
+			h.fail(w, r, err, nil)
+			return
+		}
+		var e *storage.ConflictURLError
+		if errors.As(err, &e) {
+			shortURL = e.ShortURL
+		}
+		if err = h.applyShortenEdit(r, session.UserID, shortURL, edit); err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		h.enqueuePreview(session.UserID, shortURL, long, requestJSON.Title)
+
+		responseJSON := PostLongJSONResponse{Result: storage.URL(h.Location) + shortURL}
+		if conflict {
+			h.fail(w, r, storage.ErrConflictURL, responseJSON)
+			return
+		}
+		h.writeJSON(w, r, http.StatusCreated, responseJSON)
+	}
+}
+
+// ShortenBatchV2 сохраняет пачку ссылок. Итоги по ссылкам - в теле, статус ответа говорит
+// только о запросе целиком: 201 - создана хотя бы одна ссылка, иначе 200.
+func (h *MainHandler) ShortenBatchV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestJSON, err := decodeBatch(r.Body, h.Limits.BatchMaxSize)
+		if errors.Is(err, ErrBatchTooLarge) {
+			h.fail(w, r, err, map[string]int{"max_size": h.Limits.BatchMaxSize})
+			return
+		}
+		if err != nil {
+			h.fail(w, r, badRequest(err), nil)
+			return
+		}
+		responseJSON, ok := h.shortenBatch(w, r, requestJSON)
+		if !ok {
+			return
+		}
+		status := http.StatusOK
+		for _, p := range responseJSON {
+			if p.Status == storage.BatchCreated {
+				status = http.StatusCreated
+				break
+			}
+		}
+		h.writeJSON(w, r, status, responseJSON)
+	}
+}
+
+// GetUserURLsV2 - ссылки пользователя, параметры как у GetUserUrlsJSON.
+func (h *MainHandler) GetUserURLsV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := GetSession(r)
+		format, ok := userUrlsFormat(r)
+		if !ok {
+			h.fail(w, r, badRequest(errors.New("unsupported format, expected json, csv or ndjson")), nil)
+			return
+		}
+		opts, err := userListOptions(r)
+		if err != nil {
+			h.fail(w, r, badRequest(err), nil)
+			return
+		}
+		if format != userUrlsFormatJSON {
+			h.streamUserUrls(w, r, session.UserID, format, opts)
+			return
+		}
+		page, err := h.Repository.ListUserURLs(r.Context(), session.UserID, opts)
+		if err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		setNextPage(w, r, page.NextCursor)
+		responseJSON := make([]storage.URLPair, 0, len(page.Records))
+		for _, record := range page.Records {
+			responseJSON = append(responseJSON, h.urlPair(record))
+		}
+		h.writeJSON(w, r, http.StatusOK, responseJSON)
+	}
+}
+
+// SearchUserURLsV2 ищет ссылки пользователя по словам q, самые релевантные первыми.
+func (h *MainHandler) SearchUserURLsV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := GetSession(r)
+		limit, err := searchLimit(r)
+		if err != nil {
+			h.fail(w, r, badRequest(err), nil)
+			return
+		}
+		results, err := h.Repository.SearchUserURLs(r.Context(), session.UserID, r.URL.Query().Get("q"), limit)
+		if err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		responseJSON := make([]SearchURLResult, 0, len(results))
+		for _, result := range results {
+			responseJSON = append(responseJSON, h.searchURLResult(result))
+		}
+		h.writeJSON(w, r, http.StatusOK, responseJSON)
+	}
+}
+
+// EditUserURLV2 меняет теги, папку, заголовок и заметки ссылки пользователя.
+func (h *MainHandler) EditUserURLV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := GetSession(r)
+		var requestJSON EditURLRequest
+		if err := json.NewDecoder(r.Body).Decode(&requestJSON); err != nil {
+			h.fail(w, r, badRequest(err), nil)
+			return
+		}
+		edit, err := storage.URLEdit{
+			Tags:   requestJSON.Tags,
+			Folder: requestJSON.Folder,
+			Title:  requestJSON.Title,
+			Notes:  requestJSON.Notes,
+		}.Normalize()
+		if err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		short := storage.URL(chi.URLParam(r, "short"))
+		record, err := h.Repository.EditUserURL(r.Context(), session.UserID, short, edit)
+		if err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		h.writeJSON(w, r, http.StatusOK, h.urlPair(record))
+	}
+}
+
+// DeleteUserURLsV2 удаляет ссылки пользователя в фоне.
+func (h *MainHandler) DeleteUserURLsV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := GetSession(r)
+		var shortUrls []storage.URL
+		if err := json.NewDecoder(r.Body).Decode(&shortUrls); err != nil {
+			h.fail(w, r, badRequest(err), nil)
+			return
+		}
+		if err := h.Repository.DelayedDeleteUsersURLs(session.UserID, shortUrls...); err != nil {
+			h.fail(w, r, err, nil)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
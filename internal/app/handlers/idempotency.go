@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"go-url-shortener/internal/app/idempotency"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader - заголовок с ключом, по которому повтор запроса получает первый ответ.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotencyKeyLength - предельная длина ключа от клиента.
+	maxIdempotencyKeyLength = 255
+	// idempotencyLock - сколько ключ занят запросом, который так и не ответил (например, инстанс упал).
+	idempotencyLock = time.Minute
+)
+
+var (
+	ErrIdempotencyKeyTooLong  = errors.New("idempotency key is too long")
+	ErrIdempotencyKeyReused   = errors.New("idempotency key is already used for another request")
+	ErrIdempotencyKeyInFlight = errors.New("request with this idempotency key is in progress")
+)
+
+// Idempotency - хранение ответов на запросы с заголовком Idempotency-Key.
+type Idempotency struct {
+	// Store - где хранить ключи, nil - заголовок не поддерживается.
+	Store idempotency.Store
+	// Window - сколько хранить ответ.
+	Window time.Duration
+}
+
+// idempotencyWriter пишет ответ клиенту и запоминает его для повторов.
+type idempotencyWriter struct {
+	http.ResponseWriter
+	status      int
+	contentType string
+	body        bytes.Buffer
+}
+
+func (w *idempotencyWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.contentType = w.Header().Get("Content-Type")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// stored - стоит ли отдавать ответ повторам. Ошибки сервера и 429 временные: повтор выполняется заново.
+func (w *idempotencyWriter) stored() bool {
+	return w.status != 0 && w.status < http.StatusInternalServerError && w.status != http.StatusTooManyRequests
+}
+
+// idempotent отдает повтору запроса с тем же Idempotency-Key сохраненный ответ вместо нового
+// выполнения. Ключ действует в пределах пользователя; тот же ключ с другим запросом - 422.
+// Если хранилище недоступно, запрос выполняется как без ключа. Тело запроса с ключом
+// читается целиком, до maxBufferedBody.
+func (h *MainHandler) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || h.Idempotency.Store == nil || h.Idempotency.Window <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, ErrIdempotencyKeyTooLong)
+			return
+		}
+		body, ok := bufferBody(w, r)
+		if !ok {
+			return
+		}
+
+		sum := sha256.New()
+		io.WriteString(sum, r.Method+" "+r.URL.Path+"\n")
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+		storeKey := "user:" + GetSession(r).UserID + ":" + key
+
+		now := time.Now()
+		rec, begun, err := h.Idempotency.Store.Begin(r.Context(), storeKey, fingerprint, now, idempotencyLock)
+		if err != nil {
+			log.Println("cant check idempotency key", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !begun {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				writeError(w, r, http.StatusUnprocessableEntity, ErrIdempotencyKeyReused)
+			case rec.Response == nil:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusConflict, ErrIdempotencyKeyInFlight)
+			default:
+				if rec.Response.ContentType != "" {
+					w.Header().Set("Content-Type", rec.Response.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Response.Status)
+				w.Write(rec.Response.Body)
+			}
+			return
+		}
+
+		rw := &idempotencyWriter{ResponseWriter: w}
+		// ответ сохраняется и после отключения клиента: повтор придет как раз за ним
+		ctx := context.Background()
+		defer func() {
+			if rw.stored() {
+				resp := idempotency.Response{Status: rw.status, ContentType: rw.contentType, Body: rw.body.Bytes()}
+				if err := h.Idempotency.Store.Finish(ctx, storeKey, fingerprint, resp, now.Add(h.Idempotency.Window)); err != nil {
+					log.Println("cant save idempotent response", err)
+				}
+				return
+			}
+			if err := h.Idempotency.Store.Abort(ctx, storeKey, fingerprint); err != nil {
+				log.Println("cant release idempotency key", err)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
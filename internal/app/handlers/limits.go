@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"go-url-shortener/internal/app/ratelimit"
+	"go-url-shortener/internal/app/storage"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Классы маршрутов с отдельными лимитами.
+const (
+	RouteShorten  = "shorten"
+	RouteBatch    = "batch"
+	RouteRedirect = "redirect"
+)
+
+var ErrTooManyRequests = errors.New("too many requests")
+
+// RateLimit - лимиты одного класса маршрутов: по пользователю и по адресу клиента.
+// Без куки пользователь каждый раз новый, поэтому от скриптов защищает лимит по адресу.
+type RateLimit struct {
+	User *ratelimit.Limiter
+	IP   *ratelimit.Limiter
+}
+
+// Limits - ограничения частоты запросов и дневные квоты на создание ссылок.
+type Limits struct {
+	// Rates - по классу маршрута (RouteShorten, RouteBatch, RouteRedirect), нет класса - нет лимита.
+	Rates map[string]RateLimit
+	// DailyUser и DailyIP - сколько ссылок можно создать за сутки (UTC), 0 - без квоты.
+	DailyUser int
+	DailyIP   int
+	// BatchMaxSize - сколько ссылок можно передать в одной пачке, 0 - без ограничения.
+	BatchMaxSize int
+}
+
+// clientIP - адрес клиента; middleware.RealIP уже заменил RemoteAddr адресом из заголовков прокси.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// writeTooManyRequests отвечает 429 с Retry-After в целых секундах, не меньше одной.
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+	writeError(w, r, http.StatusTooManyRequests, err)
+}
+
+// rateLimit ограничивает частоту запросов класса class. Лимиты берутся из h.Limits на каждый запрос.
+func (h *MainHandler) rateLimit(class string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit, found := h.Limits.Rates[class]
+			if !found {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, wait := limit.IP.Allow(r.Context(), clientIP(r)); !ok {
+				writeTooManyRequests(w, r, wait, ErrTooManyRequests)
+				return
+			}
+			if ok, wait := limit.User.Allow(r.Context(), GetSession(r).UserID); !ok {
+				writeTooManyRequests(w, r, wait, ErrTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// dailyQuota - дневная квота одного ключа.
+type dailyQuota struct {
+	key   string
+	limit int
+}
+
+// quotaReservation - ссылки, заранее списанные с дневных квот до сохранения.
+type quotaReservation struct {
+	repo    storage.Repository
+	day     time.Time
+	n       int
+	charged []dailyQuota
+}
+
+// reserveQuota списывает n ссылок с дневных квот адреса и пользователя, пока неизвестно, сколько
+// из них создастся; после сохранения нужен keep. При превышении любой квоты возвращает уже
+// списанное, отвечает 429 и возвращает false. Ошибка хранилища квоту не проверяет:
+// лучше пропустить лишнее, чем не сокращать совсем.
+func (h *MainHandler) reserveQuota(w http.ResponseWriter, r *http.Request, n int) (*quotaReservation, bool) {
+	now := time.Now().UTC()
+	res := &quotaReservation{repo: h.Repository, day: now, n: n}
+	for _, quota := range []dailyQuota{
+		{key: "ip:" + clientIP(r), limit: h.Limits.DailyIP},
+		{key: "user:" + GetSession(r).UserID, limit: h.Limits.DailyUser},
+	} {
+		if quota.limit <= 0 {
+			continue
+		}
+		_, err := h.Repository.ConsumeDailyQuota(r.Context(), quota.key, now, n, quota.limit)
+		if errors.Is(err, storage.ErrQuotaExceeded) {
+			res.keep(0)
+			tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			writeTooManyRequests(w, r, tomorrow.Sub(now), err)
+			return nil, false
+		}
+		if err != nil {
+			log.Println("cant check quota", err)
+			continue
+		}
+		res.charged = append(res.charged, quota)
+	}
+	return res, true
+}
+
+// keep оставляет списанными created созданных ссылок, остальное возвращает в квоты тех же суток.
+// Возврат идет без контекста запроса: клиент мог уже отключиться.
+func (res *quotaReservation) keep(created int) {
+	unused := res.n - created
+	if unused <= 0 {
+		return
+	}
+	for _, quota := range res.charged {
+		_, err := res.repo.ConsumeDailyQuota(context.Background(), quota.key, res.day, -unused, quota.limit)
+		if err != nil {
+			log.Println("cant return quota", err)
+		}
+	}
+	res.charged = nil
+}
+
+// savedOne - сколько ссылок создало одиночное сохранение: конфликт и ошибка ничего не создают.
+func savedOne(err error) int {
+	if err != nil {
+		return 0
+	}
+	return 1
+}
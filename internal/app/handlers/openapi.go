@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"github.com/go-chi/chi/v5"
+	"go-url-shortener/internal/app/openapi"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// swaggerUIPage - Swagger UI для /api/openapi.json, скрипты и стили берутся с CDN.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>go-url-shortener API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@4/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@4/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+// OpenAPISpec отдает спецификацию API.
+func (h *MainHandler) OpenAPISpec() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if _, err := w.Write(openapi.Spec()); err != nil {
+			log.Println("write answer error", err)
+		}
+	}
+}
+
+// SwaggerUI отдает страницу документации API.
+func (h *MainHandler) SwaggerUI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := io.WriteString(w, swaggerUIPage); err != nil {
+			log.Println("write answer error", err)
+		}
+	}
+}
+
+// openAPIPath - путь спецификации для шаблона маршрута chi: без "/" в конце, кроме корня.
+func openAPIPath(pattern string) string {
+	if pattern == "/" {
+		return pattern
+	}
+	return strings.TrimSuffix(pattern, "/")
+}
+
+// validateRequest проверяет JSON тело запроса по спецификации, если включен h.ValidateRequests,
+// и отвечает 400 на тело, которое ей не соответствует. Тело читается целиком, до maxBufferedBody.
+func (h *MainHandler) validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.ValidateRequests {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rctx := chi.NewRouteContext()
+		if !h.Mux.Match(rctx, r.Method, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := openAPIPath(rctx.RoutePattern())
+		op := openapi.Default().Operation(path, r.Method)
+		if op == nil || op.RequestBody == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, ok := bufferBody(w, r)
+		if !ok {
+			return
+		}
+		if err := openapi.Default().ValidateRequestBody(path, r.Method, body); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
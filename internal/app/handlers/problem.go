@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5/middleware"
+	"go-url-shortener/internal/app/openapi"
+	"go-url-shortener/internal/app/storage"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// apiV2Prefix - префикс маршрутов второй версии API: ошибки в ней всегда Problem.
+const apiV2Prefix = "/api/v2"
+
+var (
+	ErrNotFound         = errors.New("resource not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	errInternal         = errors.New("internal server error")
+)
+
+// Problem - ошибка в ответе API v2 (application/problem+json).
+type Problem struct {
+	Status int `json:"status"`
+	// Code - машиночитаемый код ошибки, например invalid_url или quota_exceeded.
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// RequestID - id запроса из middleware.RequestID, по нему ищется запись в логе.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// problemCodes - статус и код ответа для известных ошибок, остальные - 500 internal_error.
+var problemCodes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{err: storage.ErrInvalidURL, status: http.StatusBadRequest, code: "invalid_url"},
+	{err: storage.ErrInvalidEdit, status: http.StatusBadRequest, code: "invalid_edit"},
+	{err: storage.ErrBadCursor, status: http.StatusBadRequest, code: "bad_cursor"},
+	{err: storage.ErrEmptyQuery, status: http.StatusBadRequest, code: "empty_query"},
+	{err: openapi.ErrInvalidRequest, status: http.StatusBadRequest, code: "invalid_request"},
+	{err: ErrBatchEmpty, status: http.StatusBadRequest, code: "batch_empty"},
+	{err: ErrIdempotencyKeyTooLong, status: http.StatusBadRequest, code: "idempotency_key_too_long"},
+	{err: storage.ErrBlockedURL, status: http.StatusForbidden, code: "blocked_url"},
+	{err: storage.ErrNotFoundURL, status: http.StatusNotFound, code: "not_found"},
+	{err: ErrNotFound, status: http.StatusNotFound, code: "not_found"},
+	{err: ErrMethodNotAllowed, status: http.StatusMethodNotAllowed, code: "method_not_allowed"},
+	{err: storage.ErrConflictURL, status: http.StatusConflict, code: "conflict"},
+	{err: ErrIdempotencyKeyInFlight, status: http.StatusConflict, code: "idempotency_key_in_flight"},
+	{err: storage.ErrDeletedURL, status: http.StatusGone, code: "deleted"},
+	{err: ErrBatchTooLarge, status: http.StatusRequestEntityTooLarge, code: "batch_too_large"},
+	{err: ErrRequestTooLarge, status: http.StatusRequestEntityTooLarge, code: "request_too_large"},
+	{err: ErrIdempotencyKeyReused, status: http.StatusUnprocessableEntity, code: "idempotency_key_reused"},
+	{err: storage.ErrQuotaExceeded, status: http.StatusTooManyRequests, code: "quota_exceeded"},
+	{err: ErrTooManyRequests, status: http.StatusTooManyRequests, code: "rate_limited"},
+}
+
+// badRequestError - ошибка в запросе клиента, для которой нет своего кода: 400 bad_request.
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e badRequestError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(err error) error {
+	return badRequestError{err: err}
+}
+
+// problemFor - статус и код ответа для ошибки err.
+func problemFor(err error) (int, string) {
+	for _, p := range problemCodes {
+		if errors.Is(err, p.err) {
+			return p.status, p.code
+		}
+	}
+	var bad badRequestError
+	if errors.As(err, &bad) {
+		return http.StatusBadRequest, "bad_request"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// statusCode - код ошибки по статусу ответа: 429 - too_many_requests.
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+func isAPIv2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiV2Prefix+"/")
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	p.RequestID = middleware.GetReqID(r.Context())
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Println("cant encode problem", err)
+		w.WriteHeader(p.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	if _, err = w.Write(append(body, '\n')); err != nil {
+		log.Println("write answer error", err)
+	}
+}
+
+// fail отвечает Problem для ошибки err. Внутренние ошибки пишутся в лог, а клиенту не показываются.
+func (h *MainHandler) fail(w http.ResponseWriter, r *http.Request, err error, details interface{}) {
+	status, code := problemFor(err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Println("request", middleware.GetReqID(r.Context()), "failed:", err)
+		message = errInternal.Error()
+	}
+	writeProblem(w, r, Problem{Status: status, Code: code, Message: message, Details: details})
+}
+
+// writeError отвечает ошибкой со статусом status так, как ждет клиент своей версии API:
+// v1 - {"error": ...}, v2 - Problem. Для middleware, общих у обеих версий.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if !isAPIv2(r) {
+		writeJSONError(w, status, err)
+		return
+	}
+	code := statusCode(status)
+	if known, knownCode := problemFor(err); known == status {
+		code = knownCode
+	}
+	writeProblem(w, r, Problem{Status: status, Code: code, Message: err.Error()})
+}
+
+// writeJSON отвечает v со статусом status. Тело кодируется до WriteHeader,
+// чтобы ошибка кодирования стала ответом 500, а не обрезанным телом.
+func (h *MainHandler) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		h.fail(w, r, err, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err = w.Write(append(body, '\n')); err != nil {
+		log.Println("write answer error", err)
+	}
+}
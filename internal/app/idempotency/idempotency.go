@@ -0,0 +1,98 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Response - сохраненный ответ на запрос, который отдается повторам с тем же ключом.
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Record - запрос, уже занявший ключ: отпечаток его тела и ответ.
+// Response == nil - запрос еще выполняется.
+type Record struct {
+	Fingerprint string
+	Response    *Response
+}
+
+// Store - хранилище ключей идемпотентности.
+type Store interface {
+	// Begin занимает ключ key для запроса с отпечатком fingerprint на время lock.
+	// Если ключ уже занят и не истек к моменту now, возвращает его запись и false.
+	Begin(ctx context.Context, key string, fingerprint string, now time.Time, lock time.Duration) (Record, bool, error)
+	// Finish сохраняет ответ на запрос с ключом key до expiresAt. Ключ, который после истечения
+	// занял запрос с другим отпечатком или который уже получил ответ, не меняется.
+	Finish(ctx context.Context, key string, fingerprint string, resp Response, expiresAt time.Time) error
+	// Abort освобождает ключ запроса, который еще выполняется, чтобы повтор выполнил его заново.
+	// Как и Finish, не трогает ключ запроса с другим отпечатком.
+	Abort(ctx context.Context, key string, fingerprint string) error
+}
+
+// sweepInterval - как часто MemoryStore удаляет истекшие ключи.
+const sweepInterval = time.Minute
+
+// MemoryStore - ключи в памяти процесса: повтор на другой инстанс или после перезапуска выполнится заново.
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+type entry struct {
+	Record
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*entry)}
+}
+
+func (s *MemoryStore) Begin(ctx context.Context, key string, fingerprint string, now time.Time, lock time.Duration) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	if e, found := s.entries[key]; found && now.Before(e.expiresAt) {
+		return e.Record, false, nil
+	}
+	s.entries[key] = &entry{Record: Record{Fingerprint: fingerprint}, expiresAt: now.Add(lock)}
+	return Record{}, true, nil
+}
+
+func (s *MemoryStore) Finish(ctx context.Context, key string, fingerprint string, resp Response, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, found := s.entries[key]; found && e.Fingerprint == fingerprint && e.Response == nil {
+		e.Response = &resp
+		e.expiresAt = expiresAt
+	}
+	return nil
+}
+
+func (s *MemoryStore) Abort(ctx context.Context, key string, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, found := s.entries[key]; found && e.Fingerprint == fingerprint && e.Response == nil {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if !now.Before(e.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
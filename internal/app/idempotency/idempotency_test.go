@@ -0,0 +1,75 @@
+package idempotency
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	_, ok, err := s.Begin(ctx, "u1:k1", "fp1", now, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// пока запрос выполняется, повтор получает запись без ответа
+	rec, ok, err := s.Begin(ctx, "u1:k1", "fp1", now, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, Record{Fingerprint: "fp1"}, rec)
+
+	resp := Response{Status: 201, ContentType: "text/plain", Body: []byte("http://localhost:8080/2e82f047")}
+	require.NoError(t, s.Finish(ctx, "u1:k1", "fp1", resp, now.Add(time.Hour)))
+	// готовый ответ Abort не удаляет
+	require.NoError(t, s.Abort(ctx, "u1:k1", "fp1"))
+	rec, ok, err = s.Begin(ctx, "u1:k1", "fp2", now.Add(30*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, Record{Fingerprint: "fp1", Response: &resp}, rec)
+
+	// после окна ключ свободен
+	_, ok, err = s.Begin(ctx, "u1:k1", "fp2", now.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// прерванный запрос освобождает ключ сразу
+	_, ok, _ = s.Begin(ctx, "u1:k2", "fp1", now, time.Minute)
+	require.True(t, ok)
+	require.NoError(t, s.Abort(ctx, "u1:k2", "fp1"))
+	_, ok, _ = s.Begin(ctx, "u1:k2", "fp1", now, time.Minute)
+	assert.True(t, ok)
+
+	// зависший запрос освобождает ключ через lock
+	_, ok, _ = s.Begin(ctx, "u1:k3", "fp1", now, time.Minute)
+	require.True(t, ok)
+	_, ok, _ = s.Begin(ctx, "u1:k3", "fp2", now.Add(time.Minute), time.Minute)
+	assert.True(t, ok)
+	// зависший запрос, завершившись, не трогает ключ, занятый после него другим запросом
+	require.NoError(t, s.Finish(ctx, "u1:k3", "fp1", resp, now.Add(time.Hour)))
+	require.NoError(t, s.Abort(ctx, "u1:k3", "fp1"))
+	rec, ok, _ = s.Begin(ctx, "u1:k3", "fp2", now.Add(time.Minute), time.Minute)
+	assert.False(t, ok)
+	assert.Equal(t, Record{Fingerprint: "fp2"}, rec)
+	// повторный Finish не перезаписывает готовый ответ
+	require.NoError(t, s.Finish(ctx, "u1:k3", "fp2", resp, now.Add(time.Hour)))
+	other := Response{Status: 500}
+	require.NoError(t, s.Finish(ctx, "u1:k3", "fp2", other, now.Add(time.Hour)))
+	rec, _, _ = s.Begin(ctx, "u1:k3", "fp2", now.Add(time.Minute), time.Minute)
+	assert.Equal(t, Record{Fingerprint: "fp2", Response: &resp}, rec)
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	s.Begin(ctx, "u1:k1", "fp1", now, time.Minute)
+	s.Begin(ctx, "u1:k2", "fp1", now, time.Hour)
+	s.Begin(ctx, "u1:k3", "fp1", now.Add(2*time.Minute), time.Minute)
+	assert.Len(t, s.entries, 2)
+}
@@ -0,0 +1,232 @@
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// spec - спецификация API. Ее надо менять вместе с маршрутами: тест в handlers сверяет их.
+//
+//go:embed openapi.json
+var spec []byte
+
+var ErrInvalidRequest = errors.New("request does not match api schema")
+
+// Spec - спецификация API в JSON.
+func Spec() []byte {
+	return spec
+}
+
+// Document - часть спецификации, нужная для проверки запросов.
+type Document struct {
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema - поддерживаемое подмножество JSON Schema: этого хватает для спецификации сервиса.
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Nullable   bool               `json:"nullable"`
+	Properties map[string]*Schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *Schema            `json:"items"`
+	OneOf      []*Schema          `json:"oneOf"`
+	Enum       []interface{}      `json:"enum"`
+	MinItems   *int               `json:"minItems"`
+	MaxItems   *int               `json:"maxItems"`
+	MinLength  *int               `json:"minLength"`
+	MaxLength  *int               `json:"maxLength"`
+	Minimum    *float64           `json:"minimum"`
+}
+
+var document = mustParse(spec)
+
+// Default - разобранная спецификация сервиса.
+func Default() *Document {
+	return document
+}
+
+func Parse(data []byte) (*Document, error) {
+	var d Document
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("cannot parse openapi spec: %w", err)
+	}
+	return &d, nil
+}
+
+func mustParse(data []byte) *Document {
+	d, err := Parse(data)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Operation - операция метода method по пути path из спецификации ("/api/user/urls/{short}"), nil - нет такой.
+func (d *Document) Operation(path string, method string) *Operation {
+	return d.Paths[path][strings.ToLower(method)]
+}
+
+// ValidateRequestBody проверяет JSON тело запроса к операции по ее схеме.
+// Операции без JSON тела в спецификации не проверяются.
+func (d *Document) ValidateRequestBody(path string, method string, body []byte) error {
+	op := d.Operation(path, method)
+	if op == nil || op.RequestBody == nil {
+		return nil
+	}
+	media, found := op.RequestBody.Content["application/json"]
+	if !found || media.Schema == nil {
+		return nil
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return fmt.Errorf("%w: request body is required", ErrInvalidRequest)
+		}
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if err := d.validate(media.Schema, value, "body"); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	return nil
+}
+
+// resolve заменяет ссылку "#/components/schemas/..." схемой.
+func (d *Document) resolve(s *Schema) (*Schema, error) {
+	for s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		ref, found := d.Components.Schemas[name]
+		if name == s.Ref || !found {
+			return nil, fmt.Errorf("unknown schema %v", s.Ref)
+		}
+		s = ref
+	}
+	return s, nil
+}
+
+// validate проверяет значение value, разобранное с UseNumber, по схеме s; at - где оно в теле запроса.
+func (d *Document) validate(s *Schema, value interface{}, at string) error {
+	s, err := d.resolve(s)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if s.Nullable || s.Type == "" && len(s.OneOf) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%v: must not be null", at)
+	}
+	if len(s.OneOf) > 0 {
+		matched := 0
+		for _, option := range s.OneOf {
+			if d.validate(option, value, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%v: must match exactly one schema", at)
+		}
+	}
+
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v: must be an object", at)
+		}
+		for _, name := range s.Required {
+			if _, found := object[name]; !found {
+				return fmt.Errorf("%v: %v is required", at, name)
+			}
+		}
+		for name, field := range object {
+			if prop, found := s.Properties[name]; found {
+				if err = d.validate(prop, field, at+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%v: must be an array", at)
+		}
+		if s.MinItems != nil && len(array) < *s.MinItems {
+			return fmt.Errorf("%v: must have at least %v items", at, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(array) > *s.MaxItems {
+			return fmt.Errorf("%v: must have at most %v items", at, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range array {
+				if err = d.validate(s.Items, item, fmt.Sprintf("%v[%v]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v: must be a string", at)
+		}
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%v: must be at least %v characters", at, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%v: must be at most %v characters", at, *s.MaxLength)
+		}
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%v: must be a %v", at, s.Type)
+		}
+		if _, err = number.Int64(); s.Type == "integer" && err != nil {
+			return fmt.Errorf("%v: must be an integer", at)
+		}
+		if f, _ := number.Float64(); s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%v: must be at least %v", at, *s.Minimum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%v: must be a boolean", at)
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v: must be one of %v", at, s.Enum)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package openapi
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// collectRefs собирает все "$ref" спецификации.
+func collectRefs(value interface{}, refs *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if ref, ok := field.(string); ok && key == "$ref" {
+				*refs = append(*refs, ref)
+				continue
+			}
+			collectRefs(field, refs)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectRefs(item, refs)
+		}
+	}
+}
+
+func TestSpec_Refs(t *testing.T) {
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(Spec(), &raw))
+	assert.Equal(t, "3.0.3", raw["openapi"])
+
+	var refs []string
+	collectRefs(raw, &refs)
+	require.NotEmpty(t, refs)
+	for _, ref := range refs {
+		require.True(t, strings.HasPrefix(ref, "#/"), ref)
+		var node interface{} = raw
+		for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			object, ok := node.(map[string]interface{})
+			require.True(t, ok, ref)
+			node, ok = object[name]
+			require.True(t, ok, "unresolved %v", ref)
+		}
+	}
+}
+
+func TestDocument_ValidateRequestBody(t *testing.T) {
+	d := Default()
+	tests := []struct {
+		name    string
+		path    string
+		method  string
+		body    string
+		wantErr string
+	}{
+		{name: "shorten", path: "/api/shorten", method: "POST", body: `{"url":"https://ya.ru/1","tags":["q3"]}`},
+		{name: "shorten unknown field", path: "/api/shorten", method: "POST", body: `{"url":"https://ya.ru/1","x":1}`},
+		{name: "shorten no url", path: "/api/shorten", method: "POST", body: `{"title":"Ya"}`, wantErr: "body: url is required"},
+		{name: "shorten url type", path: "/api/shorten", method: "POST", body: `{"url":1}`, wantErr: "body.url: must be a string"},
+		{name: "shorten null url", path: "/api/shorten", method: "POST", body: `{"url":null}`, wantErr: "body.url: must not be null"},
+		{name: "shorten long url", path: "/api/shorten", method: "POST",
+			body: `{"url":"https://ya.ru/` + strings.Repeat("a", 2048) + `"}`, wantErr: "at most 2048 characters"},
+		{name: "shorten tags type", path: "/api/shorten", method: "POST", body: `{"url":"https://ya.ru","tags":"q3"}`, wantErr: "body.tags: must be an array"},
+		{name: "shorten empty", path: "/api/shorten", method: "POST", body: ``, wantErr: "request body is required"},
+		{name: "shorten broken", path: "/api/shorten", method: "POST", body: `{"url":`, wantErr: "unexpected EOF"},
+		{name: "batch", path: "/api/shorten/batch", method: "POST", body: `[{"correlation_id":"1","original_url":"https://ya.ru"}]`},
+		{name: "batch empty", path: "/api/shorten/batch", method: "POST", body: `[]`},
+		{name: "v2 batch empty", path: "/api/v2/shorten/batch", method: "POST", body: `[]`, wantErr: "at least 1 items"},
+		{name: "batch item", path: "/api/shorten/batch", method: "POST",
+			body:    `[{"correlation_id":"1","original_url":"https://ya.ru"},{"correlation_id":2,"original_url":"https://ya.ru"}]`,
+			wantErr: "body[1].correlation_id: must be a string"},
+		{name: "edit", path: "/api/user/urls/{short}", method: "PATCH", body: `{"tags":[],"folder":"a"}`},
+		{name: "edit tags", path: "/api/user/urls/{short}", method: "PATCH", body: `{"tags":[1]}`, wantErr: "body.tags[0]: must be a string"},
+		{name: "delete", path: "/api/user/urls", method: "DELETE", body: `["2e82f047"]`},
+		{name: "delete object", path: "/api/user/urls", method: "DELETE", body: `{}`, wantErr: "body: must be an array"},
+		// текстовое тело и операции без тела не проверяются
+		{name: "text", path: "/", method: "POST", body: `https://ya.ru`},
+		{name: "no body", path: "/{short}", method: "GET", body: `x`},
+		{name: "unknown path", path: "/api/unknown", method: "POST", body: `x`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.ValidateRequestBody(tt.path, tt.method, []byte(tt.body))
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidRequest)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestDocument_Validate(t *testing.T) {
+	minimum := 1.0
+	d := &Document{}
+	d.Components.Schemas = map[string]*Schema{
+		"Status": {Type: "string", Enum: []interface{}{"created", "conflict"}},
+		"Limit":  {Type: "integer", Minimum: &minimum},
+		"Result": {OneOf: []*Schema{{Type: "string"}, {Type: "boolean"}}},
+	}
+	tests := []struct {
+		name    string
+		ref     string
+		value   interface{}
+		wantErr bool
+	}{
+		{name: "enum", ref: "Status", value: "created"},
+		{name: "not in enum", ref: "Status", value: "deleted", wantErr: true},
+		{name: "integer", ref: "Limit", value: json.Number("10")},
+		{name: "fraction", ref: "Limit", value: json.Number("1.5"), wantErr: true},
+		{name: "below minimum", ref: "Limit", value: json.Number("0"), wantErr: true},
+		{name: "one of", ref: "Result", value: true},
+		{name: "none of", ref: "Result", value: json.Number("1"), wantErr: true},
+		{name: "unknown ref", ref: "Unknown", value: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.validate(&Schema{Ref: "#/components/schemas/" + tt.ref}, tt.value, "body")
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
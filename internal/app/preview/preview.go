@@ -0,0 +1,257 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-url-shortener/internal/app/storage"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DefaultTimeout     = 5 * time.Second
+	DefaultMaxBodySize = 1 << 20
+	DefaultWorkers     = 2
+	DefaultQueueSize   = 1000
+	// maxRedirects - сколько перенаправлений проходить до страницы.
+	maxRedirects = 5
+)
+
+var ErrForbiddenAddress = errors.New("address is not public")
+
+type Options struct {
+	// Timeout - на всю загрузку страницы, вместе с перенаправлениями.
+	Timeout time.Duration
+	// MaxBodySize - сколько байт страницы читать, дальше заголовки не ищутся.
+	MaxBodySize int64
+	// AllowPrivate разрешает ходить на loopback и частные сети: только для тестов.
+	AllowPrivate bool
+	Workers      int
+	QueueSize    int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = DefaultMaxBodySize
+	}
+	if o.Workers <= 0 {
+		o.Workers = DefaultWorkers
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = DefaultQueueSize
+	}
+	return o
+}
+
+// Metadata - то, что удалось узнать о странице.
+type Metadata struct {
+	// Title - og:title, а без него <title>.
+	Title    string
+	ImageURL string
+}
+
+// Fetcher в фоне загружает страницы новых ссылок и сохраняет их заголовок и картинку.
+type Fetcher struct {
+	repo   storage.Repository
+	client *http.Client
+	opts   Options
+	queue  chan job
+}
+
+type job struct {
+	userID string
+	short  storage.URL
+	long   storage.URL
+}
+
+func NewFetcher(repo storage.Repository, opts Options) *Fetcher {
+	opts = opts.withDefaults()
+	return &Fetcher{
+		repo:   repo,
+		client: newClient(opts),
+		opts:   opts,
+		queue:  make(chan job, opts.QueueSize),
+	}
+}
+
+// newClient - клиент, который не ходит во внутренние сети. Адрес проверяется при соединении,
+// уже после резолва, поэтому не помогают ни перенаправления, ни DNS, отвечающий частным адресом.
+func newClient(opts Options) *http.Client {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w: %v", ErrForbiddenAddress, host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			// прокси из окружения обошел бы проверку адреса
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   opts.Timeout,
+			ResponseHeaderTimeout: opts.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %v redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// blockedNets - непубличные сети, которых нет среди проверок net.IP.
+var blockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"100.64.0.0/10", // carrier-grade NAT
+		"192.0.0.0/24",
+		"198.18.0.0/15", // тестирование производительности
+		"240.0.0.0/4",
+		"64:ff9b::/96", // NAT64 может вести в частную IPv4 сеть
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetch загружает страницу long и достает из нее заголовок и картинку.
+// Не html страница - пустые Metadata без ошибки.
+func (f *Fetcher) Fetch(ctx context.Context, long storage.URL) (Metadata, error) {
+	target, err := url.Parse(long.S())
+	if err != nil {
+		return Metadata{}, fmt.Errorf("cannot parse url: %w", err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return Metadata{}, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("cannot make request: %w", err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "go-url-shortener preview")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("cannot get page: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Metadata{}, fmt.Errorf("page status %v", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return Metadata{}, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.opts.MaxBodySize))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("cannot read page: %w", err)
+	}
+	// после перенаправлений относительная картинка считается от последней страницы
+	return parseMetadata(string(body), resp.Request.URL), nil
+}
+
+var (
+	titleRe     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title\s*>`)
+	metaRe      = regexp.MustCompile(`(?is)<meta\s([^>]*)>`)
+	attributeRe = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// parseMetadata ищет в html <title> и мета-теги Open Graph.
+// Полный разбор html не нужен: страница могла обрезаться по MaxBodySize.
+func parseMetadata(page string, base *url.URL) Metadata {
+	page = strings.ToValidUTF8(page, "")
+	var meta Metadata
+	if m := titleRe.FindStringSubmatch(page); m != nil {
+		meta.Title = cleanText(m[1])
+	}
+	for _, tag := range metaRe.FindAllStringSubmatch(page, -1) {
+		attrs := make(map[string]string)
+		for _, attr := range attributeRe.FindAllStringSubmatch(tag[1], -1) {
+			attrs[strings.ToLower(attr[1])] = attr[2] + attr[3] + attr[4]
+		}
+		// Open Graph пишется в property, но многие сайты пишут в name
+		property := strings.ToLower(attrs["property"])
+		if property == "" {
+			property = strings.ToLower(attrs["name"])
+		}
+		switch property {
+		case "og:title":
+			if title := cleanText(attrs["content"]); title != "" {
+				meta.Title = title
+			}
+		case "og:image", "og:image:url", "og:image:secure_url":
+			if meta.ImageURL == "" {
+				meta.ImageURL = imageURL(html.UnescapeString(attrs["content"]), base)
+			}
+		}
+	}
+	return meta
+}
+
+// cleanText раскрывает сущности html, схлопывает пробелы и обрезает до storage.MaxTitleLength.
+func cleanText(s string) string {
+	s = strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+	if utf8.RuneCountInString(s) > storage.MaxTitleLength {
+		s = string([]rune(s)[:storage.MaxTitleLength])
+	}
+	return s
+}
+
+// imageURL - абсолютная ссылка на картинку или "", если она не подходит для хранения.
+func imageURL(s string, base *url.URL) string {
+	ref, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || s == "" {
+		return ""
+	}
+	if base != nil {
+		ref = base.ResolveReference(ref)
+	}
+	normalized, err := storage.NormalizeImageURL(ref.String())
+	if err != nil {
+		return ""
+	}
+	return normalized
+}
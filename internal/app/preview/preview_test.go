@@ -0,0 +1,197 @@
+package preview
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-url-shortener/internal/app/storage"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetadata(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/post")
+	tests := []struct {
+		name string
+		page string
+		want Metadata
+	}{
+		{
+			name: "Test #1 title only",
+			page: `<html><head><TITLE lang="en">  Go &amp; the
+				web </TITLE></head></html>`,
+			want: Metadata{Title: "Go & the web"},
+		},
+		{
+			name: "Test #2 og tags win over title, relative image",
+			page: `<head><title>Site</title>
+				<meta property="og:title" content="Post &quot;one&quot;">
+				<meta content='/img/cover.png?a=1&amp;b=2' property='og:image' /></head>`,
+			want: Metadata{Title: `Post "one"`, ImageURL: "https://example.com/img/cover.png?a=1&b=2"},
+		},
+		{
+			name: "Test #3 og in name attribute, unsupported image scheme",
+			page: `<meta name=og:title content=Plain><meta name="og:image" content="javascript:alert(1)">`,
+			want: Metadata{Title: "Plain"},
+		},
+		{
+			name: "Test #4 page cut before closing title",
+			page: `<html><head><title>Unfinished`,
+			want: Metadata{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseMetadata(tt.page, base))
+		})
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		assert.Equal(t, want, isPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func newTestSite(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><title>Test page</title><meta property="og:image" content="/cover.png"></head></html>`)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusFound)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head>"+strings.Repeat(" ", 2048)+"<title>Too far</title></head></html>")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "<title>not html</title>")
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestFetcher_Fetch(t *testing.T) {
+	ts := newTestSite(t)
+	f := NewFetcher(nil, Options{AllowPrivate: true, Timeout: 100 * time.Millisecond, MaxBodySize: 1024})
+
+	tests := []struct {
+		name    string
+		path    string
+		want    Metadata
+		wantErr bool
+	}{
+		{name: "Test #1 html page", path: "/page", want: Metadata{Title: "Test page", ImageURL: ts.URL + "/cover.png"}},
+		{name: "Test #2 redirect", path: "/redirect", want: Metadata{Title: "Test page", ImageURL: ts.URL + "/cover.png"}},
+		{name: "Test #3 title after size limit", path: "/big", want: Metadata{}},
+		{name: "Test #4 not html", path: "/image.png", want: Metadata{}},
+		{name: "Test #5 not found", path: "/missing", wantErr: true},
+		{name: "Test #6 timeout", path: "/slow", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.Fetch(context.Background(), storage.URL(ts.URL+tt.path))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := f.Fetch(context.Background(), "ftp://example.com/file")
+	assert.Error(t, err)
+}
+
+func TestFetcher_FetchPrivate(t *testing.T) {
+	ts := newTestSite(t)
+	f := NewFetcher(nil, Options{Timeout: time.Second})
+	_, err := f.Fetch(context.Background(), storage.URL(ts.URL+"/page"))
+	assert.ErrorIs(t, err, ErrForbiddenAddress)
+}
+
+func TestFetcher_Run(t *testing.T) {
+	ts := newTestSite(t)
+	repo := storage.NewMemoryMap()
+	f := NewFetcher(repo, Options{AllowPrivate: true, Timeout: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	page := storage.URL(ts.URL + "/page")
+	short, err := repo.SaveLongURL(page, "u1")
+	require.NoError(t, err)
+	saved, err := repo.GetURLInfo(short)
+	require.NoError(t, err)
+	titled := storage.URL(ts.URL + "/redirect")
+	titledShort, err := repo.SaveLongURL(titled, "u1")
+	require.NoError(t, err)
+	title := "My title"
+	_, err = repo.EditUserURL(ctx, "u1", titledShort, storage.URLEdit{Title: &title})
+	require.NoError(t, err)
+
+	// чужая ссылка не меняется
+	require.True(t, f.Enqueue("u2", short, page))
+	require.True(t, f.Enqueue("u1", titledShort, titled))
+	require.True(t, f.Enqueue("u1", short, page))
+
+	assert.Eventually(t, func() bool {
+		record, err := repo.GetURLInfo(short)
+		return err == nil && record.Title == "Test page"
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		record, err := repo.GetURLInfo(titledShort)
+		return err == nil && record.ImageURL == ts.URL+"/cover.png"
+	}, time.Second, 10*time.Millisecond)
+	record, err := repo.GetURLInfo(titledShort)
+	require.NoError(t, err)
+	assert.Equal(t, title, record.Title)
+	// загруженный заголовок - не правка пользователя
+	record, err = repo.GetURLInfo(short)
+	require.NoError(t, err)
+	assert.Equal(t, saved.UpdatedAt, record.UpdatedAt)
+}
+
+func TestFetcher_EnqueueFull(t *testing.T) {
+	f := NewFetcher(storage.NewMemoryMap(), Options{QueueSize: 1})
+	assert.True(t, f.Enqueue("u1", "a", "https://example.com/a"))
+	assert.False(t, f.Enqueue("u1", "b", "https://example.com/b"))
+}
@@ -0,0 +1,78 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-url-shortener/internal/app/storage"
+	"log"
+	"sync"
+)
+
+// Enqueue ставит ссылку в очередь на загрузку заголовка. Не блокирует:
+// при переполненной очереди ссылка пропускается и возвращается false.
+func (f *Fetcher) Enqueue(userID string, short storage.URL, long storage.URL) bool {
+	select {
+	case f.queue <- job{userID: userID, short: short, long: long}:
+		return true
+	default:
+		log.Printf("preview queue is full, skip %v", short)
+		return false
+	}
+}
+
+// Run обрабатывает очередь в Options.Workers горутин до отмены ctx.
+func (f *Fetcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < f.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-f.queue:
+					if err := f.process(ctx, j); err != nil {
+						log.Printf("preview %v error: %v", j.short, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// process загружает страницу и заполняет пустые заголовок и картинку ссылки:
+// заданное пользователем не перезаписывается.
+func (f *Fetcher) process(ctx context.Context, j job) error {
+	record, err := f.repo.GetURLInfo(j.short)
+	if err != nil {
+		return fmt.Errorf("cannot get url: %w", err)
+	}
+	if record.UserID != j.userID || record.Deleted || (record.Title != "" && record.ImageURL != "") {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.opts.Timeout)
+	defer cancel()
+	meta, err := f.Fetch(ctx, j.long)
+	if err != nil {
+		return err
+	}
+
+	edit := storage.URLEdit{Title: &meta.Title, ImageURL: &meta.ImageURL}
+	if edit, err = edit.Normalize(); err != nil {
+		return err
+	}
+	if *edit.Title == "" && *edit.ImageURL == "" {
+		return nil
+	}
+	// пока грузили страницу, пользователь мог задать заголовок сам: хранилище заполняет только пустое
+	err = f.repo.FillUserURLPreview(ctx, j.userID, j.short, *edit.Title, *edit.ImageURL)
+	if errors.Is(err, storage.ErrNotFoundURL) {
+		// ссылку успели отдать другому пользователю
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate - N запросов за Per. Все N можно сделать сразу: столько помещается в корзину MemoryStore
+// и столько же разрешает окно storage.PGRateStore.
+type Rate struct {
+	N   int
+	Per time.Duration
+}
+
+// ParseRate разбирает лимит вида "30/m" (s, m, h или длительность: "100/10s").
+// Пустая строка и "0" - без лимита.
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Rate{}, nil
+	}
+	count, period, found := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !found || err != nil || n < 0 {
+		return Rate{}, fmt.Errorf("bad rate %q: expected count/period like 30/m", s)
+	}
+	var per time.Duration
+	switch period {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		if per, err = time.ParseDuration(period); err != nil || per <= 0 {
+			return Rate{}, fmt.Errorf("bad rate %q: unknown period %q", s, period)
+		}
+	}
+	return Rate{N: n, Per: per}, nil
+}
+
+func (r Rate) IsZero() bool {
+	return r.N == 0
+}
+
+// Store - хранилище счетчиков лимитов. Один Store делят все Limiter, ключи различаются именем лимитера.
+type Store interface {
+	// Take забирает один запрос ключа key по лимиту rate в момент now.
+	// Если лимит исчерпан - false и через сколько можно повторить.
+	Take(ctx context.Context, key string, rate Rate, now time.Time) (bool, time.Duration, error)
+}
+
+// warnInterval - как часто писать в лог, что хранилище недоступно.
+const warnInterval = time.Minute
+
+// Limiter ограничивает запросы по ключу (пользователю, адресу). Если хранилище недоступно,
+// запросы пропускаются: без лимита сервис работает, а без сокращения ссылок - нет.
+type Limiter struct {
+	name     string
+	rate     Rate
+	store    Store
+	now      func() time.Time
+	mu       sync.Mutex
+	lastWarn time.Time
+}
+
+// NewLimiter - лимитер с именем name (часть ключа в store), store == nil - свой MemoryStore.
+func NewLimiter(name string, rate Rate, store Store) *Limiter {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Limiter{name: name, rate: rate, store: store, now: time.Now}
+}
+
+// Allow пропускает запрос ключа key. Если лимит исчерпан, возвращает false и через сколько повторить.
+func (l *Limiter) Allow(ctx context.Context, key string) (bool, time.Duration) {
+	if l == nil || l.rate.IsZero() {
+		return true, 0
+	}
+	ok, wait, err := l.store.Take(ctx, l.name+":"+key, l.rate, l.now())
+	if err != nil {
+		l.warn(err)
+		return true, 0
+	}
+	return ok, wait
+}
+
+func (l *Limiter) warn(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := l.now(); now.Sub(l.lastWarn) >= warnInterval {
+		l.lastWarn = now
+		log.Printf("rate limit %v is not checked: %v", l.name, err)
+	}
+}
+
+// MemoryStore - token bucket на каждый ключ в памяти процесса. Корзины, которые успели
+// наполниться, удаляются, так что память занимают только активные ключи.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, rate Rate, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	b, found := s.buckets[key]
+	if !found || b.rate != rate {
+		b = &bucket{rate: rate, tokens: float64(rate.N), last: now}
+		s.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) * float64(rate.Per) / float64(rate.N)), nil
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) * float64(b.rate.N) / float64(b.rate.Per)
+		if b.tokens > float64(b.rate.N) {
+			b.tokens = float64(b.rate.N)
+		}
+		b.last = now
+	}
+}
+
+// sweepInterval - как часто MemoryStore ищет полные корзины.
+const sweepInterval = time.Minute
+
+// sweep удаляет полные корзины: новая корзина для ключа будет такой же.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.rate.N) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Rate
+		wantErr bool
+	}{
+		{in: "", want: Rate{}},
+		{in: "0", want: Rate{}},
+		{in: "30/m", want: Rate{N: 30, Per: time.Minute}},
+		{in: " 5/s ", want: Rate{N: 5, Per: time.Second}},
+		{in: "1000/h", want: Rate{N: 1000, Per: time.Hour}},
+		{in: "100/10s", want: Rate{N: 100, Per: 10 * time.Second}},
+		{in: "30", wantErr: true},
+		{in: "x/m", wantErr: true},
+		{in: "-1/m", wantErr: true},
+		{in: "3/day", wantErr: true},
+		{in: "3/-1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRate(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMemoryStore_Take(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	rate := Rate{N: 2, Per: time.Minute}
+	s := NewMemoryStore()
+	take := func(key string) (bool, time.Duration) {
+		ok, wait, err := s.Take(ctx, key, rate, now)
+		require.NoError(t, err)
+		return ok, wait
+	}
+
+	for i := 0; i < 2; i++ {
+		ok, _ := take("a")
+		assert.True(t, ok)
+	}
+	ok, wait := take("a")
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+	// у другого ключа своя корзина
+	ok, _ = take("b")
+	assert.True(t, ok)
+
+	now = now.Add(15 * time.Second)
+	ok, wait = take("a")
+	assert.False(t, ok)
+	assert.Equal(t, 15*time.Second, wait)
+	now = now.Add(15 * time.Second)
+	ok, _ = take("a")
+	assert.True(t, ok)
+
+	// через sweepInterval полные корзины удаляются
+	now = now.Add(2 * time.Minute)
+	ok, _ = take("c")
+	assert.True(t, ok)
+	assert.Len(t, s.buckets, 1)
+}
+
+type failingStore struct {
+	calls int
+}
+
+func (s *failingStore) Take(ctx context.Context, key string, rate Rate, now time.Time) (bool, time.Duration, error) {
+	s.calls++
+	return false, 0, errors.New("connection refused")
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	user := NewLimiter("shorten:user", Rate{N: 1, Per: time.Minute}, store)
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	user.now = func() time.Time { return now }
+	ip := NewLimiter("shorten:ip", Rate{N: 1, Per: time.Minute}, store)
+
+	ok, _ := user.Allow(ctx, "a")
+	assert.True(t, ok)
+	ok, wait := user.Allow(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, wait)
+	// имя лимитера - часть ключа, счетчики в общем хранилище не смешиваются
+	ok, _ = ip.Allow(ctx, "a")
+	assert.True(t, ok)
+
+	// недоступное хранилище пропускает запросы
+	failing := &failingStore{}
+	ok, _ = NewLimiter("batch:ip", Rate{N: 1, Per: time.Minute}, failing).Allow(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, failing.calls)
+
+	var disabled *Limiter
+	ok, _ = disabled.Allow(ctx, "a")
+	assert.True(t, ok)
+	ok, _ = NewLimiter("off", Rate{}, failing).Allow(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, failing.calls)
+}
@@ -6,12 +6,18 @@ import (
 	"net/http"
 )
 
-func Serve(addr string, baseURL string, db storage.Repository) error {
+// Serve запускает сервер; previews может быть nil, тогда заголовки ссылок не загружаются.
+func Serve(addr string, baseURL string, db storage.Repository, previews handlers.PreviewQueue, limits handlers.Limits,
+	idempotency handlers.Idempotency, validateRequests bool) error {
 	//проверяем не забыт ли "/" в конце BASE_URL
 	if baseURL[len(baseURL)-1:] != "/" {
 		baseURL = baseURL + "/"
 	}
 	handler := handlers.NewMainHandler(db, baseURL)
+	handler.Previews = previews
+	handler.Limits = limits
+	handler.Idempotency = idempotency
+	handler.ValidateRequests = validateRequests
 
 	server := &http.Server{
 		Addr:    addr,
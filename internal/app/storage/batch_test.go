@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// testSaveLongBatchStatuses проверяет, что хранилище отвечает по каждой ссылке пачки, в порядке запроса.
+func testSaveLongBatchStatuses(t *testing.T, d Repository) {
+	_, err := d.SaveLongURL("https://ya.ru/1123", "u1")
+	require.NoError(t, err)
+	_, err = d.SaveLongURL("https://ya.ru/1", "u2")
+	require.NoError(t, err)
+
+	result, err := d.SaveLongBatchURL([]CorrelationLongPair{
+		{CorrelationID: "new", LongURL: "https://ya.ru/1123333"},
+		{CorrelationID: "existing", LongURL: "https://ya.ru/1123"},
+		{CorrelationID: "repeated", LongURL: "https://ya.ru/1123333"},
+		{CorrelationID: "other", LongURL: "https://ya.ru/1"},
+	}, "u1")
+	require.NoError(t, err)
+	assert.Equal(t, []CorrelationShortPair{
+		{CorrelationID: "new", ShortURL: "ac5a78ac", Status: BatchCreated},
+		{CorrelationID: "existing", ShortURL: "b3f51159", Status: BatchConflict, Owner: OwnerSameUser},
+		{CorrelationID: "repeated", ShortURL: "ac5a78ac", Status: BatchConflict, Owner: OwnerSameUser},
+		{CorrelationID: "other", ShortURL: "2e82f047", Status: BatchConflict, Owner: OwnerOtherUser},
+	}, result)
+
+	// чужая ссылка осталась у владельца
+	info, err := d.GetURLInfo("2e82f047")
+	require.NoError(t, err)
+	assert.Equal(t, "u2", info.UserID)
+	// и не попала в список того, кто ее прислал
+	for _, pair := range d.GetUsersURLs("u1") {
+		assert.NotEqual(t, URL("2e82f047"), pair.ShortURL)
+	}
+}
+
+func TestMemoryMap_SaveLongBatchURL(t *testing.T) {
+	testSaveLongBatchStatuses(t, NewMemoryMap())
+}
+
+func TestFileStorage_SaveLongBatchURL(t *testing.T) {
+	buffer := bytes.Buffer{}
+	d := &FileStorage{memMap: NewMemoryMap(), encoder: json.NewEncoder(&buffer)}
+	testSaveLongBatchStatuses(t, d)
+	// чужая ссылка в файл не пишется
+	assert.Equal(t, 1, strings.Count(buffer.String(), `"ShortURL":"2e82f047"`))
+}
+
+func TestRedis_SaveLongBatchURLStatuses(t *testing.T) {
+	d, _ := newTestRedis(t, 0)
+	testSaveLongBatchStatuses(t, d)
+}
+
+func TestSharded_SaveLongBatchURL(t *testing.T) {
+	testSaveLongBatchStatuses(t, NewSharded(map[string]Repository{"s1": NewMemoryMap(), "s2": NewMemoryMap()}))
+}
+
+func TestPG_SaveLongBatchURL(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	mock.ExpectQuery(`SELECT id FROM "user"`).WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int64(7)))
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE tmp_table`).WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	mock.ExpectCopyFrom(`"tmp_table"`, []string{"short", "long", "user_id", "is_deleted"}).WillReturnResult(3)
+	// чужая ссылка other не возвращается, своя b3f51159 обновлена
+	mock.ExpectQuery(`INSERT INTO "url" (.+) SELECT (.+) FROM tmp_table\s+ON CONFLICT \("short"\)\s+DO UPDATE (.+) RETURNING "short", \(xmax = 0\)`).
+		WillReturnRows(mock.NewRows([]string{"short", "inserted"}).
+			AddRow(URL("ac5a78ac"), true).
+			AddRow(URL("b3f51159"), false))
+	mock.ExpectCommit()
+	mock.ExpectRollback()
+
+	d := &PG{db: mock, recentWrites: newRecentWrites(0)}
+	result, err := d.SaveLongBatchURL([]CorrelationLongPair{
+		{CorrelationID: "new", LongURL: "https://ya.ru/1123333"},
+		{CorrelationID: "own", LongURL: "https://ya.ru/1123"},
+		{CorrelationID: "repeated", LongURL: "https://ya.ru/1123333"},
+		{CorrelationID: "other", LongURL: "https://ya.ru/1"},
+	}, userID)
+	require.NoError(t, err)
+	assert.Equal(t, []CorrelationShortPair{
+		{CorrelationID: "new", ShortURL: "ac5a78ac", Status: BatchCreated},
+		{CorrelationID: "own", ShortURL: "b3f51159", Status: BatchConflict, Owner: OwnerSameUser},
+		{CorrelationID: "repeated", ShortURL: "ac5a78ac", Status: BatchConflict, Owner: OwnerSameUser},
+		{CorrelationID: "other", ShortURL: "2e82f047", Status: BatchConflict, Owner: OwnerOtherUser},
+	}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache - декоратор Repository, кэширующий GetLongURL в ограниченном LRU.
+// Ответы "не найдено" кэшируются отдельно на negativeTTL (обычно короче ttl).
+// Любые изменения ссылок через Cache сбрасывают соответствующие записи.
+type Cache struct {
+	repo        Repository
+	mu          sync.Mutex
+	ll          *list.List
+	items       map[URL]*list.Element
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	hits        uint64
+	misses      uint64
+	now         func() time.Time
+	// gen растет при каждом сбросе: ответ хранилища, полученный до сброса, в кэш не попадает
+	gen uint64
+}
+
+// DeleteNotifier - хранилище с отложенным удалением, которое сообщает, когда удаление применено.
+type DeleteNotifier interface {
+	// OnDelete добавляет fn, которую хранилище вызывает с удаленными ссылками.
+	OnDelete(fn func(shortUrls ...URL))
+}
+
+type cacheEntry struct {
+	short   URL
+	long    URL
+	err     error
+	expires time.Time
+}
+
+// CacheStats - счетчики попаданий и промахов кэша.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Len    int
+}
+
+// NewCache оборачивает repo кэшем на size записей.
+// negativeTTL == 0 отключает кэширование ненайденных ссылок.
+func NewCache(repo Repository, size int, ttl time.Duration, negativeTTL time.Duration) *Cache {
+	c := &Cache{
+		repo:        repo,
+		ll:          list.New(),
+		items:       make(map[URL]*list.Element),
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+	}
+	if notifier, ok := repo.(DeleteNotifier); ok {
+		notifier.OnDelete(c.Invalidate)
+	}
+	return c
+}
+
+func (c *Cache) get(short URL) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[short]
+	if !found {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return entry, true
+}
+
+// generation - номер последнего сброса, см. add.
+func (c *Cache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// add кэширует entry, если с чтения gen ничего не сбрасывалось.
+func (c *Cache) add(entry *cacheEntry, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if el, found := c.items[entry.short]; found {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[entry.short] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).short)
+}
+
+// Invalidate удаляет из кэша записи для коротких ссылок.
+func (c *Cache) Invalidate(shortUrls ...URL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, short := range shortUrls {
+		if el, found := c.items[short]; found {
+			c.removeElement(el)
+		}
+	}
+}
+
+// Purge полностью очищает кэш.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.ll.Init()
+	c.items = make(map[URL]*list.Element)
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+		Len:    c.ll.Len(),
+	}
+}
+
+func (c *Cache) GetLongURL(short URL) (URL, error) {
+	if entry, found := c.get(short); found {
+		atomic.AddUint64(&c.hits, 1)
+		return entry.long, entry.err
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	gen := c.generation()
+	long, err := c.repo.GetLongURL(short)
+	switch {
+	case err == nil, errors.Is(err, ErrDeletedURL):
+		c.add(&cacheEntry{short: short, long: long, err: err, expires: c.now().Add(c.ttl)}, gen)
+	case errors.Is(err, ErrNotFoundURL) && c.negativeTTL > 0:
+		c.add(&cacheEntry{short: short, err: err, expires: c.now().Add(c.negativeTTL)}, gen)
+	}
+	return long, err
+}
+
+func (c *Cache) SaveLongURL(long URL, userID string) (URL, error) {
+	short, err := c.repo.SaveLongURL(long, userID)
+	if short != "" {
+		c.Invalidate(short)
+	}
+	return short, err
+}
+
+func (c *Cache) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]CorrelationShortPair, error) {
+	result, err := c.repo.SaveLongBatchURL(longURLS, userID)
+	// пачка может перезаписать или восстановить удаленные ссылки
+	for _, p := range result {
+		c.Invalidate(p.ShortURL)
+	}
+	return result, err
+}
+
+func (c *Cache) GetUsersURLs(userID string) []URLPair {
+	return c.repo.GetUsersURLs(userID)
+}
+
+func (c *Cache) ListUserURLs(ctx context.Context, userID string, opts ListOptions) (URLPage, error) {
+	return c.repo.ListUserURLs(ctx, userID, opts)
+}
+
+func (c *Cache) SearchUserURLs(ctx context.Context, userID string, query string, limit int) ([]SearchResult, error) {
+	return c.repo.SearchUserURLs(ctx, userID, query, limit)
+}
+
+func (c *Cache) EditUserURL(ctx context.Context, userID string, short URL, edit URLEdit) (URLRecord, error) {
+	return c.repo.EditUserURL(ctx, userID, short, edit)
+}
+
+func (c *Cache) FillUserURLPreview(ctx context.Context, userID string, short URL, title string, imageURL string) error {
+	return c.repo.FillUserURLPreview(ctx, userID, short, title, imageURL)
+}
+
+func (c *Cache) DeleteUsersURLs(userID string, shortUrls ...URL) error {
+	err := c.repo.DeleteUsersURLs(userID, shortUrls...)
+	c.Invalidate(shortUrls...)
+	return err
+}
+
+func (c *Cache) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) error {
+	// сбрасываем сразу и еще раз, когда хранилище применит удаление (DeleteNotifier):
+	// до этого ссылка еще действует и может закэшироваться снова
+	c.Invalidate(shortUrls...)
+	return c.repo.DelayedDeleteUsersURLs(userID, shortUrls...)
+}
+
+func (c *Cache) RestoreUsersURLs(userID string, shortUrls ...URL) error {
+	err := c.repo.RestoreUsersURLs(userID, shortUrls...)
+	c.Invalidate(shortUrls...)
+	return err
+}
+
+func (c *Cache) GetURLInfo(short URL) (URLRecord, error) {
+	return c.repo.GetURLInfo(short)
+}
+
+func (c *Cache) ConsumeDailyQuota(ctx context.Context, key string, day time.Time, n int, limit int) (int, error) {
+	return c.repo.ConsumeDailyQuota(ctx, key, day, n, limit)
+}
+
+func (c *Cache) Ping() bool {
+	return c.repo.Ping()
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// countingRepo считает обращения к GetLongURL и запоминает удаления.
+type countingRepo struct {
+	*MemoryMap
+	gets    int
+	deleted map[URL]bool
+}
+
+func newCountingRepo() *countingRepo {
+	return &countingRepo{MemoryMap: NewMemoryMap(), deleted: make(map[URL]bool)}
+}
+
+func (r *countingRepo) GetLongURL(short URL) (URL, error) {
+	r.gets++
+	if r.deleted[short] {
+		return "", ErrDeletedURL
+	}
+	return r.MemoryMap.GetLongURL(short)
+}
+
+func (r *countingRepo) DeleteUsersURLs(userID string, shortUrls ...URL) error {
+	for _, short := range shortUrls {
+		r.deleted[short] = true
+	}
+	return nil
+}
+
+func TestCache_GetLongURL(t *testing.T) {
+	repo := newCountingRepo()
+	repo.SetLongURL("https://ya.ru/1", "s1", "user")
+	repo.SetLongURL("https://ya.ru/2", "s2", "user")
+	repo.SetLongURL("https://ya.ru/3", "s3", "user")
+
+	c := NewCache(repo, 2, time.Minute, time.Second)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		long, err := c.GetLongURL("s1")
+		require.NoError(t, err)
+		assert.Equal(t, URL("https://ya.ru/1"), long)
+	}
+	assert.Equal(t, 1, repo.gets)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Len: 1}, c.Stats())
+
+	// s2 и s3 вытесняют s1 из кэша на две записи
+	_, _ = c.GetLongURL("s2")
+	_, _ = c.GetLongURL("s3")
+	_, _ = c.GetLongURL("s1")
+	assert.Equal(t, 4, repo.gets)
+	assert.Equal(t, 2, c.Stats().Len)
+
+	now = now.Add(2 * time.Minute)
+	_, _ = c.GetLongURL("s1")
+	assert.Equal(t, 5, repo.gets, "expired entry must be reloaded")
+}
+
+func TestCache_NegativeCaching(t *testing.T) {
+	repo := newCountingRepo()
+	c := NewCache(repo, 10, time.Minute, time.Second)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	_, err := c.GetLongURL("6db64c5d")
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+	_, err = c.GetLongURL("6db64c5d")
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+	assert.Equal(t, 1, repo.gets)
+
+	now = now.Add(2 * time.Second)
+	_, err = c.GetLongURL("6db64c5d")
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+	assert.Equal(t, 2, repo.gets)
+
+	// сохранение должно сбросить закэшированное "не найдено"
+	short, err := c.SaveLongURL("long_url", "user")
+	require.NoError(t, err)
+	require.Equal(t, URL("6db64c5d"), short)
+	long, err := c.GetLongURL(short)
+	assert.NoError(t, err)
+	assert.Equal(t, URL("long_url"), long)
+}
+
+func TestCache_InvalidateOnDelete(t *testing.T) {
+	repo := newCountingRepo()
+	repo.SetLongURL("https://ya.ru/1123", "b3f51159", "user")
+	c := NewCache(repo, 10, time.Minute, time.Second)
+
+	_, err := c.GetLongURL("b3f51159")
+	require.NoError(t, err)
+
+	require.NoError(t, c.DeleteUsersURLs("user", "b3f51159"))
+	_, err = c.GetLongURL("b3f51159")
+	assert.ErrorIs(t, err, ErrDeletedURL)
+	assert.Equal(t, 2, repo.gets)
+
+	// повторная пачка восстанавливает ссылку и тоже сбрасывает запись
+	delete(repo.deleted, "b3f51159")
+	_, err = c.SaveLongBatchURL([]CorrelationLongPair{{CorrelationID: "1", LongURL: "https://ya.ru/1123"}}, "user")
+	require.NoError(t, err)
+	long, err := c.GetLongURL("b3f51159")
+	assert.NoError(t, err)
+	assert.Equal(t, URL("https://ya.ru/1123"), long)
+	assert.Equal(t, 3, repo.gets)
+}
+
+// delayedRepo удаляет ссылки только по flush, как отложенное удаление PG.
+type delayedRepo struct {
+	*countingRepo
+	pending  []URL
+	onDelete []func(shortUrls ...URL)
+}
+
+func (r *delayedRepo) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) error {
+	r.pending = append(r.pending, shortUrls...)
+	return nil
+}
+
+func (r *delayedRepo) OnDelete(fn func(shortUrls ...URL)) {
+	r.onDelete = append(r.onDelete, fn)
+}
+
+func (r *delayedRepo) flush() {
+	_ = r.DeleteUsersURLs("user", r.pending...)
+	for _, fn := range r.onDelete {
+		fn(r.pending...)
+	}
+	r.pending = nil
+}
+
+func TestCache_DelayedDelete(t *testing.T) {
+	repo := &delayedRepo{countingRepo: newCountingRepo()}
+	repo.SetLongURL("https://ya.ru/1123", "b3f51159", "user")
+	c := NewCache(repo, 10, time.Minute, time.Second)
+
+	require.NoError(t, c.DelayedDeleteUsersURLs("user", "b3f51159"))
+	// до удаления в базе ссылка действует и снова попадает в кэш
+	_, err := c.GetLongURL("b3f51159")
+	require.NoError(t, err)
+
+	repo.flush()
+	_, err = c.GetLongURL("b3f51159")
+	assert.ErrorIs(t, err, ErrDeletedURL)
+}
+
+// holdPipelines задерживает пайплайны redis, пока не закрыт release.
+type holdPipelines struct {
+	release chan struct{}
+}
+
+func (h holdPipelines) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h holdPipelines) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h holdPipelines) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	<-h.release
+	return ctx, nil
+}
+
+func (h holdPipelines) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+func TestCache_DelayedDeleteRedis(t *testing.T) {
+	repo, _ := newTestRedis(t, 0)
+	short, err := repo.SaveLongURL("https://ya.ru/1123", "user")
+	require.NoError(t, err)
+	hold := holdPipelines{release: make(chan struct{})}
+	repo.client.AddHook(hold)
+	c := NewCache(repo, 10, time.Minute, time.Second)
+
+	require.NoError(t, c.DelayedDeleteUsersURLs("user", short))
+	// до применения удаления ссылка действует и снова попадает в кэш
+	_, err = c.GetLongURL(short)
+	require.NoError(t, err)
+
+	close(hold.release)
+	assert.Eventually(t, func() bool {
+		_, err := c.GetLongURL(short)
+		return errors.Is(err, ErrDeletedURL)
+	}, time.Second, 10*time.Millisecond)
+}
+
+// invalidatingRepo сбрасывает кэш посреди чтения, как изменение из другого запроса.
+type invalidatingRepo struct {
+	*countingRepo
+	cache *Cache
+}
+
+func (r *invalidatingRepo) GetLongURL(short URL) (URL, error) {
+	long, err := r.countingRepo.GetLongURL(short)
+	r.deleted[short] = true
+	r.cache.Invalidate(short)
+	return long, err
+}
+
+func TestCache_StaleFill(t *testing.T) {
+	repo := &invalidatingRepo{countingRepo: newCountingRepo()}
+	repo.SetLongURL("https://ya.ru/1123", "b3f51159", "user")
+	c := NewCache(repo, 10, time.Minute, time.Second)
+	repo.cache = c
+
+	// ответ, прочитанный до сброса, не кэшируется
+	_, err := c.GetLongURL("b3f51159")
+	require.NoError(t, err)
+	assert.Equal(t, 0, c.Stats().Len)
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MaxTags           = 20
+	MaxTagLength      = 64
+	MaxFolderLength   = 128
+	MaxTitleLength    = 300
+	MaxNotesLength    = 4000
+	MaxImageURLLength = 2048
+)
+
+var ErrInvalidEdit = errors.New("invalid link edit")
+
+// URLEdit - изменения ссылки пользователем; nil - поле не меняется.
+type URLEdit struct {
+	// Tags заменяет все теги ссылки, пустой список их снимает.
+	Tags *[]string
+	// Folder - папка ссылки, "" - без папки.
+	Folder *string
+	Title  *string
+	Notes  *string
+	// ImageURL - абсолютная http(s) ссылка на картинку, "" - без картинки.
+	ImageURL *string
+}
+
+// IsEmpty - в правке нечего менять.
+func (e URLEdit) IsEmpty() bool {
+	return e.Tags == nil && e.Folder == nil && e.Title == nil && e.Notes == nil && e.ImageURL == nil
+}
+
+// Normalize проверяет правку и приводит теги и папку к хранимому виду.
+func (e URLEdit) Normalize() (URLEdit, error) {
+	if e.Tags != nil {
+		tags, err := NormalizeTags(*e.Tags)
+		if err != nil {
+			return e, err
+		}
+		e.Tags = &tags
+	}
+	if e.Folder != nil {
+		folder, err := NormalizeFolder(*e.Folder)
+		if err != nil {
+			return e, err
+		}
+		e.Folder = &folder
+	}
+	if e.Title != nil {
+		title, err := NormalizeTitle(*e.Title)
+		if err != nil {
+			return e, err
+		}
+		e.Title = &title
+	}
+	if e.Notes != nil {
+		notes, err := NormalizeNotes(*e.Notes)
+		if err != nil {
+			return e, err
+		}
+		e.Notes = &notes
+	}
+	if e.ImageURL != nil {
+		imageURL, err := NormalizeImageURL(*e.ImageURL)
+		if err != nil {
+			return e, err
+		}
+		e.ImageURL = &imageURL
+	}
+	return e, nil
+}
+
+// NormalizeTitle убирает пробелы по краям заголовка и проверяет его длину.
+func NormalizeTitle(title string) (string, error) {
+	return normalizeText("title", title, MaxTitleLength)
+}
+
+func NormalizeNotes(notes string) (string, error) {
+	return normalizeText("notes", notes, MaxNotesLength)
+}
+
+// NormalizeImageURL проверяет, что ссылка на картинку абсолютная http(s) и не слишком длинная.
+func NormalizeImageURL(imageURL string) (string, error) {
+	imageURL = strings.TrimSpace(imageURL)
+	if imageURL == "" {
+		return "", nil
+	}
+	if len(imageURL) > MaxImageURLLength {
+		return "", fmt.Errorf("%w: image url is longer than %v", ErrInvalidEdit, MaxImageURLLength)
+	}
+	u, err := url.Parse(imageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%w: image url must be an absolute http(s) url", ErrInvalidEdit)
+	}
+	return imageURL, nil
+}
+
+// normalizeText убирает пробелы по краям и проверяет длину в символах.
+func normalizeText(field string, text string, maxLength int) (string, error) {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > maxLength {
+		return "", fmt.Errorf("%w: %v is longer than %v characters", ErrInvalidEdit, field, maxLength)
+	}
+	return text, nil
+}
+
+// apply применяет нормализованную правку к записи.
+func (e URLEdit) apply(rec URLRecord, now time.Time) URLRecord {
+	if e.Tags != nil {
+		rec.Tags = append([]string(nil), *e.Tags...)
+	}
+	if e.Folder != nil {
+		rec.Folder = *e.Folder
+	}
+	if e.Title != nil {
+		rec.Title = *e.Title
+	}
+	if e.Notes != nil {
+		rec.Notes = *e.Notes
+	}
+	if e.ImageURL != nil {
+		rec.ImageURL = *e.ImageURL
+	}
+	rec.UpdatedAt = now
+	return rec
+}
+
+// fillPreview заполняет пустые заголовок и картинку записи, UpdatedAt не меняется.
+// Возвращает false, если менять нечего.
+func fillPreview(rec URLRecord, title string, imageURL string) (URLRecord, bool) {
+	changed := false
+	if rec.Title == "" && title != "" {
+		rec.Title = title
+		changed = true
+	}
+	if rec.ImageURL == "" && imageURL != "" {
+		rec.ImageURL = imageURL
+		changed = true
+	}
+	return rec, changed
+}
+
+// NormalizeTags приводит теги к нижнему регистру, убирает повторы и сортирует.
+// Тег не может быть пустым, содержать пробелы или запятые (запятой теги разделены в CSV).
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		switch {
+		case tag == "":
+			return nil, fmt.Errorf("%w: empty tag", ErrInvalidEdit)
+		case len(tag) > MaxTagLength:
+			return nil, fmt.Errorf("%w: tag %q is longer than %v", ErrInvalidEdit, tag, MaxTagLength)
+		case strings.ContainsAny(tag, ",") || strings.IndexFunc(tag, unicode.IsSpace) >= 0:
+			return nil, fmt.Errorf("%w: tag %q contains spaces or commas", ErrInvalidEdit, tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	if len(result) > MaxTags {
+		return nil, fmt.Errorf("%w: more than %v tags", ErrInvalidEdit, MaxTags)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// NormalizeFolder убирает пробелы и косые черты по краям: " /campaigns/q3/ " -> "campaigns/q3".
+func NormalizeFolder(folder string) (string, error) {
+	folder = strings.Trim(strings.TrimSpace(folder), "/")
+	if len(folder) > MaxFolderLength {
+		return "", fmt.Errorf("%w: folder is longer than %v", ErrInvalidEdit, MaxFolderLength)
+	}
+	if strings.IndexFunc(folder, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("%w: folder contains control characters", ErrInvalidEdit)
+	}
+	return folder, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
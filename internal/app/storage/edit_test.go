@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Test #1 lower case, sorted, no repeats", tags: []string{" Q3", "deck", "q3"}, want: []string{"deck", "q3"}},
+		{name: "Test #2 empty list", tags: []string{}, want: []string{}},
+		{name: "Test #3 empty tag", tags: []string{"deck", " "}, wantErr: true},
+		{name: "Test #4 space inside", tags: []string{"q3 deck"}, wantErr: true},
+		{name: "Test #5 comma inside", tags: []string{"q3,deck"}, wantErr: true},
+		{name: "Test #6 too long", tags: []string{strings.Repeat("a", MaxTagLength+1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeTags(tt.tags)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidEdit)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestURLEdit_Normalize(t *testing.T) {
+	title, notes := "  Q3 deck ", "\tslides for the review\n"
+	edit, err := URLEdit{Title: &title, Notes: &notes}.Normalize()
+	require.NoError(t, err)
+	assert.Equal(t, "Q3 deck", *edit.Title)
+	assert.Equal(t, "slides for the review", *edit.Notes)
+
+	// длина считается в символах, а не в байтах
+	title = strings.Repeat("я", MaxTitleLength)
+	_, err = URLEdit{Title: &title}.Normalize()
+	assert.NoError(t, err)
+	title += "я"
+	_, err = URLEdit{Title: &title}.Normalize()
+	assert.ErrorIs(t, err, ErrInvalidEdit)
+	notes = strings.Repeat("a", MaxNotesLength+1)
+	_, err = URLEdit{Notes: &notes}.Normalize()
+	assert.ErrorIs(t, err, ErrInvalidEdit)
+
+	for image, valid := range map[string]bool{
+		" https://example.com/cover.png ": true,
+		"":                                true,
+		"/cover.png":                      false,
+		"javascript:alert(1)":             false,
+		"https://example.com/" + strings.Repeat("a", MaxImageURLLength): false,
+	} {
+		image := image
+		_, err = URLEdit{ImageURL: &image}.Normalize()
+		assert.Equal(t, valid, err == nil, image)
+	}
+}
+
+func editTags(tags ...string) *[]string {
+	return &tags
+}
+
+func editFolder(folder string) *string {
+	return &folder
+}
+
+// testEditUserURL проверяет правку, список по тегу и папке и поиск по тегу на любом хранилище.
+func testEditUserURL(t *testing.T, d Repository) {
+	ctx := context.Background()
+	short, err := d.SaveLongURL("https://docs.example.com/presentation", "u1")
+	require.NoError(t, err)
+	other, err := d.SaveLongURL("https://ya.ru", "u1")
+	require.NoError(t, err)
+
+	_, err = d.EditUserURL(ctx, "u2", short, URLEdit{Tags: editTags("q3")})
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+	_, err = d.EditUserURL(ctx, "u1", "missing", URLEdit{Tags: editTags("q3")})
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+
+	record, err := d.EditUserURL(ctx, "u1", short, URLEdit{Tags: editTags("deck", "q3"), Folder: editFolder("campaigns")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"deck", "q3"}, record.Tags)
+	assert.Equal(t, "campaigns", record.Folder)
+
+	// правка только папки не трогает теги
+	record, err = d.EditUserURL(ctx, "u1", short, URLEdit{Folder: editFolder("campaigns/q3")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"deck", "q3"}, record.Tags)
+	assert.Equal(t, "campaigns/q3", record.Folder)
+
+	page, err := d.ListUserURLs(ctx, "u1", ListOptions{Tag: "Q3"})
+	require.NoError(t, err)
+	assert.Equal(t, []URL{short}, shorts(page.Records))
+	noFolder := ""
+	page, err = d.ListUserURLs(ctx, "u1", ListOptions{Folder: &noFolder})
+	require.NoError(t, err)
+	assert.Equal(t, []URL{other}, shorts(page.Records))
+
+	results, err := d.SearchUserURLs(ctx, "u1", "deck", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, short, results[0].ShortURL)
+
+	record, err = d.EditUserURL(ctx, "u1", short, URLEdit{Tags: editTags()})
+	require.NoError(t, err)
+	assert.Empty(t, record.Tags)
+	results, err = d.SearchUserURLs(ctx, "u1", "deck", 0)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	title, notes := "Quarterly review", "shared with sales"
+	record, err = d.EditUserURL(ctx, "u1", short, URLEdit{Title: &title, Notes: &notes})
+	require.NoError(t, err)
+	assert.Equal(t, title, record.Title)
+	assert.Equal(t, notes, record.Notes)
+	assert.Equal(t, "campaigns/q3", record.Folder)
+	assert.False(t, record.UpdatedAt.Before(record.CreatedAt))
+	page, err = d.ListUserURLs(ctx, "u1", ListOptions{Contains: "docs.example.com"})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, title, page.Records[0].Title)
+	assert.Equal(t, notes, page.Records[0].Notes)
+
+	// заголовок и заметки ищутся наравне со ссылкой
+	results, err = d.SearchUserURLs(ctx, "u1", "quarterly sales", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, short, results[0].ShortURL)
+}
+
+func TestMemoryMap_EditUserURL(t *testing.T) {
+	testEditUserURL(t, NewMemoryMap())
+}
+
+func TestRedis_EditUserURL(t *testing.T) {
+	d, _ := newTestRedis(t, 0)
+	testEditUserURL(t, d)
+}
+
+func TestFileStorage_EditUserURL(t *testing.T) {
+	buffer := bytes.Buffer{}
+	d := &FileStorage{memMap: NewMemoryMap(), encoder: json.NewEncoder(&buffer)}
+	testEditUserURL(t, d)
+
+	// правки переживают перезапуск
+	loaded := &FileStorage{memMap: NewMemoryMap()}
+	require.NoError(t, loaded.LoadFromBuff(&buffer))
+	page, err := loaded.ListUserURLs(context.Background(), "u1", ListOptions{Tag: "q3"})
+	require.NoError(t, err)
+	assert.Empty(t, page.Records)
+	folder := "campaigns/q3"
+	page, err = loaded.ListUserURLs(context.Background(), "u1", ListOptions{Folder: &folder})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, "Quarterly review", page.Records[0].Title)
+	assert.Equal(t, "shared with sales", page.Records[0].Notes)
+}
+
+func TestPG_EditUserURL(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	createdAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	updatedAt := createdAt.Add(time.Hour)
+	tags := []string{"deck", "q3"}
+	title := "Q3 deck"
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT "url".short FROM "url" (.+) FOR UPDATE OF "url"`).WithArgs(URL("deck"), userID).
+		WillReturnRows(mock.NewRows([]string{"short"}).AddRow(URL("deck")))
+	mock.ExpectExec(`UPDATE "url" SET updated_at = now\(\), folder = \$2, title = \$3 WHERE short = \$1`).
+		WithArgs(URL("deck"), "q3", title).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec(`DELETE FROM link_tag WHERE short = \$1 AND tag <> all\(\$2\)`).WithArgs(URL("deck"), tags).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec(`INSERT INTO link_tag \(short, tag\) SELECT \$1, unnest\(\$2::text\[\]\)`).WithArgs(URL("deck"), tags).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT "url".long, (.+) WHERE "url".short = \$1`).WithArgs(URL("deck")).
+		WillReturnRows(mock.NewRows([]string{"long", "uuid", "is_deleted", "created_at", "tags", "folder",
+			"updated_at", "title", "notes", "image_url"}).
+			AddRow(URL("https://ya.ru"), userID, false, createdAt, tags, "q3", updatedAt, title, "", ""))
+
+	d := &PG{db: mock, recentWrites: newRecentWrites(0)}
+	got, err := d.EditUserURL(context.Background(), userID, "deck",
+		URLEdit{Tags: &tags, Folder: editFolder("q3"), Title: &title})
+	require.NoError(t, err)
+	assert.Equal(t, URLRecord{ShortURL: "deck", LongURL: "https://ya.ru", UserID: userID, CreatedAt: createdAt,
+		UpdatedAt: updatedAt, Tags: tags, Folder: "q3", Title: title}, got)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPG_EditUserURL_NotOwner(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT "url".short FROM "url" (.+) FOR UPDATE OF "url"`).WillReturnError(ErrNoRows)
+	mock.ExpectRollback()
+
+	d := &PG{db: mock}
+	_, err = d.EditUserURL(context.Background(), "u2", "deck", URLEdit{Folder: editFolder("q3")})
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMemoryMap_UpdatedAt(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	d := NewMemoryMap()
+	d.now = func() time.Time { return now }
+	short, err := d.SaveLongURL("https://ya.ru", "u1")
+	require.NoError(t, err)
+
+	tick := func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	record, _ := d.GetURLInfo(short)
+	assert.Equal(t, record.CreatedAt, record.UpdatedAt)
+
+	deletedAt := tick()
+	require.NoError(t, d.DeleteUsersURLs("u1", short))
+	record, _ = d.GetURLInfo(short)
+	assert.Equal(t, deletedAt, record.UpdatedAt)
+
+	// повторное удаление ничего не меняет
+	tick()
+	require.NoError(t, d.DeleteUsersURLs("u1", short))
+	record, _ = d.GetURLInfo(short)
+	assert.Equal(t, deletedAt, record.UpdatedAt)
+
+	restoredAt := tick()
+	_, err = d.SaveLongURL("https://ya.ru", "u1")
+	require.NoError(t, err)
+	record, _ = d.GetURLInfo(short)
+	assert.False(t, record.Deleted)
+	assert.Equal(t, restoredAt, record.UpdatedAt)
+
+	editedAt := tick()
+	record, err = d.EditUserURL(context.Background(), "u1", short, URLEdit{Folder: editFolder("q3")})
+	require.NoError(t, err)
+	assert.Equal(t, editedAt, record.UpdatedAt)
+	assert.Equal(t, time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC), record.CreatedAt)
+}
+
+// testOtherUsersURL проверяет, что ссылка, сохраненная вторым пользователем, не попадает в его список
+// вместе с заголовком, заметками и пометкой удаления владельца.
+func testOtherUsersURL(t *testing.T, d Repository) {
+	ctx := context.Background()
+	short, err := d.SaveLongURL("https://ya.ru/deck", "alice")
+	require.NoError(t, err)
+	title, notes := "Q3 deck", "password is hunter2"
+	_, err = d.EditUserURL(ctx, "alice", short, URLEdit{Title: &title, Notes: &notes, Tags: editTags("q3")})
+	require.NoError(t, err)
+	require.NoError(t, d.DeleteUsersURLs("alice", short))
+
+	_, _ = d.SaveLongURL("https://ya.ru/deck", "bob")
+	_, err = d.SaveLongBatchURL([]CorrelationLongPair{{CorrelationID: "1", LongURL: "https://ya.ru/deck"}}, "bob")
+	require.NoError(t, err)
+
+	page, err := d.ListUserURLs(ctx, "bob", ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, page.Records)
+	results, err := d.SearchUserURLs(ctx, "bob", "deck", 0)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+	assert.Empty(t, d.GetUsersURLs("bob"))
+
+	page, err = d.ListUserURLs(ctx, "alice", ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, "alice", page.Records[0].UserID)
+	assert.True(t, page.Records[0].Deleted)
+}
+
+func TestMemoryMap_OtherUsersURL(t *testing.T) {
+	testOtherUsersURL(t, NewMemoryMap())
+}
+
+func TestFileStorage_OtherUsersURL(t *testing.T) {
+	buffer := bytes.Buffer{}
+	testOtherUsersURL(t, &FileStorage{memMap: NewMemoryMap(), encoder: json.NewEncoder(&buffer)})
+
+	loaded := &FileStorage{memMap: NewMemoryMap()}
+	require.NoError(t, loaded.LoadFromBuff(&buffer))
+	page, err := loaded.ListUserURLs(context.Background(), "bob", ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, page.Records)
+}
+
+func TestRedis_OtherUsersURL(t *testing.T) {
+	d, _ := newTestRedis(t, 0)
+	testOtherUsersURL(t, d)
+}
+
+func testFillUserURLPreview(t *testing.T, d Repository) {
+	ctx := context.Background()
+	titled, err := d.SaveLongURL("https://ya.ru/1", "u1")
+	require.NoError(t, err)
+	blank, err := d.SaveLongURL("https://ya.ru/2", "u1")
+	require.NoError(t, err)
+	title := "My title"
+	_, err = d.EditUserURL(ctx, "u1", titled, URLEdit{Title: &title})
+	require.NoError(t, err)
+	before, err := d.GetURLInfo(titled)
+	require.NoError(t, err)
+
+	// заданный пользователем заголовок не перезаписывается, время изменения прежнее
+	require.NoError(t, d.FillUserURLPreview(ctx, "u1", titled, "Page title", "https://ya.ru/cover.png"))
+	got, err := d.GetURLInfo(titled)
+	require.NoError(t, err)
+	assert.Equal(t, title, got.Title)
+	assert.Equal(t, "https://ya.ru/cover.png", got.ImageURL)
+	assert.Equal(t, before.UpdatedAt, got.UpdatedAt)
+
+	require.NoError(t, d.FillUserURLPreview(ctx, "u1", blank, "Page title", ""))
+	got, err = d.GetURLInfo(blank)
+	require.NoError(t, err)
+	assert.Equal(t, "Page title", got.Title)
+	assert.Empty(t, got.ImageURL)
+
+	assert.ErrorIs(t, d.FillUserURLPreview(ctx, "u2", blank, "Other", ""), ErrNotFoundURL)
+	assert.ErrorIs(t, d.FillUserURLPreview(ctx, "u1", "ffffffff", "Other", ""), ErrNotFoundURL)
+}
+
+func TestMemoryMap_FillUserURLPreview(t *testing.T) {
+	testFillUserURLPreview(t, NewMemoryMap())
+}
+
+func TestRedis_FillUserURLPreview(t *testing.T) {
+	d, _ := newTestRedis(t, 0)
+	testFillUserURLPreview(t, d)
+}
+
+func TestFileStorage_FillUserURLPreview(t *testing.T) {
+	buffer := bytes.Buffer{}
+	d := &FileStorage{memMap: NewMemoryMap(), encoder: json.NewEncoder(&buffer)}
+	testFillUserURLPreview(t, d)
+
+	loaded := &FileStorage{memMap: NewMemoryMap()}
+	require.NoError(t, loaded.LoadFromBuff(&buffer))
+	got, err := loaded.GetURLInfo("2f82f1da")
+	require.NoError(t, err)
+	assert.Equal(t, "Page title", got.Title)
+}
+
+func TestPG_FillUserURLPreview(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	query := `UPDATE "url" SET\s+title = CASE WHEN "url".title = '' THEN \$3 ELSE "url".title END,\s+` +
+		`image_url = CASE WHEN "url".image_url = '' THEN \$4 ELSE "url".image_url END\s+` +
+		`FROM "user" WHERE "url".short = \$1 AND "user".id = "url".user_id AND "user".uuid = \$2`
+	mock.ExpectExec(query).WithArgs(URL("deck"), userID, "Q3 deck", "").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec(query).WithArgs(URL("deck"), "other", "Q3 deck", "").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+
+	d := &PG{db: mock, recentWrites: newRecentWrites(0)}
+	require.NoError(t, d.FillUserURLPreview(context.Background(), userID, "deck", "Q3 deck", ""))
+	assert.ErrorIs(t, d.FillUserURLPreview(context.Background(), "other", "deck", "Q3 deck", ""), ErrNotFoundURL)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
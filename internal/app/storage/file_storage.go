@@ -1,23 +1,56 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"os"
 	"sync"
+	"time"
 )
 
 type FileStorage struct {
 	FileAccessMutex sync.RWMutex
 	memMap          *MemoryMap
+	file            *os.File
 	encoder         *json.Encoder
 }
 
+// FileRecord - строка файла. Запись без LongURL меняет только пометку удаления
+// ранее сохраненной ссылки, запись с Replace (импорт, правка) заменяет ссылку целиком.
 type FileRecord struct {
-	ShortURL URL
-	LongURL  URL
-	UserID   string
+	ShortURL  URL
+	LongURL   URL `json:",omitempty"`
+	UserID    string
+	Deleted   bool       `json:",omitempty"`
+	CreatedAt *time.Time `json:",omitempty"`
+	UpdatedAt *time.Time `json:",omitempty"`
+	Tags      []string   `json:",omitempty"`
+	Folder    string     `json:",omitempty"`
+	Title     string     `json:",omitempty"`
+	Notes     string     `json:",omitempty"`
+	ImageURL  string     `json:",omitempty"`
+	Replace   bool       `json:",omitempty"`
+}
+
+// replaceRecord - строка файла, заменяющая ссылку целиком.
+func replaceRecord(rec URLRecord) FileRecord {
+	createdAt, updatedAt := rec.CreatedAt, rec.UpdatedAt
+	return FileRecord{
+		ShortURL:  rec.ShortURL,
+		LongURL:   rec.LongURL,
+		UserID:    rec.UserID,
+		Deleted:   rec.Deleted,
+		CreatedAt: &createdAt,
+		UpdatedAt: &updatedAt,
+		Tags:      rec.Tags,
+		Folder:    rec.Folder,
+		Title:     rec.Title,
+		Notes:     rec.Notes,
+		ImageURL:  rec.ImageURL,
+		Replace:   true,
+	}
 }
 
 func NewFileStorage(filename string) (*FileStorage, error) {
@@ -35,11 +68,19 @@ func NewFileStorage(filename string) (*FileStorage, error) {
 	if err != nil {
 		return nil, err
 	}
+	db.file = file
 	db.encoder = json.NewEncoder(file)
 
 	return db, nil
 }
 
+func (d *FileStorage) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
+
 func (d *FileStorage) LoadFromFile(filename string) error {
 	d.FileAccessMutex.RLock()
 	defer d.FileAccessMutex.RUnlock()
@@ -64,7 +105,26 @@ func (d *FileStorage) LoadFromBuff(buf io.Reader) error {
 			}
 			return err
 		}
-		d.memMap.SetLongURL(record.LongURL, record.ShortURL, record.UserID)
+		rec := URLRecord{ShortURL: record.ShortURL, LongURL: record.LongURL, UserID: record.UserID, Deleted: record.Deleted,
+			Tags: record.Tags, Folder: record.Folder, Title: record.Title, Notes: record.Notes, ImageURL: record.ImageURL}
+		if record.CreatedAt != nil {
+			rec.CreatedAt = *record.CreatedAt
+		}
+		if record.UpdatedAt != nil {
+			rec.UpdatedAt = *record.UpdatedAt
+		}
+		switch {
+		case record.Replace:
+			d.memMap.putRecord(rec)
+		case record.LongURL == "":
+			// в старых файлах у пометки удаления нет времени - оставляем прежнее
+			if rec.UpdatedAt.IsZero() {
+				rec.UpdatedAt = d.memMap.urls[record.ShortURL].UpdatedAt
+			}
+			d.memMap.setDeletedAt(record.UserID, record.Deleted, rec.UpdatedAt, record.ShortURL)
+		default:
+			d.memMap.saveRecord(rec)
+		}
 	}
 
 }
@@ -72,16 +132,37 @@ func (d *FileStorage) LoadFromBuff(buf io.Reader) error {
 func (d *FileStorage) SaveLongURL(long URL, userID string) (URL, error) {
 	d.FileAccessMutex.Lock()
 	defer d.FileAccessMutex.Unlock()
-	short, err := d.memMap.SaveLongURL(long, userID)
+	short, _, err := d.saveLocked(long, userID)
+	return short, err
+}
+
+// saveLocked сохраняет ссылку под FileAccessMutex и сообщает, чья она была раньше ("" - новая).
+func (d *FileStorage) saveLocked(long URL, userID string) (URL, Owner, error) {
+	short, err := makeShort(long)
 	if err != nil {
-		return "", err
+		return "", "", fmt.Errorf("cannot generate short url: %w", err)
 	}
 
-	if err = d.encoder.Encode(FileRecord{ShortURL: short, LongURL: long, UserID: userID}); err != nil {
-		return "", err
+	createdAt := d.memMap.now()
+	d.memMap.Mutex.Lock()
+	var existed Owner
+	if prev, found := d.memMap.urls[short]; found {
+		existed = ownerOf(prev.UserID, userID)
 	}
+	if existed == OwnerOtherUser {
+		// чужая ссылка не меняется, и в файл писать нечего
+		d.memMap.Mutex.Unlock()
+		return short, existed, nil
+	}
+	d.memMap.saveRecord(URLRecord{ShortURL: short, LongURL: long, UserID: userID, CreatedAt: createdAt})
+	d.memMap.Mutex.Unlock()
 
-	return short, nil
+	record := FileRecord{ShortURL: short, LongURL: long, UserID: userID, CreatedAt: &createdAt}
+	if err = d.encoder.Encode(record); err != nil {
+		return "", existed, err
+	}
+
+	return short, existed, nil
 }
 
 func (d *FileStorage) GetLongURL(short URL) (URL, error) {
@@ -92,30 +173,125 @@ func (d *FileStorage) GetUsersURLs(userID string) []URLPair {
 	return d.memMap.GetUsersURLs(userID)
 }
 
+func (d *FileStorage) ListUserURLs(ctx context.Context, userID string, opts ListOptions) (URLPage, error) {
+	return d.memMap.ListUserURLs(ctx, userID, opts)
+}
+
+func (d *FileStorage) SearchUserURLs(ctx context.Context, userID string, query string, limit int) ([]SearchResult, error) {
+	return d.memMap.SearchUserURLs(ctx, userID, query, limit)
+}
+
+// ConsumeDailyQuota считает квоты в памяти: в файл пишутся только ссылки,
+// поэтому после перезапуска счетчики начинаются заново.
+func (d *FileStorage) ConsumeDailyQuota(ctx context.Context, key string, day time.Time, n int, limit int) (int, error) {
+	return d.memMap.ConsumeDailyQuota(ctx, key, day, n, limit)
+}
+
 func (d *FileStorage) Ping() bool {
 	return d.memMap.Ping()
 }
 
 func (d *FileStorage) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]CorrelationShortPair, error) {
+	d.FileAccessMutex.Lock()
+	defer d.FileAccessMutex.Unlock()
+
 	result := make([]CorrelationShortPair, 0, len(longURLS))
 	for _, p := range longURLS {
-
-		short, err := d.SaveLongURL(p.LongURL, userID)
+		short, existed, err := d.saveLocked(p.LongURL, userID)
 		if err != nil {
-			log.Printf("SaveLongBatchURL error(%v):  cant shor url %v", err, p.LongURL)
+			result = append(result, batchFailure(p.CorrelationID, BatchError, err))
 			continue
 		}
-		result = append(result, CorrelationShortPair{p.CorrelationID, short})
+		item := CorrelationShortPair{CorrelationID: p.CorrelationID, ShortURL: short, Status: BatchCreated}
+		if existed != "" {
+			item.Status = BatchConflict
+			item.Owner = existed
+		}
+		result = append(result, item)
 	}
 	return result, nil
 }
 
+func (d *FileStorage) GetURLInfo(short URL) (URLRecord, error) {
+	return d.memMap.GetURLInfo(short)
+}
+
+func (d *FileStorage) setDeleted(userID string, deleted bool, shortUrls ...URL) error {
+	d.FileAccessMutex.Lock()
+	defer d.FileAccessMutex.Unlock()
+	d.memMap.Mutex.Lock()
+	defer d.memMap.Mutex.Unlock()
+
+	for _, short := range shortUrls {
+		record, found := d.memMap.urls[short]
+		if !found || record.UserID != userID || record.Deleted == deleted {
+			continue
+		}
+		updatedAt := d.memMap.now()
+		if err := d.encoder.Encode(FileRecord{ShortURL: short, UserID: userID, Deleted: deleted, UpdatedAt: &updatedAt}); err != nil {
+			return err
+		}
+		d.memMap.setDeletedAt(userID, deleted, updatedAt, short)
+	}
+	return nil
+}
+
 func (d *FileStorage) DeleteUsersURLs(userID string, shortUrls ...URL) error {
-	//TODO implement me
-	panic("implement me")
+	return d.setDeleted(userID, true, shortUrls...)
 }
 
 func (d *FileStorage) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) error {
-	//TODO implement me
-	panic("implement me")
+	return d.DeleteUsersURLs(userID, shortUrls...)
+}
+
+func (d *FileStorage) RestoreUsersURLs(userID string, shortUrls ...URL) error {
+	return d.setDeleted(userID, false, shortUrls...)
+}
+
+func (d *FileStorage) ExportURLs(ctx context.Context, fn func(URLRecord) error) error {
+	return d.memMap.ExportURLs(ctx, fn)
+}
+
+func (d *FileStorage) ImportURLs(ctx context.Context, records []URLRecord, policy ConflictPolicy) (ImportResult, error) {
+	d.FileAccessMutex.Lock()
+	defer d.FileAccessMutex.Unlock()
+	d.memMap.Mutex.Lock()
+	defer d.memMap.Mutex.Unlock()
+
+	result, applied, err := d.memMap.importRecords(records, policy)
+	if err != nil {
+		return result, err
+	}
+	for _, rec := range applied {
+		if err = d.encoder.Encode(replaceRecord(rec)); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (d *FileStorage) EditUserURL(ctx context.Context, userID string, short URL, edit URLEdit) (URLRecord, error) {
+	d.FileAccessMutex.Lock()
+	defer d.FileAccessMutex.Unlock()
+	d.memMap.Mutex.Lock()
+	defer d.memMap.Mutex.Unlock()
+
+	record, err := d.memMap.editRecord(userID, short, edit)
+	if err != nil {
+		return URLRecord{}, err
+	}
+	return record, d.encoder.Encode(replaceRecord(record))
+}
+
+func (d *FileStorage) FillUserURLPreview(ctx context.Context, userID string, short URL, title string, imageURL string) error {
+	d.FileAccessMutex.Lock()
+	defer d.FileAccessMutex.Unlock()
+	d.memMap.Mutex.Lock()
+	defer d.memMap.Mutex.Unlock()
+
+	record, err := d.memMap.fillRecord(userID, short, title, imageURL)
+	if err != nil || record.ShortURL == "" {
+		return err
+	}
+	return d.encoder.Encode(replaceRecord(record))
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestFileStorage_LoadFromBuff(t *testing.T) {
@@ -15,10 +16,11 @@ func TestFileStorage_LoadFromBuff(t *testing.T) {
 	}
 
 	tests := []struct {
-		name    string
-		fields  fields
-		wantErr error
-		wantMap map[URL]URL
+		name        string
+		fields      fields
+		wantErr     error
+		wantMap     map[URL]URL
+		wantDeleted []URL
 	}{
 		{
 			name: "Test case #1",
@@ -34,7 +36,21 @@ func TestFileStorage_LoadFromBuff(t *testing.T) {
 				"7d7cbdab": "https://ya.ru",
 			},
 		},
-		// TODO: Add test cases.
+		{
+			name: "Test case #2 delete and restore records",
+			fields: fields{
+				memMap: NewMemoryMap(),
+				fileContent: `{"ShortURL":"7d7cbdab","LongURL":"https://ya.ru","UserID":"u1"}
+{"ShortURL":"2f82f1da","LongURL":"https://ya.ru/2","UserID":"u1"}
+{"ShortURL":"7d7cbdab","UserID":"u1","Deleted":true}
+{"ShortURL":"2f82f1da","UserID":"u1","Deleted":true}
+{"ShortURL":"2f82f1da","UserID":"other","Deleted":false}
+{"ShortURL":"7d7cbdab","UserID":"u1"}
+`,
+			},
+			wantMap:     map[URL]URL{"7d7cbdab": "https://ya.ru"},
+			wantDeleted: []URL{"2f82f1da"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -51,6 +67,10 @@ func TestFileStorage_LoadFromBuff(t *testing.T) {
 				assert.NoError(t, err)
 				assert.Equal(t, wantLong, memLong)
 			}
+			for _, short := range tt.wantDeleted {
+				_, err := d.memMap.GetLongURL(short)
+				assert.ErrorIs(t, err, ErrDeletedURL)
+			}
 
 		})
 	}
@@ -81,7 +101,7 @@ func TestFileStorage_SaveLongURL(t *testing.T) {
 			want:    "c101c693",
 			args:    args{long: "https://stackoverflow.com/questions/24886015/how-to-convert-uint32-to-string", userID: "some_id"},
 			wantErr: nil,
-			wantFileContent: `{"ShortURL":"c101c693","LongURL":"https://stackoverflow.com/questions/24886015/how-to-convert-uint32-to-string","UserID":"some_id"}
+			wantFileContent: `{"ShortURL":"c101c693","LongURL":"https://stackoverflow.com/questions/24886015/how-to-convert-uint32-to-string","UserID":"some_id","CreatedAt":"2022-05-01T12:00:00Z"}
 `,
 		},
 	}
@@ -90,6 +110,7 @@ func TestFileStorage_SaveLongURL(t *testing.T) {
 			buffer := bytes.Buffer{}
 			buffer.WriteString(tt.context.fileContent)
 
+			tt.context.memMap.now = func() time.Time { return time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC) }
 			d := &FileStorage{
 				memMap:  tt.context.memMap,
 				encoder: json.NewEncoder(&buffer),
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-url-shortener/internal/app/idempotency"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultIdempotencyStoreTimeout - сколько ждать postgres, прежде чем выполнить запрос без ключа.
+	DefaultIdempotencyStoreTimeout = time.Second
+	// idempotencyCleanupInterval - как часто удалять истекшие ключи.
+	idempotencyCleanupInterval = time.Minute
+)
+
+// PGIdempotencyStore - idempotency.Store в postgres: повтор запроса на другой инстанс
+// или после перезапуска получает тот же ответ.
+type PGIdempotencyStore struct {
+	db      PgxIface
+	timeout time.Duration
+	// lastCleanup - unix-время последней очистки, меняется через atomic.
+	lastCleanup int64
+}
+
+// NewPGIdempotencyStore подключается к postgres и готовит схему, как NewPG.
+func NewPGIdempotencyStore(dsn string, opts PGOptions) (*PGIdempotencyStore, error) {
+	ctx := context.Background()
+	conn, err := connectPool(ctx, dsn, opts.MaxConns)
+	if err != nil {
+		return nil, err
+	}
+	if err = migrateSchema(ctx, conn, opts.MigrateMode); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &PGIdempotencyStore{db: conn, timeout: DefaultIdempotencyStoreTimeout}, nil
+}
+
+func (s *PGIdempotencyStore) Begin(ctx context.Context, key string, fingerprint string, now time.Time, lock time.Duration) (idempotency.Record, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// истекший ключ занимается заново, живой не меняется и не возвращается
+	var begun bool
+	err := s.db.QueryRow(ctx, `INSERT INTO idempotency_key (key, fingerprint, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status = NULL,
+			content_type = NULL, body = NULL, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_key.expires_at <= $4
+		RETURNING true`, key, fingerprint, now.Add(lock), now).Scan(&begun)
+	if err == nil {
+		s.cleanup(now)
+		return idempotency.Record{}, true, nil
+	}
+	if !errors.Is(err, ErrNoRows) {
+		return idempotency.Record{}, false, fmt.Errorf("cannot begin request: %w", err)
+	}
+
+	var rec idempotency.Record
+	var status *int
+	var contentType *string
+	var body []byte
+	err = s.db.QueryRow(ctx, `SELECT fingerprint, status, content_type, body FROM idempotency_key WHERE key = $1`, key).
+		Scan(&rec.Fingerprint, &status, &contentType, &body)
+	if err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("cannot get request: %w", err)
+	}
+	if status != nil {
+		rec.Response = &idempotency.Response{Status: *status, Body: body}
+		if contentType != nil {
+			rec.Response.ContentType = *contentType
+		}
+	}
+	return rec, false, nil
+}
+
+func (s *PGIdempotencyStore) Finish(ctx context.Context, key string, fingerprint string, resp idempotency.Response, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, `UPDATE idempotency_key SET status = $3, content_type = $4, body = $5, expires_at = $6
+		WHERE key = $1 AND fingerprint = $2 AND status IS NULL`,
+		key, fingerprint, resp.Status, resp.ContentType, resp.Body, expiresAt)
+	if err != nil {
+		return fmt.Errorf("cannot save response: %w", err)
+	}
+	return nil
+}
+
+func (s *PGIdempotencyStore) Abort(ctx context.Context, key string, fingerprint string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	_, err := s.db.Exec(ctx, `DELETE FROM idempotency_key WHERE key = $1 AND fingerprint = $2 AND status IS NULL`,
+		key, fingerprint)
+	if err != nil {
+		return fmt.Errorf("cannot release request: %w", err)
+	}
+	return nil
+}
+
+// cleanup раз в idempotencyCleanupInterval удаляет истекшие ключи, как PGRateStore.cleanup.
+func (s *PGIdempotencyStore) cleanup(now time.Time) {
+	last := atomic.LoadInt64(&s.lastCleanup)
+	if now.Sub(time.Unix(last, 0)) < idempotencyCleanupInterval ||
+		!atomic.CompareAndSwapInt64(&s.lastCleanup, last, now.Unix()) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), idempotencyCleanupInterval)
+		defer cancel()
+		if _, err := s.db.Exec(ctx, `DELETE FROM idempotency_key WHERE expires_at < $1`, now); err != nil {
+			log.Println("cannot delete expired idempotency keys", err)
+		}
+	}()
+}
+
+func (s *PGIdempotencyStore) Close() {
+	s.db.Close()
+}
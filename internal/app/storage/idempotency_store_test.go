@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-url-shortener/internal/app/idempotency"
+	"testing"
+	"time"
+)
+
+func TestPGIdempotencyStore(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	ctx := context.Background()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	begin := `INSERT INTO idempotency_key (.+) ON CONFLICT \(key\) DO UPDATE (.+) WHERE idempotency_key.expires_at <= \$4\s+RETURNING true`
+	get := `SELECT fingerprint, status, content_type, body FROM idempotency_key WHERE key = \$1`
+	finish := `UPDATE idempotency_key SET status = \$3, content_type = \$4, body = \$5, expires_at = \$6\s+` +
+		`WHERE key = \$1 AND fingerprint = \$2 AND status IS NULL`
+
+	mock.ExpectQuery(begin).WithArgs("user:u1:k1", "fp1", now.Add(time.Minute), now).
+		WillReturnRows(mock.NewRows([]string{"bool"}).AddRow(true))
+	mock.ExpectExec(finish).
+		WithArgs("user:u1:k1", "fp1", 201, "text/plain", []byte("http://localhost:8080/2e82f047"), now.Add(time.Hour)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	// ключ занят готовым ответом
+	mock.ExpectQuery(begin).WillReturnError(ErrNoRows)
+	status, contentType := 201, "text/plain"
+	mock.ExpectQuery(get).WithArgs("user:u1:k1").
+		WillReturnRows(mock.NewRows([]string{"fingerprint", "status", "content_type", "body"}).
+			AddRow("fp1", &status, &contentType, []byte("http://localhost:8080/2e82f047")))
+	// ключ занят запросом, который еще выполняется
+	mock.ExpectQuery(begin).WillReturnError(ErrNoRows)
+	mock.ExpectQuery(get).WithArgs("user:u1:k2").
+		WillReturnRows(mock.NewRows([]string{"fingerprint", "status", "content_type", "body"}).
+			AddRow("fp2", (*int)(nil), (*string)(nil), []byte(nil)))
+	mock.ExpectExec(`DELETE FROM idempotency_key WHERE key = \$1 AND fingerprint = \$2 AND status IS NULL`).
+		WithArgs("user:u1:k2", "fp2").
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	// очистка уже была, в тесте не запускается
+	s := &PGIdempotencyStore{db: mock, timeout: time.Second, lastCleanup: now.Unix()}
+	_, ok, err := s.Begin(ctx, "user:u1:k1", "fp1", now, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	resp := idempotency.Response{Status: 201, ContentType: "text/plain", Body: []byte("http://localhost:8080/2e82f047")}
+	require.NoError(t, s.Finish(ctx, "user:u1:k1", "fp1", resp, now.Add(time.Hour)))
+
+	rec, ok, err := s.Begin(ctx, "user:u1:k1", "fp1", now, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, idempotency.Record{Fingerprint: "fp1", Response: &resp}, rec)
+
+	rec, ok, err = s.Begin(ctx, "user:u1:k2", "fp1", now, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, idempotency.Record{Fingerprint: "fp2"}, rec)
+	require.NoError(t, s.Abort(ctx, "user:u1:k2", "fp2"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
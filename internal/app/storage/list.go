@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SortField - поле сортировки списка ссылок пользователя.
+type SortField string
+
+const (
+	SortByCreated SortField = "created"
+	SortByShort   SortField = "short"
+)
+
+// MaxListLimit - наибольший размер страницы списка.
+const MaxListLimit = 1000
+
+var ErrBadCursor = errors.New("bad cursor")
+
+// ListOptions - страница, сортировка и фильтры списка ссылок пользователя.
+type ListOptions struct {
+	// Sort - SortByCreated (по умолчанию) или SortByShort; при равенстве времени создания
+	// порядок определяет короткий код.
+	Sort SortField
+	Desc bool
+	// Limit - размер страницы, 0 - все ссылки.
+	Limit int
+	// Cursor - NextCursor предыдущей страницы с теми же Sort и Desc.
+	Cursor string
+	// Domain - хост ссылки или его поддомены, без учета регистра.
+	Domain string
+	// Contains - подстрока ссылки, без учета регистра.
+	Contains string
+	// Deleted - только удаленные (true) или только действующие (false); nil - все.
+	Deleted *bool
+	// Tag - только ссылки с этим тегом.
+	Tag string
+	// Folder - только ссылки этой папки ("" - без папки); nil - все.
+	Folder *string
+}
+
+// URLPage - страница списка. NextCursor пустой на последней странице.
+type URLPage struct {
+	Records    []URLRecord
+	NextCursor string
+}
+
+// listCursor - ключ сортировки последней записи страницы. Записи следующей страницы
+// идут строго после него, поэтому вставки и удаления не сдвигают страницы.
+type listCursor struct {
+	Sort      SortField `json:"s"`
+	Desc      bool      `json:"d,omitempty"`
+	CreatedAt int64     `json:"t,omitempty"`
+	Short     URL       `json:"k"`
+}
+
+func (o ListOptions) sortField() SortField {
+	if o.Sort == "" {
+		return SortByCreated
+	}
+	return o.Sort
+}
+
+func (o ListOptions) encodeCursor(rec URLRecord) string {
+	c := listCursor{Sort: o.sortField(), Desc: o.Desc, Short: rec.ShortURL}
+	if c.Sort == SortByCreated {
+		c.CreatedAt = rec.CreatedAt.UnixNano()
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor возвращает nil для первой страницы.
+func (o ListOptions) decodeCursor() (*listCursor, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var c listCursor
+	if err = json.Unmarshal(data, &c); err != nil || c.Short == "" {
+		return nil, ErrBadCursor
+	}
+	if c.Sort != o.sortField() || c.Desc != o.Desc {
+		// курсор другой сортировки указывает неизвестно куда
+		return nil, ErrBadCursor
+	}
+	return &c, nil
+}
+
+// Validate проверяет сортировку, размер страницы и курсор.
+func (o ListOptions) Validate() error {
+	switch o.sortField() {
+	case SortByCreated, SortByShort:
+	default:
+		return errors.New("unknown sort field " + string(o.Sort))
+	}
+	if o.Limit < 0 || o.Limit > MaxListLimit {
+		return errors.New("limit out of range")
+	}
+	_, err := o.decodeCursor()
+	return err
+}
+
+// DestinationHost возвращает хост ссылки в нижнем регистре, без порта.
+func DestinationHost(long URL) string {
+	u, err := url.Parse(long.S())
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func (o ListOptions) matches(rec URLRecord) bool {
+	if o.Deleted != nil && rec.Deleted != *o.Deleted {
+		return false
+	}
+	if o.Domain != "" {
+		host, domain := DestinationHost(rec.LongURL), strings.ToLower(o.Domain)
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	if o.Contains != "" && !strings.Contains(strings.ToLower(rec.LongURL.S()), strings.ToLower(o.Contains)) {
+		return false
+	}
+	if o.Tag != "" && !hasTag(rec.Tags, strings.ToLower(o.Tag)) {
+		return false
+	}
+	if o.Folder != nil && rec.Folder != *o.Folder {
+		return false
+	}
+	return true
+}
+
+// compare сравнивает записи в порядке сортировки по возрастанию.
+func (o ListOptions) compare(a URLRecord, aCreated time.Time, b URLRecord, bCreated time.Time) int {
+	if o.sortField() == SortByCreated && !aCreated.Equal(bCreated) {
+		if aCreated.Before(bCreated) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.ShortURL.S(), b.ShortURL.S())
+}
+
+func (o ListOptions) less(a, b URLRecord) bool {
+	c := o.compare(a, a.CreatedAt, b, b.CreatedAt)
+	if o.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// afterCursor - идет ли запись строго после курсора в порядке сортировки.
+func (o ListOptions) afterCursor(rec URLRecord, c *listCursor) bool {
+	cursorRec := URLRecord{ShortURL: c.Short}
+	cmp := o.compare(rec, rec.CreatedAt, cursorRec, time.Unix(0, c.CreatedAt))
+	if o.Desc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+// listRecords применяет ListOptions к уже загруженным записям:
+// для хранилищ, которые не умеют фильтровать и сортировать сами.
+func listRecords(records []URLRecord, opts ListOptions) (URLPage, error) {
+	cursor, err := opts.decodeCursor()
+	if err != nil {
+		return URLPage{}, err
+	}
+	filtered := records[:0]
+	for _, rec := range records {
+		if opts.matches(rec) && (cursor == nil || opts.afterCursor(rec, cursor)) {
+			filtered = append(filtered, rec)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return opts.less(filtered[i], filtered[j]) })
+	return opts.page(filtered), nil
+}
+
+// page обрезает отсортированные записи до Limit и выставляет курсор следующей страницы.
+func (o ListOptions) page(sorted []URLRecord) URLPage {
+	if o.Limit <= 0 || len(sorted) <= o.Limit {
+		return URLPage{Records: sorted}
+	}
+	sorted = sorted[:o.Limit]
+	return URLPage{Records: sorted, NextCursor: o.encodeCursor(sorted[len(sorted)-1])}
+}
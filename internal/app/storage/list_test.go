@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func listTestRecords(userID string) []URLRecord {
+	base := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	return []URLRecord{
+		{ShortURL: "d", LongURL: "https://ya.ru/a", UserID: userID, CreatedAt: base},
+		{ShortURL: "b", LongURL: "https://mail.ya.ru/b", UserID: userID, CreatedAt: base, Deleted: true},
+		{ShortURL: "a", LongURL: "https://go.dev/doc", UserID: userID, CreatedAt: base.Add(time.Hour)},
+		{ShortURL: "c", LongURL: "https://notya.ru/Doc", UserID: userID, CreatedAt: base.Add(-time.Hour)},
+	}
+}
+
+func shorts(records []URLRecord) []URL {
+	result := make([]URL, 0, len(records))
+	for _, rec := range records {
+		result = append(result, rec.ShortURL)
+	}
+	return result
+}
+
+// listAll проходит все страницы, проверяя, что каждая не длиннее limit.
+func listAll(t *testing.T, repo Repository, userID string, opts ListOptions) []URL {
+	var result []URL
+	for i := 0; ; i++ {
+		require.Less(t, i, 100, "pagination must end")
+		page, err := repo.ListUserURLs(context.Background(), userID, opts)
+		require.NoError(t, err)
+		if opts.Limit > 0 {
+			require.LessOrEqual(t, len(page.Records), opts.Limit)
+		}
+		result = append(result, shorts(page.Records)...)
+		if page.NextCursor == "" {
+			return result
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// testListUserURLs проверяет сортировки, страницы и фильтры на хранилище от newRepo.
+func testListUserURLs(t *testing.T, newRepo func(t *testing.T) Repository) {
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	notDeleted := false
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []URL
+	}{
+		{name: "Test #1 by creation time, ties by code", opts: ListOptions{}, want: []URL{"c", "b", "d", "a"}},
+		{name: "Test #2 by creation time desc", opts: ListOptions{Desc: true}, want: []URL{"a", "d", "b", "c"}},
+		{name: "Test #3 by code", opts: ListOptions{Sort: SortByShort}, want: []URL{"a", "b", "c", "d"}},
+		{name: "Test #4 pages of one", opts: ListOptions{Limit: 1}, want: []URL{"c", "b", "d", "a"}},
+		{name: "Test #5 pages of three desc by code", opts: ListOptions{Sort: SortByShort, Desc: true, Limit: 3},
+			want: []URL{"d", "c", "b", "a"}},
+		{name: "Test #6 domain with subdomains", opts: ListOptions{Domain: "YA.RU"}, want: []URL{"b", "d"}},
+		{name: "Test #7 substring ignores case", opts: ListOptions{Contains: "doc"}, want: []URL{"c", "a"}},
+		{name: "Test #8 not deleted", opts: ListOptions{Deleted: &notDeleted, Limit: 2}, want: []URL{"c", "d", "a"}},
+		{name: "Test #9 pages of two desc", opts: ListOptions{Desc: true, Limit: 2}, want: []URL{"a", "d", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newRepo(t)
+			_, err := d.(Transferable).ImportURLs(context.Background(), listTestRecords(userID), ConflictFail)
+			require.NoError(t, err)
+			_, err = d.SaveLongURL("https://ya.ru/other", "other-user")
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.want, listAll(t, d, userID, tt.opts))
+		})
+	}
+}
+
+func TestMemoryMap_ListUserURLs(t *testing.T) {
+	testListUserURLs(t, func(t *testing.T) Repository { return NewMemoryMap() })
+
+	// новая ссылка попадает в уже построенный порядок
+	d := NewMemoryMap()
+	_, err := d.ImportURLs(context.Background(), listTestRecords("u"), ConflictFail)
+	require.NoError(t, err)
+	assert.Equal(t, []URL{"c", "b", "d", "a"}, listAll(t, d, "u", ListOptions{}))
+	d.SetLongURL("https://ya.ru/e", "e", "u")
+	assert.Equal(t, []URL{"c", "b", "d", "a", "e"}, listAll(t, d, "u", ListOptions{}))
+	assert.Equal(t, []URL{"a", "b", "c", "d", "e"}, listAll(t, d, "u", ListOptions{Sort: SortByShort, Limit: 2}))
+}
+
+func TestRedis_ListUserURLs(t *testing.T) {
+	testListUserURLs(t, func(t *testing.T) Repository {
+		d, _ := newTestRedis(t, 0)
+		return d
+	})
+}
+
+func TestRedis_ListUserURLsIndex(t *testing.T) {
+	d, mr := newTestRedis(t, 0)
+	var want []URL
+	var records []URLRecord
+	base := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 2*redisUserBatch+10; i++ {
+		short := URL(fmt.Sprintf("code%04d", i))
+		records = append(records, URLRecord{ShortURL: short, LongURL: URL("https://ya.ru/" + short),
+			UserID: "u", CreatedAt: base.Add(time.Duration(i/3) * time.Second)})
+		want = append(want, short)
+	}
+	// скрипты в miniredis медленные: одним пайплайном импорт не укладывается в таймаут
+	for start := 0; start < len(records); start += 100 {
+		end := start + 100
+		if end > len(records) {
+			end = len(records)
+		}
+		_, err := d.ImportURLs(context.Background(), records[start:end], ConflictFail)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, want, listAll(t, d, "u", ListOptions{Limit: 333}))
+
+	// индексы ссылок, сохраненных до их появления, строятся при первом чтении списка
+	mr.Del("test:user_created:u")
+	mr.Del("test:user_short:u")
+	assert.Equal(t, want, listAll(t, d, "u", ListOptions{Sort: SortByShort, Limit: MaxListLimit}))
+	members, err := mr.ZMembers("test:user_created:u")
+	require.NoError(t, err)
+	assert.Len(t, members, len(want))
+}
+
+func TestListOptions_Cursor(t *testing.T) {
+	d := NewMemoryMap()
+	_, err := d.ImportURLs(context.Background(), listTestRecords("u"), ConflictFail)
+	require.NoError(t, err)
+	page, err := d.ListUserURLs(context.Background(), "u", ListOptions{Limit: 2})
+	require.NoError(t, err)
+	require.NotEmpty(t, page.NextCursor)
+
+	// курсор другой сортировки и мусор отвергаются
+	_, err = d.ListUserURLs(context.Background(), "u", ListOptions{Limit: 2, Desc: true, Cursor: page.NextCursor})
+	assert.ErrorIs(t, err, ErrBadCursor)
+	_, err = d.ListUserURLs(context.Background(), "u", ListOptions{Cursor: "garbage"})
+	assert.ErrorIs(t, err, ErrBadCursor)
+
+	// удаление уже показанной ссылки не сдвигает следующую страницу
+	d.Mutex.Lock()
+	delete(d.UserShorts["u"], "c")
+	d.Mutex.Unlock()
+	page, err = d.ListUserURLs(context.Background(), "u", ListOptions{Limit: 2, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	assert.Equal(t, []URL{"d", "a"}, shorts(page.Records))
+}
+
+func TestSharded_ListUserURLs(t *testing.T) {
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	shards := map[string]Repository{"s1": NewMemoryMap(), "s2": NewMemoryMap(), "s3": NewMemoryMap()}
+	d := NewSharded(shards)
+
+	var records []URLRecord
+	var want []URL
+	base := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		short := URL(fmt.Sprintf("code%02d", i))
+		records = append(records, URLRecord{ShortURL: short, LongURL: URL("https://ya.ru/" + short),
+			UserID: userID, CreatedAt: base.Add(time.Duration(i) * time.Minute)})
+		want = append(want, short)
+	}
+	_, err := d.ImportURLs(context.Background(), records, ConflictFail)
+	require.NoError(t, err)
+
+	for _, limit := range []int{1, 3, 7, 20} {
+		assert.Equal(t, want, listAll(t, d, userID, ListOptions{Limit: limit}), "limit %v", limit)
+	}
+}
+
+func TestPG_ListUserURLs(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	created := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	deleted := true
+	opts := ListOptions{Limit: 1, Domain: "Ya.ru", Contains: "doc", Deleted: &deleted, Desc: true}
+	opts.Cursor = opts.encodeCursor(URLRecord{ShortURL: "z", CreatedAt: created})
+
+	mock.ExpectQuery(`WHERE "user".uuid = \$1 AND COALESCE\("url".is_deleted, false\) = \$2 `+
+		`AND \(lower\(substring(.+)\) = \$3 OR (.+)\) AND strpos\(lower\("url".long\), lower\(\$4\)\) > 0 `+
+		`AND \("url".created_at, "url".short\) < \(\$5, \$6\)\s+`+
+		`ORDER BY "url".created_at DESC, "url".short DESC LIMIT 2`).
+		WithArgs(userID, true, "ya.ru", "doc", created.Local(), URL("z")).
+		WillReturnRows(mock.NewRows([]string{"short", "long", "is_deleted", "created_at", "tags", "folder",
+			"updated_at", "title", "notes", "image_url"}).
+			AddRow(URL("y"), URL("https://ya.ru/doc"), true, created, []string{}, "", created, "", "", "").
+			AddRow(URL("x"), URL("https://ya.ru/docs"), true, created, []string{}, "", created, "", "", ""))
+
+	d := &PG{db: mock}
+	page, err := d.ListUserURLs(context.Background(), userID, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []URL{"y"}, shorts(page.Records))
+	assert.Equal(t, opts.encodeCursor(page.Records[0]), page.NextCursor)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,25 +1,64 @@
 package storage
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
 type MemoryMap struct {
 	Mutex      sync.RWMutex
-	urls       map[URL]URL
+	urls       map[URL]URLRecord
 	UserShorts map[string]map[URL]struct{}
+	index      *searchIndex
+	now        func() time.Time
+	quotaMu    sync.Mutex
+	// quotas - счетчики дневных квот, хранятся только за последние сутки.
+	quotas     map[string]int
+	quotaToday string
+	// sorted - ссылки пользователя по возрастанию для каждой сортировки, строится при первом
+	// чтении списка и сбрасывается, когда меняется состав ссылок. Защищен sortedMu под Mutex.RLock.
+	sorted   map[string]map[SortField][]URL
+	sortedMu sync.Mutex
 }
 
 func (d *MemoryMap) Ping() bool {
 	return true
 }
 
+func (d *MemoryMap) ConsumeDailyQuota(ctx context.Context, key string, day time.Time, n int, limit int) (int, error) {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+
+	if today := quotaDay(day); today != d.quotaToday {
+		if today < d.quotaToday {
+			// запрос пришел с прошлыми сутками, когда счетчики уже сброшены
+			return 0, nil
+		}
+		d.quotas = make(map[string]int)
+		d.quotaToday = today
+	}
+	used := d.quotas[key] + n
+	if n > 0 && used > limit {
+		return d.quotas[key], quotaExceeded(key, n, limit)
+	}
+	if used < 0 {
+		used = 0
+	}
+	d.quotas[key] = used
+	return used, nil
+}
+
 func NewMemoryMap() *MemoryMap {
 	db := &MemoryMap{
-		urls:       make(map[URL]URL),
+		urls:       make(map[URL]URLRecord),
 		UserShorts: make(map[string]map[URL]struct{}),
+		index:      newSearchIndex(),
+		sorted:     make(map[string]map[SortField][]URL),
+		now:        time.Now,
+		quotas:     make(map[string]int),
 	}
 	return db
 }
@@ -36,58 +75,354 @@ func (d *MemoryMap) SaveLongURL(long URL, userID string) (URL, error) {
 	return shortURL, nil
 }
 
+// SetLongURL сохраняет ссылку. Владельцем остается пользователь, создавший ее первым;
+// повторное сохранение владельцем снимает пометку удаления.
 func (d *MemoryMap) SetLongURL(long URL, short URL, userID string) {
-	d.urls[short] = long
+	d.saveRecord(URLRecord{ShortURL: short, LongURL: long, UserID: userID, CreatedAt: d.now()})
+}
+
+// saveRecord - SetLongURL с заданным временем создания новой ссылки.
+// Восстановление удаленной ссылки меняет UpdatedAt на то же время.
+func (d *MemoryMap) saveRecord(rec URLRecord) {
+	record, exists := d.urls[rec.ShortURL]
+	if !exists {
+		record = rec
+		record.Deleted = false
+		if record.UpdatedAt.IsZero() {
+			record.UpdatedAt = record.CreatedAt
+		}
+	} else if record.UserID == rec.UserID {
+		record.LongURL = rec.LongURL
+		if record.Deleted {
+			record.Deleted = false
+			record.UpdatedAt = rec.CreatedAt
+		}
+	}
+	d.urls[rec.ShortURL] = record
+	d.index.put(record)
+	// чужая ссылка в список пользователя не попадает
+	if record.UserID == rec.UserID {
+		d.addUserShort(rec.UserID, rec.ShortURL)
+	}
+}
+
+func (d *MemoryMap) addUserShort(userID string, short URL) {
 	userShorts, exists := d.UserShorts[userID]
 	if !exists {
 		userShorts = make(map[URL]struct{})
 		d.UserShorts[userID] = userShorts
 	}
 	userShorts[short] = struct{}{}
+	delete(d.sorted, userID)
+}
+
+// putRecord сохраняет запись целиком, заменяя существующую вместе с владельцем.
+func (d *MemoryMap) putRecord(rec URLRecord) {
+	if old, exists := d.urls[rec.ShortURL]; exists && old.UserID != rec.UserID {
+		delete(d.UserShorts[old.UserID], rec.ShortURL)
+		delete(d.sorted, old.UserID)
+	}
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = d.now()
+	}
+	if rec.UpdatedAt.IsZero() {
+		rec.UpdatedAt = rec.CreatedAt
+	}
+	d.urls[rec.ShortURL] = rec
+	d.index.put(rec)
+	d.addUserShort(rec.UserID, rec.ShortURL)
 }
 
 func (d *MemoryMap) GetLongURL(short URL) (URL, error) {
 	d.Mutex.RLock()
 	defer d.Mutex.RUnlock()
 
-	longURL := d.urls[short]
-	if longURL == "" {
-		return longURL, fmt.Errorf("short url not registered")
+	record, found := d.urls[short]
+	if !found || record.LongURL == "" {
+		return "", ErrNotFoundURL
+	}
+	if record.Deleted {
+		return "", ErrDeletedURL
 	}
 
-	return longURL, nil
+	return record.LongURL, nil
+}
+
+func (d *MemoryMap) GetURLInfo(short URL) (URLRecord, error) {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	record, found := d.urls[short]
+	if !found {
+		return URLRecord{}, ErrNotFoundURL
+	}
+	return record, nil
 }
 
 func (d *MemoryMap) GetUsersURLs(userID string) (result []URLPair) {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
 	for short := range d.UserShorts[userID] {
+		if d.urls[short].UserID != userID {
+			continue
+		}
 		result = append(result, URLPair{
 			ShortURL: short,
-			LongURL:  d.urls[short],
+			LongURL:  d.urls[short].LongURL,
 		})
 	}
 	return
 }
 
 func (d *MemoryMap) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]CorrelationShortPair, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
 	result := make([]CorrelationShortPair, 0, len(longURLS))
 	for _, p := range longURLS {
-
-		short, err := d.SaveLongURL(p.LongURL, userID)
+		short, err := makeShort(p.LongURL)
 		if err != nil {
-			log.Printf("SaveLongBatchURL error(%v):  cant shor url %v", err, p.LongURL)
+			result = append(result, batchFailure(p.CorrelationID, BatchError, err))
 			continue
 		}
-		result = append(result, CorrelationShortPair{p.CorrelationID, short})
+		item := CorrelationShortPair{CorrelationID: p.CorrelationID, ShortURL: short, Status: BatchCreated}
+		if record, exists := d.urls[short]; exists {
+			item.Status = BatchConflict
+			item.Owner = ownerOf(record.UserID, userID)
+		}
+		// чужую ссылку не трогаем, как ON CONFLICT ... WHERE в PG
+		if item.Owner != OwnerOtherUser {
+			d.SetLongURL(p.LongURL, short, userID)
+		}
+		result = append(result, item)
 	}
 	return result, nil
 }
 
+// SetDeleted помечает ссылки удаленными или восстанавливает их,
+// только если они принадлежат пользователю.
+func (d *MemoryMap) SetDeleted(userID string, deleted bool, shortUrls ...URL) {
+	d.setDeletedAt(userID, deleted, d.now(), shortUrls...)
+}
+
+// setDeletedAt - SetDeleted с заданным временем изменения.
+func (d *MemoryMap) setDeletedAt(userID string, deleted bool, at time.Time, shortUrls ...URL) {
+	for _, short := range shortUrls {
+		record, found := d.urls[short]
+		if !found || record.UserID != userID || record.Deleted == deleted {
+			continue
+		}
+		record.Deleted = deleted
+		record.UpdatedAt = at
+		d.urls[short] = record
+	}
+}
+
 func (d *MemoryMap) DeleteUsersURLs(userID string, shortUrls ...URL) error {
-	//TODO implement me
-	panic("implement me")
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	d.SetDeleted(userID, true, shortUrls...)
+	return nil
 }
 
 func (d *MemoryMap) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) error {
-	//TODO implement me
-	panic("implement me")
+	// в памяти удаление дешевое, откладывать нечего
+	return d.DeleteUsersURLs(userID, shortUrls...)
+}
+
+func (d *MemoryMap) RestoreUsersURLs(userID string, shortUrls ...URL) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	d.SetDeleted(userID, false, shortUrls...)
+	return nil
+}
+
+func (d *MemoryMap) ExportURLs(ctx context.Context, fn func(URLRecord) error) error {
+	// копируем, чтобы не держать блокировку, пока fn пишет выгрузку
+	d.Mutex.RLock()
+	records := make([]URLRecord, 0, len(d.urls))
+	for _, record := range d.urls {
+		records = append(records, record)
+	}
+	d.Mutex.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].ShortURL < records[j].ShortURL })
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *MemoryMap) ImportURLs(ctx context.Context, records []URLRecord, policy ConflictPolicy) (ImportResult, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	result, _, err := d.importRecords(records, policy)
+	return result, err
+}
+
+// importRecords применяет записи без блокировки и возвращает те, что были сохранены.
+func (d *MemoryMap) importRecords(records []URLRecord, policy ConflictPolicy) (ImportResult, []URLRecord, error) {
+	var result ImportResult
+	if policy == ConflictFail {
+		if err := repeatedShortError(records); err != nil {
+			return result, nil, err
+		}
+		for _, rec := range records {
+			if _, exists := d.urls[rec.ShortURL]; exists {
+				return result, nil, fmt.Errorf("%w: %v", ErrImportConflict, rec.ShortURL)
+			}
+		}
+	}
+
+	applied := make([]URLRecord, 0, len(records))
+	for _, rec := range records {
+		_, exists := d.urls[rec.ShortURL]
+		switch {
+		case !exists:
+			result.Created++
+		case policy == ConflictOverwrite:
+			result.Overwritten++
+		default:
+			result.Skipped++
+			continue
+		}
+		d.putRecord(rec)
+		applied = append(applied, d.urls[rec.ShortURL])
+	}
+	return result, applied, nil
+}
+
+// ListUserURLs начинает страницу с курсора двоичным поиском по отсортированным ссылкам пользователя,
+// поэтому выгрузка по страницам не сортирует все ссылки заново на каждой.
+func (d *MemoryMap) ListUserURLs(ctx context.Context, userID string, opts ListOptions) (URLPage, error) {
+	cursor, err := opts.decodeCursor()
+	if err != nil {
+		return URLPage{}, err
+	}
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	shorts := d.sortedShorts(userID, opts.sortField())
+	afterCursor := func(i int) bool {
+		return cursor == nil || opts.afterCursor(d.urls[shorts[i]], cursor)
+	}
+	var records []URLRecord
+	add := func(i int) bool {
+		if record := d.urls[shorts[i]]; opts.matches(record) {
+			records = append(records, record)
+		}
+		// одна лишняя запись показывает, что есть следующая страница
+		return opts.Limit <= 0 || len(records) <= opts.Limit
+	}
+	if opts.Desc {
+		// по убыванию после курсора идут записи меньше него - они в начале
+		end := sort.Search(len(shorts), func(i int) bool { return !afterCursor(i) })
+		for i := end - 1; i >= 0; i-- {
+			if !add(i) {
+				break
+			}
+		}
+	} else {
+		for i := sort.Search(len(shorts), afterCursor); i < len(shorts); i++ {
+			if !add(i) {
+				break
+			}
+		}
+	}
+	return opts.page(records), nil
+}
+
+// sortedShorts возвращает ссылки, которыми владеет пользователь, по возрастанию field.
+// Вызывается под Mutex.RLock.
+func (d *MemoryMap) sortedShorts(userID string, field SortField) []URL {
+	d.sortedMu.Lock()
+	defer d.sortedMu.Unlock()
+
+	if shorts, found := d.sorted[userID][field]; found {
+		return shorts
+	}
+	shorts := make([]URL, 0, len(d.UserShorts[userID]))
+	for short := range d.UserShorts[userID] {
+		if d.urls[short].UserID == userID {
+			shorts = append(shorts, short)
+		}
+	}
+	opts := ListOptions{Sort: field}
+	sort.Slice(shorts, func(i, j int) bool { return opts.less(d.urls[shorts[i]], d.urls[shorts[j]]) })
+	if d.sorted[userID] == nil {
+		d.sorted[userID] = make(map[SortField][]URL)
+	}
+	d.sorted[userID][field] = shorts
+	return shorts
+}
+
+func (d *MemoryMap) SearchUserURLs(ctx context.Context, userID string, query string, limit int) ([]SearchResult, error) {
+	terms, err := searchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	userShorts := d.UserShorts[userID]
+	var results []SearchResult
+	for short, rank := range d.index.search(terms) {
+		record := d.urls[short]
+		if _, found := userShorts[short]; !found || record.UserID != userID || record.Deleted {
+			continue
+		}
+		results = append(results, SearchResult{URLRecord: record, Rank: rank})
+	}
+	return sortSearchResults(results, searchLimit(limit)), nil
+}
+
+func (d *MemoryMap) EditUserURL(ctx context.Context, userID string, short URL, edit URLEdit) (URLRecord, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	return d.editRecord(userID, short, edit)
+}
+
+func (d *MemoryMap) FillUserURLPreview(ctx context.Context, userID string, short URL, title string, imageURL string) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	_, err := d.fillRecord(userID, short, title, imageURL)
+	return err
+}
+
+// fillRecord - FillUserURLPreview без блокировки; возвращает измененную запись или пустую, если менять нечего.
+func (d *MemoryMap) fillRecord(userID string, short URL, title string, imageURL string) (URLRecord, error) {
+	record, found := d.urls[short]
+	if !found || record.UserID != userID {
+		return URLRecord{}, ErrNotFoundURL
+	}
+	record, changed := fillPreview(record, title, imageURL)
+	if !changed {
+		return URLRecord{}, nil
+	}
+	d.urls[short] = record
+	d.index.put(record)
+	return record, nil
+}
+
+// editRecord применяет правку без блокировки.
+func (d *MemoryMap) editRecord(userID string, short URL, edit URLEdit) (URLRecord, error) {
+	record, found := d.urls[short]
+	if !found || record.UserID != userID {
+		return URLRecord{}, ErrNotFoundURL
+	}
+	record = edit.apply(record, d.now())
+	d.urls[short] = record
+	d.index.put(record)
+	return record, nil
 }
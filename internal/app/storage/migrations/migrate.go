@@ -1,12 +1,22 @@
 package migrations
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io/fs"
 	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type PgxIface interface {
@@ -21,36 +31,355 @@ type PgxIface interface {
 	Close()
 }
 
-type migration func(ctx context.Context, db PgxIface) error
+// Файлы миграций называются NNNN_описание.sql и состоят из двух частей,
+// начинающихся строками upMarker и downMarker.
+//
+//go:embed sql/*.sql
+var sqlFiles embed.FS
 
+const (
+	upMarker   = "-- +migrate Up"
+	downMarker = "-- +migrate Down"
+)
+
+var ErrChecksumMismatch = errors.New("applied migration was edited")
+var ErrUnknownVersion = errors.New("database version is newer than known migrations")
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Load читает встроенные миграции, упорядоченные по версии.
+func Load() ([]Migration, error) {
+	return loadFS(sqlFiles, "sql")
+}
+
+func loadFS(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read migrations: %w", err)
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read migration %v: %w", entry.Name(), err)
+		}
+		m, err := parseMigration(entry.Name(), string(content))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %v: expected version %v", m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+func parseMigration(filename string, content string) (Migration, error) {
+	name := strings.TrimSuffix(filename, ".sql")
+	versionStr, _, _ := strings.Cut(name, "_")
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		return Migration{}, fmt.Errorf("migration %v: bad version: %w", filename, err)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	m := Migration{Version: version, Name: name, Checksum: hex.EncodeToString(sum[:])}
+
+	var up, down strings.Builder
+	var current *strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch strings.TrimSpace(line) {
+		case upMarker:
+			current = &up
+			continue
+		case downMarker:
+			current = &down
+			continue
+		}
+		if current == nil {
+			if strings.TrimSpace(line) != "" {
+				return Migration{}, fmt.Errorf("migration %v: sql before %q", filename, upMarker)
+			}
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+	}
+	m.Up = strings.TrimSpace(up.String())
+	m.Down = strings.TrimSpace(down.String())
+	if m.Up == "" || m.Down == "" {
+		return Migration{}, fmt.Errorf("migration %v: both %q and %q parts are required", filename, upMarker, downMarker)
+	}
+	return m, nil
+}
+
+// Migrator применяет и откатывает миграции. Каждая миграция выполняется
+// в отдельной транзакции вместе с записью в таблицу revision.
+type Migrator struct {
+	db         PgxIface
+	migrations []Migration
+	// DryRun - только печатать, что будет выполнено.
+	DryRun bool
+	Logf   func(format string, args ...interface{})
+}
+
+func NewMigrator(db PgxIface) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, Logf: log.Printf}, nil
+}
+
+// Migrate применяет все новые миграции.
 func Migrate(ctx context.Context, db PgxIface) error {
-	_, err := db.Exec(
-		ctx, `CREATE TABLE IF NOT EXISTS "revision" (version BIGSERIAL CONSTRAINT revision_version_pk PRIMARY KEY)`)
+	m, err := NewMigrator(db)
 	if err != nil {
-		return fmt.Errorf("cannot get or create table revision: %w", err)
+		return err
 	}
-	var version int
-	err = db.QueryRow(
-		ctx, "SELECT version FROM revision ORDER BY version DESC LIMIT 1").Scan(&version)
+	return m.Up(ctx, 0)
+}
 
-	if err != nil &&
-		!(errors.Is(err, pgx.ErrNoRows)) {
-		return fmt.Errorf("cannot get version: %w", err)
+// Check проверяет, что все миграции применены, ничего не меняя.
+func Check(ctx context.Context, db PgxIface) error {
+	m, err := NewMigrator(db)
+	if err != nil {
+		return err
 	}
+	return m.Check(ctx)
+}
+
+// Latest возвращает версию последней известной миграции.
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// advisoryLockKey - ключ pg_advisory_lock, под которым выполняются миграции,
+// чтобы одновременно стартующие инстансы не применяли их параллельно.
+const advisoryLockKey int64 = 0x73686f7274656e // "shorten"
+
+var ErrSchemaBehind = errors.New("database schema is behind, run migrations")
+
+// poolConn - соединение, взятое из пула на время миграций.
+type poolConn struct {
+	*pgxpool.Conn
+}
+
+// Close не нужен: соединение возвращает в пул withLock.
+func (c poolConn) Close() {}
 
-	migrations := []migration{
-		migration1,
-		migration2,
+// withLock выполняет fn под сессионным advisory lock. Из пула берется одно соединение,
+// и блокировка, и миграции идут через него, так что хватает пула из одного соединения.
+func (m *Migrator) withLock(ctx context.Context, fn func() error) error {
+	if m.DryRun {
+		return fn()
+	}
+	if pool, ok := m.db.(*pgxpool.Pool); ok {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot acquire connection for migrations: %w", err)
+		}
+		defer conn.Release()
+		m.db = poolConn{conn}
+		defer func() { m.db = pool }()
 	}
 
-	for v, m := range migrations {
-		if version < (v + 1) {
-			log.Println("migrate database to version: ", v+1)
-			if err = m(ctx, db); err != nil {
-				return err
+	if _, err := m.db.Exec(ctx, `SELECT pg_advisory_lock($1)`, advisoryLockKey); err != nil {
+		return fmt.Errorf("cannot take migrations lock: %w", err)
+	}
+	defer func() {
+		if _, err := m.db.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, advisoryLockKey); err != nil {
+			m.Logf("cannot release migrations lock: %v", err)
+			// соединение с блокировкой не должно вернуться в пул
+			if conn, ok := m.db.(poolConn); ok {
+				conn.Conn.Conn().Close(context.Background())
 			}
 		}
+	}()
+	return fn()
+}
+
+func (m *Migrator) prepare(ctx context.Context) error {
+	if m.DryRun {
+		return nil
+	}
+	_, err := m.db.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS "revision" (version BIGSERIAL CONSTRAINT revision_version_pk PRIMARY KEY);
+ALTER TABLE "revision" ADD COLUMN IF NOT EXISTS checksum TEXT;
+ALTER TABLE "revision" ADD COLUMN IF NOT EXISTS applied_at TIMESTAMPTZ DEFAULT now();`)
+	if err != nil {
+		return fmt.Errorf("cannot get or create table revision: %w", err)
 	}
+	return nil
+}
 
+// Version возвращает текущую версию схемы, сверяя контрольные суммы
+// уже примененных миграций с файлами. Схему не меняет.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	return m.version(ctx, true)
+}
+
+func (m *Migrator) version(ctx context.Context, readOnly bool) (int, error) {
+	readOnly = readOnly || m.DryRun
+	rows, err := m.db.Query(ctx, `SELECT version, COALESCE(checksum, '') FROM revision ORDER BY version`)
+	var pgErr *pgconn.PgError
+	if err != nil && readOnly && errors.As(err, &pgErr) {
+		// таблица revision еще не создана или не обновлена
+		switch pgErr.Code {
+		case "42P01": // undefined_table
+			return 0, nil
+		case "42703": // undefined_column
+			rows, err = m.db.Query(ctx, `SELECT version, '' FROM revision ORDER BY version`)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot get version: %w", err)
+	}
+	type applied struct {
+		version  int
+		checksum string
+	}
+	var revisions []applied
+	for rows.Next() {
+		var a applied
+		if err = rows.Scan(&a.version, &a.checksum); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("cannot get version: %w", err)
+		}
+		revisions = append(revisions, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("cannot get version: %w", err)
+	}
+
+	version := 0
+	for _, a := range revisions {
+		if a.version > len(m.migrations) {
+			return 0, fmt.Errorf("%w: %v", ErrUnknownVersion, a.version)
+		}
+		migration := m.migrations[a.version-1]
+		switch a.checksum {
+		case migration.Checksum:
+		case "":
+			// миграции, примененные до появления контрольных сумм
+			if !readOnly {
+				_, err = m.db.Exec(ctx, `UPDATE revision SET checksum = $1 WHERE version = $2`, migration.Checksum, a.version)
+				if err != nil {
+					return 0, fmt.Errorf("cannot save checksum: %w", err)
+				}
+			}
+		default:
+			return 0, fmt.Errorf("%w: %v", ErrChecksumMismatch, migration.Name)
+		}
+		version = a.version
+	}
+	return version, nil
+}
+
+// Check возвращает ErrSchemaBehind, если применены не все миграции.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("%w: version %v, latest %v", ErrSchemaBehind, version, m.Latest())
+	}
 	return nil
 }
+
+// Up применяет миграции до версии target (0 - до последней).
+func (m *Migrator) Up(ctx context.Context, target int) error {
+	if target == 0 {
+		target = m.Latest()
+	}
+	if target > m.Latest() {
+		return fmt.Errorf("%w: %v", ErrUnknownVersion, target)
+	}
+	return m.withLock(ctx, func() error {
+		if err := m.prepare(ctx); err != nil {
+			return err
+		}
+		// версию читаем только под блокировкой: другой инстанс мог уже все применить
+		version, err := m.version(ctx, false)
+		if err != nil {
+			return err
+		}
+		if version >= target {
+			return nil
+		}
+		for _, migration := range m.migrations[version:target] {
+			m.Logf("migrate database to version: %v (%v)", migration.Version, migration.Name)
+			err = m.apply(ctx, migration.Up,
+				`INSERT INTO revision (version, checksum) VALUES($1, $2)`, migration.Version, migration.Checksum)
+			if err != nil {
+				return fmt.Errorf("migration %v: %w", migration.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down откатывает миграции так, чтобы версия схемы стала target.
+func (m *Migrator) Down(ctx context.Context, target int) error {
+	if target < 0 {
+		return fmt.Errorf("bad target version %v", target)
+	}
+	return m.withLock(ctx, func() error {
+		if err := m.prepare(ctx); err != nil {
+			return err
+		}
+		version, err := m.version(ctx, false)
+		if err != nil {
+			return err
+		}
+		for v := version; v > target; v-- {
+			migration := m.migrations[v-1]
+			m.Logf("rollback database from version: %v (%v)", migration.Version, migration.Name)
+			err = m.apply(ctx, migration.Down, `DELETE FROM revision WHERE version = $1`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("rollback %v: %w", migration.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// apply выполняет sql миграции и изменение revision в одной транзакции.
+func (m *Migrator) apply(ctx context.Context, sql string, revisionSQL string, args ...interface{}) error {
+	if m.DryRun {
+		m.Logf("BEGIN;\n%v\n%v -- %v\nCOMMIT;", sql, revisionSQL, args)
+		return nil
+	}
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, revisionSQL, args...); err != nil {
+		return fmt.Errorf("cannot update revision: %w", err)
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,245 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Up, m.Name)
+		assert.NotEmpty(t, m.Down, m.Name)
+		assert.Len(t, m.Checksum, 64, m.Name)
+	}
+}
+
+func TestParseMigration(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		want     Migration
+		wantErr  bool
+	}{
+		{
+			name:     "Test #1 up and down parts",
+			filename: "0002_url_is_deleted.sql",
+			content:  "-- +migrate Up\nALTER TABLE url ADD is_deleted bool;\n\n-- +migrate Down\nALTER TABLE url DROP COLUMN is_deleted;\n",
+			want: Migration{
+				Version: 2,
+				Name:    "0002_url_is_deleted",
+				Up:      "ALTER TABLE url ADD is_deleted bool;",
+				Down:    "ALTER TABLE url DROP COLUMN is_deleted;",
+			},
+		},
+		{
+			name:     "Test #2 missing down part",
+			filename: "0002_url_is_deleted.sql",
+			content:  "-- +migrate Up\nALTER TABLE url ADD is_deleted bool;\n",
+			wantErr:  true,
+		},
+		{
+			name:     "Test #3 sql before up marker",
+			filename: "0002_url_is_deleted.sql",
+			content:  "DROP TABLE url;\n-- +migrate Up\nSELECT 1;\n-- +migrate Down\nSELECT 1;\n",
+			wantErr:  true,
+		},
+		{
+			name:     "Test #4 bad version",
+			filename: "init.sql",
+			content:  "-- +migrate Up\nSELECT 1;\n-- +migrate Down\nSELECT 1;\n",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMigration(tt.filename, tt.content)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			got.Checksum = ""
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func newTestMigrator(t *testing.T) (*Migrator, pgxmock.PgxPoolIface) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	m, err := NewMigrator(mock)
+	require.NoError(t, err)
+	m.migrations = []Migration{
+		{Version: 1, Name: "0001_a", Up: "CREATE TABLE a ()", Down: "DROP TABLE a", Checksum: "sum1"},
+		{Version: 2, Name: "0002_b", Up: "CREATE TABLE b ()", Down: "DROP TABLE b", Checksum: "sum2"},
+	}
+	m.Logf = t.Logf
+	return m, mock
+}
+
+func expectLock(mock pgxmock.PgxPoolIface) {
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).WithArgs(advisoryLockKey).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+}
+
+func expectUnlock(mock pgxmock.PgxPoolIface) {
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WithArgs(advisoryLockKey).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+}
+
+func expectVersion(mock pgxmock.PgxPoolIface, checksums ...string) {
+	expectLock(mock)
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "revision"`).
+		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	rows := mock.NewRows([]string{"version", "checksum"})
+	for i, sum := range checksums {
+		rows.AddRow(i+1, sum)
+	}
+	mock.ExpectQuery(`SELECT version, COALESCE\(checksum, ''\) FROM revision`).WillReturnRows(rows)
+}
+
+func TestMigrator_Up(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(mock pgxmock.PgxPoolIface)
+		dryRun  bool
+		wantErr error
+	}{
+		{
+			name: "Test #1 fresh database",
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				expectVersion(mock)
+				for _, v := range []int{1, 2} {
+					mock.ExpectBegin()
+					mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf("CREATE TABLE %c ()", 'a'+v-1))).
+						WillReturnResult(pgxmock.NewResult("CREATE", 0))
+					mock.ExpectExec(`INSERT INTO revision`).WithArgs(v, fmt.Sprintf("sum%v", v)).
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+					mock.ExpectCommit()
+				}
+			},
+		},
+		{
+			name: "Test #2 failed migration is rolled back with its revision",
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				expectVersion(mock, "sum1")
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE b ()")).WillReturnError(fmt.Errorf("syntax error"))
+				mock.ExpectRollback()
+			},
+			wantErr: fmt.Errorf("migration 0002_b: syntax error"),
+		},
+		{
+			name: "Test #3 edited migration",
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				expectVersion(mock, "edited")
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			name: "Test #4 migrations applied before checksums",
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				expectVersion(mock, "", "")
+				mock.ExpectExec(`UPDATE revision SET checksum`).WithArgs("sum1", 1).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectExec(`UPDATE revision SET checksum`).WithArgs("sum2", 2).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			},
+		},
+		{
+			name:   "Test #5 dry run changes nothing",
+			dryRun: true,
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery(`SELECT version, COALESCE\(checksum, ''\) FROM revision`).
+					WillReturnRows(mock.NewRows([]string{"version", "checksum"}).AddRow(1, "sum1"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newTestMigrator(t)
+			m.DryRun = tt.dryRun
+			tt.prepare(mock)
+			if !tt.dryRun {
+				expectUnlock(mock)
+			}
+
+			err := m.Up(context.Background(), 0)
+			switch {
+			case tt.wantErr == nil:
+				assert.NoError(t, err)
+			case tt.wantErr == ErrChecksumMismatch:
+				assert.ErrorIs(t, err, tt.wantErr)
+			default:
+				assert.EqualError(t, err, tt.wantErr.Error())
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestMigrator_Down(t *testing.T) {
+	m, mock := newTestMigrator(t)
+	expectVersion(mock, "sum1", "sum2")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE b")).WillReturnResult(pgxmock.NewResult("DROP", 0))
+	mock.ExpectExec(`DELETE FROM revision WHERE version = \$1`).WithArgs(2).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	assert.NoError(t, m.Down(context.Background(), 1))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		checksums []string
+		wantErr   error
+	}{
+		{
+			name:      "Test #1 schema is up to date",
+			checksums: []string{"sum1", "sum2"},
+		},
+		{
+			name:      "Test #2 schema is behind",
+			checksums: []string{"sum1"},
+			wantErr:   ErrSchemaBehind,
+		},
+		{
+			name:      "Test #3 edited migration",
+			checksums: []string{"sum1", "edited"},
+			wantErr:   ErrChecksumMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newTestMigrator(t)
+			rows := mock.NewRows([]string{"version", "checksum"})
+			for i, sum := range tt.checksums {
+				rows.AddRow(i+1, sum)
+			}
+			// проверка только читает: ни блокировки, ни изменений revision
+			mock.ExpectQuery(`SELECT version, COALESCE\(checksum, ''\) FROM revision`).WillReturnRows(rows)
+
+			err := m.Check(context.Background())
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -1,13 +1,4 @@
-package migrations
-
-import (
-	"context"
-)
-
-func migration1(ctx context.Context, db PgxIface) error {
-	_, err := db.Exec(
-		ctx,
-		`
+-- +migrate Up
 CREATE TABLE "user" (
     id   bigserial CONSTRAINT user_id_pk PRIMARY KEY,
     uuid UUID
@@ -26,7 +17,6 @@ CREATE TABLE url (
 
 CREATE UNIQUE INDEX IF NOT EXISTS url_short_uindex ON url(short);
 
-INSERT INTO revision VALUES(1);  
-`)
-	return err
-}
+-- +migrate Down
+DROP TABLE url;
+DROP TABLE "user";
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE url ADD is_deleted bool DEFAULT FALSE;
+
+-- +migrate Down
+ALTER TABLE url DROP COLUMN is_deleted;
@@ -0,0 +1,17 @@
+-- +migrate Up
+-- при каждом изменении или удалении строки url отправляем NOTIFY url_changes с короткой ссылкой,
+-- инстансы с локальным кэшем слушают канал и сбрасывают измененные ссылки
+CREATE OR REPLACE FUNCTION notify_url_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('url_changes', OLD.short);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER url_change_notify
+    AFTER UPDATE OR DELETE ON url
+    FOR EACH ROW EXECUTE PROCEDURE notify_url_change();
+
+-- +migrate Down
+DROP TRIGGER url_change_notify ON url;
+DROP FUNCTION notify_url_change();
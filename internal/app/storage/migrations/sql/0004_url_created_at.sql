@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE url ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- +migrate Down
+ALTER TABLE url DROP COLUMN created_at;
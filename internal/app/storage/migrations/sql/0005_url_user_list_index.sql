@@ -0,0 +1,7 @@
+-- +migrate Up
+CREATE INDEX IF NOT EXISTS url_user_id_created_at_index ON url (user_id, created_at, short);
+CREATE INDEX IF NOT EXISTS url_user_id_short_index ON url (user_id, short);
+
+-- +migrate Down
+DROP INDEX IF EXISTS url_user_id_short_index;
+DROP INDEX IF EXISTS url_user_id_created_at_index;
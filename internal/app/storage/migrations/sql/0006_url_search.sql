@@ -0,0 +1,10 @@
+-- +migrate Up
+-- документ для полнотекстового поиска: слова ссылки, разделенные всем, кроме букв и цифр
+-- (как storage.SearchTerms), без стемминга - ищем по префиксам слов
+ALTER TABLE url ADD COLUMN search tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', regexp_replace(long, '[^[:alnum:]]+', ' ', 'g'))) STORED;
+CREATE INDEX url_search_index ON url USING GIN (search);
+
+-- +migrate Down
+DROP INDEX url_search_index;
+ALTER TABLE url DROP COLUMN search;
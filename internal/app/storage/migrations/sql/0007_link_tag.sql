@@ -0,0 +1,75 @@
+-- +migrate Up
+ALTER TABLE url ADD COLUMN folder TEXT NOT NULL DEFAULT '';
+CREATE INDEX url_user_id_folder_index ON url (user_id, folder);
+
+CREATE TABLE link_tag (
+    short VARCHAR(255) NOT NULL
+        CONSTRAINT link_tag_short_fk
+            REFERENCES url (short)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    tag   VARCHAR(64)  NOT NULL,
+    CONSTRAINT link_tag_pk PRIMARY KEY (short, tag)
+);
+CREATE INDEX link_tag_tag_index ON link_tag (tag, short);
+
+-- поиск учитывает теги из link_tag, поэтому документ больше не вычисляемая колонка,
+-- а обновляется триггерами на url и link_tag; слова тегов весят больше слов ссылки
+ALTER TABLE url DROP COLUMN search;
+ALTER TABLE url ADD COLUMN search tsvector;
+
+CREATE FUNCTION url_search_document(long TEXT, tags TEXT) RETURNS tsvector AS $$
+    SELECT setweight(to_tsvector('simple', regexp_replace(COALESCE(tags, ''), '[^[:alnum:]]+', ' ', 'g')), 'A') ||
+           setweight(to_tsvector('simple', regexp_replace(COALESCE(long, ''), '[^[:alnum:]]+', ' ', 'g')), 'B');
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE FUNCTION url_tags_text(url_short VARCHAR) RETURNS TEXT AS $$
+    SELECT string_agg(tag, ' ') FROM link_tag WHERE short = url_short;
+$$ LANGUAGE sql STABLE;
+
+CREATE FUNCTION url_search_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search := url_search_document(NEW.long, url_tags_text(NEW.short));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER url_search_update
+    BEFORE INSERT OR UPDATE OF long ON url
+    FOR EACH ROW EXECUTE PROCEDURE url_search_update();
+
+CREATE FUNCTION link_tag_search_update() RETURNS trigger AS $$
+DECLARE
+    changed VARCHAR;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD.short;
+    ELSE
+        changed := NEW.short;
+    END IF;
+    UPDATE url SET search = url_search_document(long, url_tags_text(short)) WHERE short = changed;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER link_tag_search_update
+    AFTER INSERT OR DELETE ON link_tag
+    FOR EACH ROW EXECUTE PROCEDURE link_tag_search_update();
+
+UPDATE url SET search = url_search_document(long, NULL);
+CREATE INDEX url_search_index ON url USING GIN (search);
+
+-- +migrate Down
+DROP TABLE link_tag;
+DROP FUNCTION link_tag_search_update();
+DROP TRIGGER url_search_update ON url;
+DROP FUNCTION url_search_update();
+DROP FUNCTION url_tags_text(VARCHAR);
+DROP FUNCTION url_search_document(TEXT, TEXT);
+
+ALTER TABLE url DROP COLUMN search;
+ALTER TABLE url ADD COLUMN search tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', regexp_replace(long, '[^[:alnum:]]+', ' ', 'g'))) STORED;
+CREATE INDEX url_search_index ON url USING GIN (search);
+
+DROP INDEX url_user_id_folder_index;
+ALTER TABLE url DROP COLUMN folder;
@@ -0,0 +1,100 @@
+-- +migrate Up
+ALTER TABLE url ADD COLUMN updated_at TIMESTAMPTZ;
+UPDATE url SET updated_at = created_at;
+ALTER TABLE url ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE url ALTER COLUMN updated_at SET DEFAULT now();
+ALTER TABLE url ADD COLUMN title TEXT NOT NULL DEFAULT '';
+ALTER TABLE url ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+
+-- удаление и восстановление меняют updated_at, если запрос не задал его сам (импорт);
+-- правку ссылки EditUserURL отмечает явно, потому что теги лежат в link_tag
+CREATE FUNCTION url_touch_updated_at() RETURNS trigger AS $$
+BEGIN
+    IF NEW.updated_at IS NOT DISTINCT FROM OLD.updated_at THEN
+        NEW.updated_at := now();
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER url_touch_updated_at
+    BEFORE UPDATE OF is_deleted ON url
+    FOR EACH ROW
+    WHEN (OLD.is_deleted IS DISTINCT FROM NEW.is_deleted)
+    EXECUTE PROCEDURE url_touch_updated_at();
+
+-- заголовок весит как теги, заметки - как ссылка
+DROP TRIGGER url_search_update ON url;
+DROP FUNCTION url_search_document(TEXT, TEXT);
+
+CREATE FUNCTION url_search_document(long TEXT, tags TEXT, title TEXT, notes TEXT) RETURNS tsvector AS $$
+    SELECT setweight(to_tsvector('simple',
+               regexp_replace(COALESCE(tags, '') || ' ' || COALESCE(title, ''), '[^[:alnum:]]+', ' ', 'g')), 'A') ||
+           setweight(to_tsvector('simple',
+               regexp_replace(COALESCE(long, '') || ' ' || COALESCE(notes, ''), '[^[:alnum:]]+', ' ', 'g')), 'B');
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION url_search_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search := url_search_document(NEW.long, url_tags_text(NEW.short), NEW.title, NEW.notes);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER url_search_update
+    BEFORE INSERT OR UPDATE OF long, title, notes ON url
+    FOR EACH ROW EXECUTE PROCEDURE url_search_update();
+
+CREATE OR REPLACE FUNCTION link_tag_search_update() RETURNS trigger AS $$
+DECLARE
+    changed VARCHAR;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD.short;
+    ELSE
+        changed := NEW.short;
+    END IF;
+    UPDATE url SET search = url_search_document(long, url_tags_text(short), title, notes) WHERE short = changed;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- +migrate Down
+DROP TRIGGER url_search_update ON url;
+DROP FUNCTION url_search_document(TEXT, TEXT, TEXT, TEXT);
+
+CREATE FUNCTION url_search_document(long TEXT, tags TEXT) RETURNS tsvector AS $$
+    SELECT setweight(to_tsvector('simple', regexp_replace(COALESCE(tags, ''), '[^[:alnum:]]+', ' ', 'g')), 'A') ||
+           setweight(to_tsvector('simple', regexp_replace(COALESCE(long, ''), '[^[:alnum:]]+', ' ', 'g')), 'B');
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION url_search_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search := url_search_document(NEW.long, url_tags_text(NEW.short));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER url_search_update
+    BEFORE INSERT OR UPDATE OF long ON url
+    FOR EACH ROW EXECUTE PROCEDURE url_search_update();
+
+CREATE OR REPLACE FUNCTION link_tag_search_update() RETURNS trigger AS $$
+DECLARE
+    changed VARCHAR;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD.short;
+    ELSE
+        changed := NEW.short;
+    END IF;
+    UPDATE url SET search = url_search_document(long, url_tags_text(short)) WHERE short = changed;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER url_touch_updated_at ON url;
+DROP FUNCTION url_touch_updated_at();
+ALTER TABLE url DROP COLUMN notes;
+ALTER TABLE url DROP COLUMN title;
+ALTER TABLE url DROP COLUMN updated_at;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE url ADD COLUMN image_url TEXT NOT NULL DEFAULT '';
+
+-- +migrate Down
+ALTER TABLE url DROP COLUMN image_url;
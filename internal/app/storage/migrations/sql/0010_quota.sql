@@ -0,0 +1,11 @@
+-- +migrate Up
+-- счетчики дневных квот на создание ссылок, key - "user:<uuid>" или "ip:<адрес>"
+CREATE TABLE quota (
+    key  VARCHAR(255) NOT NULL,
+    day  DATE         NOT NULL,
+    used INTEGER      NOT NULL,
+    CONSTRAINT quota_pk PRIMARY KEY (key, day)
+);
+
+-- +migrate Down
+DROP TABLE quota;
@@ -0,0 +1,14 @@
+-- +migrate Up
+-- счетчики лимитов запросов, общие для всех инстансов; потеря при сбое не страшна,
+-- поэтому таблица не пишется в WAL
+CREATE UNLOGGED TABLE rate_limit (
+    key          VARCHAR(255) NOT NULL,
+    window_start TIMESTAMPTZ  NOT NULL,
+    hits         INTEGER      NOT NULL,
+    expires_at   TIMESTAMPTZ  NOT NULL,
+    CONSTRAINT rate_limit_pk PRIMARY KEY (key, window_start)
+);
+CREATE INDEX rate_limit_expires_at_index ON rate_limit (expires_at);
+
+-- +migrate Down
+DROP TABLE rate_limit;
@@ -0,0 +1,15 @@
+-- +migrate Up
+-- ключи идемпотентности запросов на сокращение и сохраненные ответы на них;
+-- status IS NULL - запрос еще выполняется
+CREATE TABLE idempotency_key (
+    key          VARCHAR(512) PRIMARY KEY,
+    fingerprint  VARCHAR(64)  NOT NULL,
+    status       INTEGER,
+    content_type VARCHAR(255),
+    body         BYTEA,
+    expires_at   TIMESTAMPTZ  NOT NULL
+);
+CREATE INDEX idempotency_key_expires_at_index ON idempotency_key (expires_at);
+
+-- +migrate Down
+DROP TABLE idempotency_key;
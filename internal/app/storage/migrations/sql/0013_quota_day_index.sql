@@ -0,0 +1,6 @@
+-- +migrate Up
+-- по дню удаляются счетчики прошедших суток
+CREATE INDEX quota_day_index ON quota (day);
+
+-- +migrate Down
+DROP INDEX quota_day_index;
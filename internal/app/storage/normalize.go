@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// MaxLongURLLength - предельная длина сокращаемой ссылки, до и после нормализации.
+const MaxLongURLLength = 2048
+
+var ErrInvalidURL = errors.New("invalid url")
+
+// defaultPorts - порты, которые не пишутся в канонической ссылке.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// NormalizeLongURL проверяет, что ссылка абсолютная http(s), и приводит ее к каноническому виду,
+// чтобы одинаковые по смыслу ссылки получали один короткий адрес: схема и хост в нижнем регистре,
+// хост в punycode, без порта по умолчанию, без "/" у пустого пути.
+func NormalizeLongURL(long URL) (URL, error) {
+	raw := strings.TrimSpace(long.S())
+	if raw == "" {
+		return "", fmt.Errorf("%w: empty url", ErrInvalidURL)
+	}
+	if len(raw) > MaxLongURLLength {
+		return "", fmt.Errorf("%w: url is longer than %v", ErrInvalidURL, MaxLongURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[u.Scheme]; !ok || u.Opaque != "" {
+		return "", fmt.Errorf("%w: url must be an absolute http(s) url", ErrInvalidURL)
+	}
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u.Host = host
+	if u.Path == "/" && u.RawPath == "" {
+		u.Path = ""
+	}
+
+	normalized := u.String()
+	if len(normalized) > MaxLongURLLength {
+		return "", fmt.Errorf("%w: url is longer than %v", ErrInvalidURL, MaxLongURLLength)
+	}
+	return URL(normalized), nil
+}
+
+// normalizeHost переводит хост в нижний регистр и punycode. IP адреса остаются как есть.
+func normalizeHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return "", fmt.Errorf("%w: url has no host", ErrInvalidURL)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("%w: bad host %q", ErrInvalidURL, host)
+	}
+	return ascii, nil
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLongURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		long    URL
+		want    URL
+		wantErr bool
+	}{
+		{name: "Test #1 already canonical", long: "https://ya.ru/path?q=1#top", want: "https://ya.ru/path?q=1#top"},
+		{name: "Test #2 scheme and host case", long: " HTTPS://Ya.RU/Path ", want: "https://ya.ru/Path"},
+		{name: "Test #3 default ports", long: "http://ya.ru:80/a", want: "http://ya.ru/a"},
+		{name: "Test #4 other port kept", long: "https://ya.ru:8443/a", want: "https://ya.ru:8443/a"},
+		{name: "Test #5 root slash", long: "https://ya.ru/", want: "https://ya.ru"},
+		{name: "Test #6 root slash with query", long: "https://ya.ru/?q=1", want: "https://ya.ru?q=1"},
+		{name: "Test #7 idn", long: "http://Пример.РФ/страница", want: "http://xn--e1afmkfd.xn--p1ai/%D1%81%D1%82%D1%80%D0%B0%D0%BD%D0%B8%D1%86%D0%B0"},
+		{name: "Test #8 trailing dot", long: "https://ya.ru./a", want: "https://ya.ru/a"},
+		{name: "Test #9 ipv6", long: "https://[2001:DB8::1]:443/", want: "https://[2001:db8::1]"},
+		{name: "Test #10 empty", long: "  ", wantErr: true},
+		{name: "Test #11 relative", long: "ya.ru/path", wantErr: true},
+		{name: "Test #12 other scheme", long: "javascript:alert(1)", wantErr: true},
+		{name: "Test #13 no host", long: "https:///path", wantErr: true},
+		{name: "Test #14 bad host", long: "https://ya ru/", wantErr: true},
+		{name: "Test #15 too long", long: URL("https://ya.ru/" + strings.Repeat("a", MaxLongURLLength)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeLongURL(tt.long)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidURL)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
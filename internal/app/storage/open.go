@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"go-url-shortener/internal/app/config"
+	"log"
+	"time"
+)
+
+// OpenOptions - какое хранилище открывать. Выбирается первое заданное:
+// шарды postgres, postgres, redis, файл; если ничего не задано - память.
+type OpenOptions struct {
+	// Shards - DSN шардов postgres по именам, см. ParseShards.
+	Shards      map[string]string
+	DatabaseDSN string
+	// PG - настройки postgres; шардам передаются только MaxConns и MigrateMode.
+	PG              PGOptions
+	RedisURL        string
+	RedisKeyPrefix  string
+	RedisTTL        time.Duration
+	FileStoragePath string
+}
+
+// OptionsFromConfig - настройки хранилища из конфигурации, с разобранным DATABASE_SHARDS.
+func OptionsFromConfig(cfg config.Config) (OpenOptions, error) {
+	shards, err := ParseShards(cfg.DatabaseShards)
+	if err != nil {
+		return OpenOptions{}, err
+	}
+	return OpenOptions{
+		Shards:      shards,
+		DatabaseDSN: cfg.DatabaseDSN,
+		PG: PGOptions{
+			ReplicaDSNs:     cfg.DatabaseReplicaDSNs,
+			MaxConns:        cfg.DatabaseMaxConns,
+			ReplicaMaxConns: cfg.DatabaseReplicaMaxConns,
+			ReadYourWrites:  cfg.DatabaseReadYourWrites,
+			MigrateMode:     cfg.DatabaseMigrate,
+		},
+		RedisURL:        cfg.RedisURL,
+		RedisKeyPrefix:  cfg.RedisKeyPrefix,
+		RedisTTL:        cfg.RedisTTL,
+		FileStoragePath: cfg.FileStoragePath,
+	}, nil
+}
+
+// PolicyFromConfig - источники правил URLPolicy из конфигурации.
+func PolicyFromConfig(cfg config.Config) PolicyConfig {
+	return PolicyConfig{
+		Blocklist:     cfg.PolicyBlocklist,
+		BlocklistFile: cfg.PolicyBlocklistFile,
+		Allowlist:     cfg.PolicyAllowlist,
+		AllowlistFile: cfg.PolicyAllowlistFile,
+		ThreatFeed:    cfg.PolicyThreatFeed,
+	}
+}
+
+// Open создает хранилище по opts.
+func Open(opts OpenOptions) (Repository, error) {
+	if len(opts.Shards) > 0 {
+		shardOpts := PGOptions{
+			MaxConns:    opts.PG.MaxConns,
+			MigrateMode: opts.PG.MigrateMode,
+		}
+		shards := make(map[string]Repository, len(opts.Shards))
+		for name, dsn := range opts.Shards {
+			shard, err := NewPG(dsn, shardOpts)
+			if err != nil {
+				for _, opened := range shards {
+					opened.(*PG).Close()
+				}
+				return nil, fmt.Errorf("shard %v: %w", name, err)
+			}
+			shards[name] = shard
+			log.Printf("use postgres conn %v as shard %v", dsn, name)
+		}
+		return NewSharded(shards), nil
+	}
+
+	if opts.DatabaseDSN != "" {
+		db, err := NewPG(opts.DatabaseDSN, opts.PG)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("use postgres conn " + opts.DatabaseDSN + " as db")
+		return db, nil
+	}
+
+	if opts.RedisURL != "" {
+		db, err := NewRedis(opts.RedisURL, opts.RedisKeyPrefix, opts.RedisTTL)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("use redis " + opts.RedisURL + " as db")
+		return db, nil
+	}
+
+	if opts.FileStoragePath != "" {
+		db, err := NewFileStorage(opts.FileStoragePath)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("use file " + opts.FileStoragePath + " as db")
+		return db, nil
+	}
+
+	return NewMemoryMap(), nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgconn"
+	pgx "github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+// URLChangesChannel - канал NOTIFY, в который триггер на таблице url пишет измененные короткие ссылки.
+const URLChangesChannel = "url_changes"
+
+// Invalidator - то, что умеет сбрасывать закэшированные ссылки (например Cache).
+type Invalidator interface {
+	Invalidate(shortUrls ...URL)
+	Purge()
+}
+
+type listenConn interface {
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	Close(ctx context.Context) error
+}
+
+// PGListener слушает URLChangesChannel и сбрасывает измененные ссылки в target.
+// Пока соединения нет, уведомления теряются, поэтому при потере соединения
+// и после переподключения кэш очищается полностью.
+type PGListener struct {
+	target         Invalidator
+	connect        func(ctx context.Context) (listenConn, error)
+	reconnectDelay time.Duration
+}
+
+func NewPGListener(dsn string, target Invalidator) *PGListener {
+	return &PGListener{
+		target: target,
+		connect: func(ctx context.Context) (listenConn, error) {
+			return pgx.Connect(ctx, dsn)
+		},
+		reconnectDelay: time.Second,
+	}
+}
+
+// Run слушает уведомления до отмены ctx, переподключаясь при ошибках.
+func (l *PGListener) Run(ctx context.Context) {
+	for {
+		err := l.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("url changes listener error: %v, reconnect in %v", err, l.reconnectDelay)
+		l.target.Purge()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.reconnectDelay):
+		}
+	}
+}
+
+func (l *PGListener) listen(ctx context.Context) error {
+	conn, err := l.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+URLChangesChannel); err != nil {
+		return fmt.Errorf("cannot listen: %w", err)
+	}
+	// пока не слушали, могли пропустить изменения
+	l.target.Purge()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("wait for notification: %w", err)
+		}
+		l.target.Invalidate(URL(notification.Payload))
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeListenConn struct {
+	notifications chan *pgconn.Notification
+	listened      chan string
+}
+
+func (c *fakeListenConn) Exec(_ context.Context, sql string, _ ...interface{}) (pgconn.CommandTag, error) {
+	c.listened <- sql
+	return nil, nil
+}
+
+func (c *fakeListenConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case n, ok := <-c.notifications:
+		if !ok {
+			return nil, errors.New("conn closed")
+		}
+		return n, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeListenConn) Close(context.Context) error {
+	return nil
+}
+
+type recordingInvalidator struct {
+	mu          sync.Mutex
+	invalidated []URL
+	purges      int
+}
+
+func (r *recordingInvalidator) Invalidate(shortUrls ...URL) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.invalidated = append(r.invalidated, shortUrls...)
+}
+
+func (r *recordingInvalidator) Purge() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.purges++
+}
+
+func (r *recordingInvalidator) state() ([]URL, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]URL(nil), r.invalidated...), r.purges
+}
+
+func TestPGListener_Run(t *testing.T) {
+	target := &recordingInvalidator{}
+	conns := []*fakeListenConn{
+		{notifications: make(chan *pgconn.Notification), listened: make(chan string, 1)},
+		{notifications: make(chan *pgconn.Notification), listened: make(chan string, 1)},
+	}
+	connected := 0
+	l := &PGListener{
+		target: target,
+		connect: func(ctx context.Context) (listenConn, error) {
+			conn := conns[connected]
+			connected++
+			return conn, nil
+		},
+		reconnectDelay: time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+
+	assert.Equal(t, "LISTEN "+URLChangesChannel, <-conns[0].listened)
+	conns[0].notifications <- &pgconn.Notification{Channel: URLChangesChannel, Payload: "6db64c5d"}
+
+	// потеря соединения: полный сброс и переподключение
+	close(conns[0].notifications)
+	assert.Equal(t, "LISTEN "+URLChangesChannel, <-conns[1].listened)
+	conns[1].notifications <- &pgconn.Notification{Channel: URLChangesChannel, Payload: "ac5a78ac"}
+
+	cancel()
+	<-done
+
+	invalidated, purges := target.state()
+	assert.Equal(t, []URL{"6db64c5d", "ac5a78ac"}, invalidated)
+	// после первого LISTEN, при потере соединения и после второго LISTEN
+	assert.Equal(t, 3, purges)
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type pgReplica struct {
+	db      PgxIface
+	name    string
+	healthy int32
+}
+
+func (r *pgReplica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *pgReplica) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	if old := atomic.SwapInt32(&r.healthy, v); old != v {
+		log.Printf("replica %v healthy: %v", r.name, healthy)
+	}
+}
+
+// replicaSet раздает реплики для чтения по кругу, пропуская нездоровые.
+type replicaSet struct {
+	replicas []*pgReplica
+	next     uint32
+	done     chan struct{}
+}
+
+func newReplicaSet(replicas ...*pgReplica) *replicaSet {
+	return &replicaSet{
+		replicas: replicas,
+		done:     make(chan struct{}),
+	}
+}
+
+// pick возвращает следующую здоровую реплику или nil, если таких нет.
+func (s *replicaSet) pick() *pgReplica {
+	if s == nil || len(s.replicas) == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(&s.next, 1)
+	for i := 0; i < len(s.replicas); i++ {
+		r := s.replicas[(int(start)+i)%len(s.replicas)]
+		if r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *replicaSet) checkHealth(timeout time.Duration) {
+	for _, r := range s.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		r.setHealthy(r.db.Ping(ctx) == nil)
+		cancel()
+	}
+}
+
+func (s *replicaSet) run(interval time.Duration, tick func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkHealth(interval)
+			tick()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *replicaSet) Close() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+	for _, r := range s.replicas {
+		r.db.Close()
+	}
+}
+
+// recentWrites помнит пользователей и ссылки, измененные за последние window,
+// чтобы их чтения шли в primary, пока реплики могут отставать.
+type recentWrites struct {
+	mu     sync.Mutex
+	window time.Duration
+	users  map[string]time.Time
+	shorts map[URL]time.Time
+}
+
+func newRecentWrites(window time.Duration) *recentWrites {
+	return &recentWrites{
+		window: window,
+		users:  make(map[string]time.Time),
+		shorts: make(map[URL]time.Time),
+	}
+}
+
+func (w *recentWrites) mark(userID string, shortUrls ...URL) {
+	if w == nil || w.window <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	until := time.Now().Add(w.window)
+	w.users[userID] = until
+	for _, short := range shortUrls {
+		w.shorts[short] = until
+	}
+}
+
+func (w *recentWrites) hasUser(userID string) bool {
+	if w == nil || w.window <= 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.users[userID])
+}
+
+func (w *recentWrites) hasShort(short URL) bool {
+	if w == nil || w.window <= 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.shorts[short])
+}
+
+// prune удаляет истекшие записи.
+func (w *recentWrites) prune() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for userID, until := range w.users {
+		if now.After(until) {
+			delete(w.users, userID)
+		}
+	}
+	for short, until := range w.shorts {
+		if now.After(until) {
+			delete(w.shorts, short)
+		}
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 	"go-url-shortener/internal/app/storage/migrations"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +20,12 @@ type delayedUserUrlsDeleter struct {
 	mu       sync.RWMutex
 	userChan map[int64]chan URL
 	done     chan struct{}
+	stopped  bool
+	// senders - горутины, передающие ссылки в каналы, workers - горутины пользователей
+	senders sync.WaitGroup
+	workers sync.WaitGroup
+	// onDelete вызываются с ссылками, удаление которых применено в базе
+	onDelete []func(shortUrls ...URL)
 }
 
 type PgxIface interface {
@@ -34,51 +43,143 @@ type PgxIface interface {
 type PG struct {
 	Repository
 	db             PgxIface
+	replicas       *replicaSet
+	recentWrites   *recentWrites
 	delayedDeleter *delayedUserUrlsDeleter
+	// lastQuotaCleanup - unix-время последней очистки квот, меняется через atomic.
+	lastQuotaCleanup int64
 }
 
+// PGOptions - необязательные настройки подключения к postgres.
+type PGOptions struct {
+	// ReplicaDSNs - реплики, на которые уходят GetLongURL и GetUsersURLs.
+	ReplicaDSNs     []string
+	MaxConns        int32
+	ReplicaMaxConns int32
+	// ReadYourWrites - сколько после записи читать ссылки и список пользователя из primary.
+	ReadYourWrites      time.Duration
+	HealthCheckInterval time.Duration
+	// MigrateMode - MigrateAuto (по умолчанию) или MigrateCheck.
+	MigrateMode string
+}
+
+const (
+	// MigrateAuto - применять миграции при старте.
+	MigrateAuto = "auto"
+	// MigrateCheck - не мигрировать, а отказываться стартовать на устаревшей схеме;
+	// миграции применяются отдельным шагом деплоя.
+	MigrateCheck = "check"
+)
+
 var ErrNoRows = pgx.ErrNoRows
 
+// ErrClosed - хранилище закрыто и больше не принимает отложенные удаления.
+var ErrClosed = errors.New("storage is closed")
+
 func newDeleteUserUrls() *delayedUserUrlsDeleter {
 	return &delayedUserUrlsDeleter{
 		userChan: make(map[int64]chan URL),
+		done:     make(chan struct{}),
 	}
 }
 
-func NewPG(dsn string) (*PG, error) {
-	ctx := context.Background()
+func connectPool(ctx context.Context, dsn string, maxConns int32) (*pgxpool.Pool, error) {
 	conf, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect: parse dsn problem (dsn=%v): %w", dsn, err)
 	}
 
-	conf.MaxConns = 10
+	if maxConns > 0 {
+		conf.MaxConns = maxConns
+	}
 	conn, err := pgxpool.ConnectConfig(ctx, conf)
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to database(dsn=%v): %w", dsn, err)
 	}
+	return conn, nil
+}
+
+// migrateSchema применяет миграции или проверяет схему, в зависимости от mode.
+func migrateSchema(ctx context.Context, conn PgxIface, mode string) error {
+	switch mode {
+	case MigrateAuto, "":
+		if err := migrations.Migrate(ctx, conn); err != nil {
+			return fmt.Errorf("cannot apply migrations: %w", err)
+		}
+	case MigrateCheck:
+		if err := migrations.Check(ctx, conn); err != nil {
+			return fmt.Errorf("cannot start: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown migrate mode %q", mode)
+	}
+	return nil
+}
+
+func NewPG(dsn string, opts PGOptions) (*PG, error) {
+	ctx := context.Background()
+	conn, err := connectPool(ctx, dsn, opts.MaxConns)
+	if err != nil {
+		return nil, err
+	}
 
 	repo := &PG{
 		db:             conn,
+		recentWrites:   newRecentWrites(opts.ReadYourWrites),
 		delayedDeleter: newDeleteUserUrls(),
 	}
-	err = migrations.Migrate(ctx, conn)
-	if err != nil {
-		return nil, fmt.Errorf("cannot apply migrations: %w", err)
+	if err = migrateSchema(ctx, conn, opts.MigrateMode); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if len(opts.ReplicaDSNs) > 0 {
+		replicas := make([]*pgReplica, 0, len(opts.ReplicaDSNs))
+		for i, replicaDSN := range opts.ReplicaDSNs {
+			replicaConn, err := connectPool(ctx, replicaDSN, opts.ReplicaMaxConns)
+			if err != nil {
+				// без одной реплики хранилище не создается - закрываем уже открытые пулы
+				for _, opened := range replicas {
+					opened.db.Close()
+				}
+				conn.Close()
+				return nil, fmt.Errorf("replica #%v: %w", i, err)
+			}
+			replicas = append(replicas, &pgReplica{db: replicaConn, name: fmt.Sprintf("#%v", i)})
+		}
+		interval := opts.HealthCheckInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		repo.replicas = newReplicaSet(replicas...)
+		repo.replicas.checkHealth(interval)
+		go repo.replicas.run(interval, repo.recentWrites.prune)
 	}
 	return repo, nil
 }
 
 func (d *PG) Close() error {
 	d.delayedDeleter.Stop()
+	d.replicas.Close()
 	d.db.Close()
 	return nil
 	//return d.db.Close(context.Background())
 }
 
+// Stop перестает принимать ссылки, дожидается отправленных и удаляет все накопленные.
 func (d *delayedUserUrlsDeleter) Stop() {
-	d.done <- struct{}{}
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.stopped = true
+	d.mu.Unlock()
+
+	d.senders.Wait()
+	close(d.done)
+	d.workers.Wait()
 }
 
 func (d *PG) getOrCreateUser(userUUID string) (userPK int64, err error) {
@@ -99,6 +200,15 @@ func (d *PG) getOrCreateUser(userUUID string) (userPK int64, err error) {
 
 }
 
+// reader выбирает реплику для чтения. Если реплик нет, все нездоровы или данные
+// недавно изменялись (read-your-writes) - возвращает nil, читать нужно из primary.
+func (d *PG) reader(recentlyWritten bool) *pgReplica {
+	if recentlyWritten {
+		return nil
+	}
+	return d.replicas.pick()
+}
+
 func (d *PG) SaveLongURL(long URL, userID string) (URL, error) {
 	shortURL, err := makeShort(long)
 	if err != nil {
@@ -118,6 +228,7 @@ func (d *PG) SaveLongURL(long URL, userID string) (URL, error) {
 	if err != nil {
 		return "", fmt.Errorf("cannot save url to db: %w", err)
 	}
+	d.recentWrites.mark(userID, shortURL)
 	if ct.RowsAffected() < 1 {
 		return shortURL, NewConflictURLError(shortURL, ErrConflictURL)
 	}
@@ -132,7 +243,7 @@ func (d *PG) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]
 		return nil, fmt.Errorf("cannot get or create user: %w", err)
 	}
 
-	result := make([]CorrelationShortPair, 0, len(longURLS))
+	result := make([]CorrelationShortPair, len(longURLS))
 
 	type rowStruct struct {
 		Short  string
@@ -140,21 +251,28 @@ func (d *PG) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]
 		UserPK int64
 	}
 	copyFromRows := make([]rowStruct, 0, len(longURLS))
-	for _, p := range longURLS {
-
+	// first - индекс первой ссылки пачки с этим коротким адресом: только она уходит в базу,
+	// потому что ON CONFLICT DO UPDATE не может менять одну строку дважды
+	first := make(map[URL]int, len(longURLS))
+	for i, p := range longURLS {
 		shortURL, err := makeShort(p.LongURL)
 		if err != nil {
-			log.Printf("cannot generate short url: %v for url: %v", err, p.LongURL)
+			result[i] = batchFailure(p.CorrelationID, BatchError, err)
 			continue
 		}
-
+		result[i] = CorrelationShortPair{CorrelationID: p.CorrelationID, ShortURL: shortURL}
+		if _, dup := first[shortURL]; dup {
+			result[i].Status = BatchConflict
+			continue
+		}
+		first[shortURL] = i
 		copyFromRows = append(copyFromRows, rowStruct{shortURL.S(), p.LongURL.S(), userPK})
-		result = append(result, CorrelationShortPair{p.CorrelationID, shortURL})
 	}
 	tx, err := d.db.Begin(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("cannot begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 	_, err = tx.Exec(ctx, `CREATE TEMP TABLE tmp_table ON COMMIT DROP AS SELECT * FROM "url" WITH NO DATA`)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create temp table: %w", err)
@@ -172,17 +290,58 @@ func (d *PG) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]
 		return nil, fmt.Errorf("cannot insert rows to temp table: %w", err)
 	}
 
-	_, err = tx.Exec(ctx, `INSERT INTO "url" SELECT DISTINCT ON (short) * FROM tmp_table
+	// RETURNING отдает новые строки (xmax = 0) и обновленные строки пользователя,
+	// чужие ссылки не меняются и не возвращаются
+	rows, err := tx.Query(ctx, `INSERT INTO "url" ("short", "long", "user_id", "is_deleted")
+SELECT "short", "long", "user_id", "is_deleted" FROM tmp_table
 ON CONFLICT ("short")
 DO UPDATE SET long = EXCLUDED.long, is_deleted = false
-WHERE url.user_id = EXCLUDED.user_id and url.short = EXCLUDED.short`)
+WHERE url.user_id = EXCLUDED.user_id and url.short = EXCLUDED.short
+RETURNING "short", (xmax = 0)`)
 	if err != nil {
 		return nil, fmt.Errorf("cannot insert rows from temp table: %w", err)
 	}
+	inserted := make(map[URL]bool, len(copyFromRows))
+	for rows.Next() {
+		var short URL
+		var created bool
+		if err = rows.Scan(&short, &created); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot read inserted rows: %w", err)
+		}
+		inserted[short] = created
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot insert rows from temp table: %w", err)
+	}
 
 	if err = tx.Commit(ctx); err != nil {
 		return nil, fmt.Errorf("commit transaction: %w", err)
 	}
+	shorts := make([]URL, 0, len(first))
+	for short, i := range first {
+		// чужие ссылки RETURNING не отдает, свои отдает как обновленные
+		created, returned := inserted[short]
+		switch {
+		case !returned:
+			result[i].Status, result[i].Owner = BatchConflict, OwnerOtherUser
+		case created:
+			result[i].Status = BatchCreated
+		default:
+			result[i].Status, result[i].Owner = BatchConflict, OwnerSameUser
+		}
+		shorts = append(shorts, short)
+	}
+	// повтор ссылки в пачке принадлежит тому же, кому и первая: пользователю, если она создана
+	for i := range result {
+		if j, found := first[result[i].ShortURL]; found && j != i && result[i].Status == BatchConflict {
+			result[i].Owner = result[j].Owner
+			if result[i].Owner == "" {
+				result[i].Owner = OwnerSameUser
+			}
+		}
+	}
+	d.recentWrites.mark(userID, shorts...)
 
 	return result, nil
 }
@@ -190,11 +349,31 @@ WHERE url.user_id = EXCLUDED.user_id and url.short = EXCLUDED.short`)
 func (d *PG) GetLongURL(short URL) (URL, error) {
 	var long URL
 	var isDeleted bool
-	err := d.db.QueryRow(context.Background(),
-		`SELECT long, is_deleted FROM url WHERE short = $1 LIMIT 1`, short).
-		Scan(&long, &isDeleted)
+	query := func(db PgxIface) error {
+		return db.QueryRow(context.Background(),
+			`SELECT long, is_deleted FROM url WHERE short = $1 LIMIT 1`, short).
+			Scan(&long, &isDeleted)
+	}
+
+	var err error
+	if replica := d.reader(d.recentWrites.hasShort(short)); replica != nil {
+		err = query(replica.db)
+		if err != nil && !errors.Is(err, ErrNoRows) {
+			log.Printf("replica %v read error: %v", replica.name, err)
+			replica.setHealthy(false)
+		}
+		// ссылка могла быть создана другим инстансом и еще не доехать до реплики
+		if err != nil {
+			err = query(d.db)
+		}
+	} else {
+		err = query(d.db)
+	}
 	if errors.Is(err, ErrNoRows) {
-		return "", err
+		return "", ErrNotFoundURL
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot get url from db: %w", err)
 	}
 	if isDeleted {
 		return "", ErrDeletedURL
@@ -203,14 +382,28 @@ func (d *PG) GetLongURL(short URL) (URL, error) {
 }
 
 func (d *PG) GetUsersURLs(userID string) []URLPair {
-	rows, err := d.db.Query(context.Background(),
-		`SELECT "long", "short" FROM "url"
+	query := func(db PgxIface) (pgx.Rows, error) {
+		return db.Query(context.Background(),
+			`SELECT "long", "short" FROM "url"
 		JOIN "user" ON "user".id = "url".user_id
 		WHERE "user".uuid = $1`, userID)
+	}
 
+	var rows pgx.Rows
+	var err error
+	if replica := d.reader(d.recentWrites.hasUser(userID)); replica != nil {
+		if rows, err = query(replica.db); err != nil {
+			log.Printf("replica %v read error: %v", replica.name, err)
+			replica.setHealthy(false)
+		}
+	}
+	if rows == nil {
+		rows, err = query(d.db)
+	}
 	if err != nil {
 		return nil
 	}
+	defer rows.Close()
 	var urlPairs []URLPair
 
 	for rows.Next() {
@@ -224,6 +417,275 @@ func (d *PG) GetUsersURLs(userID string) []URLPair {
 	return urlPairs
 }
 
+// pgTags - теги ссылки из link_tag в порядке NormalizeTags.
+const pgTags = `COALESCE((SELECT array_agg(link_tag.tag ORDER BY link_tag.tag) FROM link_tag
+		WHERE link_tag.short = "url".short), '{}')`
+
+// pgDestinationHost - хост ссылки в SQL, как DestinationHost.
+const pgDestinationHost = `lower(substring("url".long from '^[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/?#]*@)?([^:/?#]+)'))`
+
+func (d *PG) ListUserURLs(ctx context.Context, userID string, opts ListOptions) (URLPage, error) {
+	cursor, err := opts.decodeCursor()
+	if err != nil {
+		return URLPage{}, err
+	}
+
+	args := []interface{}{userID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := []string{`"user".uuid = $1`}
+	if opts.Deleted != nil {
+		where = append(where, `COALESCE("url".is_deleted, false) = `+arg(*opts.Deleted))
+	}
+	if opts.Domain != "" {
+		domain := arg(strings.ToLower(opts.Domain))
+		where = append(where, fmt.Sprintf(`(%[1]v = %[2]v OR right(%[1]v, length(%[2]v) + 1) = '.' || %[2]v)`,
+			pgDestinationHost, domain))
+	}
+	if opts.Contains != "" {
+		where = append(where, `strpos(lower("url".long), lower(`+arg(opts.Contains)+`)) > 0`)
+	}
+	if opts.Tag != "" {
+		where = append(where, `EXISTS (SELECT 1 FROM link_tag WHERE link_tag.short = "url".short AND link_tag.tag = `+
+			arg(strings.ToLower(opts.Tag))+`)`)
+	}
+	if opts.Folder != nil {
+		where = append(where, `"url".folder = `+arg(*opts.Folder))
+	}
+
+	cmp, direction := ">", "ASC"
+	if opts.Desc {
+		cmp, direction = "<", "DESC"
+	}
+	orderBy := `"url".short ` + direction
+	if opts.sortField() == SortByCreated {
+		orderBy = `"url".created_at ` + direction + `, ` + orderBy
+		if cursor != nil {
+			where = append(where, `("url".created_at, "url".short) `+cmp+
+				` (`+arg(time.Unix(0, cursor.CreatedAt))+`, `+arg(cursor.Short)+`)`)
+		}
+	} else if cursor != nil {
+		where = append(where, `"url".short `+cmp+` `+arg(cursor.Short))
+	}
+	sql := `SELECT "url".short, "url".long, COALESCE("url".is_deleted, false), "url".created_at,
+		` + pgTags + `, "url".folder, "url".updated_at, "url".title, "url".notes, "url".image_url
+		FROM "url"
+		JOIN "user" ON "user".id = "url".user_id
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY ` + orderBy
+	if opts.Limit > 0 {
+		// одна лишняя строка показывает, что есть следующая страница
+		sql += ` LIMIT ` + strconv.Itoa(opts.Limit+1)
+	}
+
+	rows, err := d.queryUserURLs(ctx, userID, sql, args...)
+	if err != nil {
+		return URLPage{}, fmt.Errorf("cannot get user urls from db: %w", err)
+	}
+	defer rows.Close()
+
+	var records []URLRecord
+	for rows.Next() {
+		record := URLRecord{UserID: userID}
+		if err = rows.Scan(&record.ShortURL, &record.LongURL, &record.Deleted, &record.CreatedAt,
+			&record.Tags, &record.Folder, &record.UpdatedAt, &record.Title, &record.Notes,
+			&record.ImageURL); err != nil {
+			return URLPage{}, fmt.Errorf("cannot get user urls from db: %w", err)
+		}
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		return URLPage{}, fmt.Errorf("cannot get user urls from db: %w", err)
+	}
+	return opts.page(records), nil
+}
+
+// queryUserURLs выполняет запрос по ссылкам пользователя на реплике, если пользователь
+// ничего не менял недавно, иначе (или если реплика не ответила) - на primary.
+func (d *PG) queryUserURLs(ctx context.Context, userID string, sql string, args ...interface{}) (pgx.Rows, error) {
+	if replica := d.reader(d.recentWrites.hasUser(userID)); replica != nil {
+		rows, err := replica.db.Query(ctx, sql, args...)
+		if err == nil {
+			return rows, nil
+		}
+		log.Printf("replica %v read error: %v", replica.name, err)
+		replica.setHealthy(false)
+	}
+	return d.db.Query(ctx, sql, args...)
+}
+
+// pgSearchQuery переводит слова запроса в tsquery: нужны все слова, каждое как префикс.
+// Слова состоят только из букв и цифр, поэтому экранировать нечего.
+func pgSearchQuery(terms []string) string {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		parts = append(parts, term+":*")
+	}
+	return strings.Join(parts, " & ")
+}
+
+func (d *PG) SearchUserURLs(ctx context.Context, userID string, query string, limit int) ([]SearchResult, error) {
+	terms, err := searchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := d.queryUserURLs(ctx, userID,
+		`SELECT "url".short, "url".long, "url".created_at, `+pgTags+`, "url".folder,
+		"url".updated_at, "url".title, "url".notes, "url".image_url, ts_rank("url".search, q)::float8 AS rank
+		FROM "url" JOIN "user" ON "user".id = "url".user_id, to_tsquery('simple', $2) q
+		WHERE "user".uuid = $1 AND NOT COALESCE("url".is_deleted, false) AND "url".search @@ q
+		ORDER BY rank DESC, "url".created_at DESC, "url".short
+		LIMIT $3`, userID, pgSearchQuery(terms), searchLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("cannot search user urls in db: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{URLRecord: URLRecord{UserID: userID}}
+		if err = rows.Scan(&result.ShortURL, &result.LongURL, &result.CreatedAt, &result.Tags, &result.Folder,
+			&result.UpdatedAt, &result.Title, &result.Notes, &result.ImageURL, &result.Rank); err != nil {
+			return nil, fmt.Errorf("cannot search user urls in db: %w", err)
+		}
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot search user urls in db: %w", err)
+	}
+	return results, nil
+}
+
+func (d *PG) GetURLInfo(short URL) (URLRecord, error) {
+	record := URLRecord{ShortURL: short}
+	err := d.db.QueryRow(context.Background(),
+		`SELECT "url".long, COALESCE("user".uuid::text, ''), COALESCE("url".is_deleted, false), "url".created_at,
+		`+pgTags+`, "url".folder, "url".updated_at, "url".title, "url".notes, "url".image_url
+		FROM "url" LEFT JOIN "user" ON "user".id = "url".user_id
+		WHERE "url".short = $1`, short).
+		Scan(&record.LongURL, &record.UserID, &record.Deleted, &record.CreatedAt, &record.Tags, &record.Folder,
+			&record.UpdatedAt, &record.Title, &record.Notes, &record.ImageURL)
+	if errors.Is(err, ErrNoRows) {
+		return URLRecord{}, ErrNotFoundURL
+	}
+	if err != nil {
+		return URLRecord{}, fmt.Errorf("cannot get url from db: %w", err)
+	}
+	return record, nil
+}
+
+func (d *PG) EditUserURL(ctx context.Context, userID string, short URL, edit URLEdit) (URLRecord, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return URLRecord{}, fmt.Errorf("cannot begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// блокировка строки упорядочивает параллельные правки тегов одной ссылки
+	var locked URL
+	err = tx.QueryRow(ctx, `SELECT "url".short FROM "url" JOIN "user" ON "user".id = "url".user_id
+		WHERE "url".short = $1 AND "user".uuid = $2 FOR UPDATE OF "url"`, short, userID).Scan(&locked)
+	if errors.Is(err, ErrNoRows) {
+		return URLRecord{}, ErrNotFoundURL
+	}
+	if err != nil {
+		return URLRecord{}, fmt.Errorf("cannot lock url: %w", err)
+	}
+	// теги лежат в link_tag, поэтому время изменения отмечаем при любой правке
+	args := []interface{}{short}
+	set := []string{`updated_at = now()`}
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"folder", edit.Folder}, {"title", edit.Title}, {"notes", edit.Notes}, {"image_url", edit.ImageURL},
+	} {
+		if field.value != nil {
+			args = append(args, *field.value)
+			set = append(set, field.column+` = $`+strconv.Itoa(len(args)))
+		}
+	}
+	if _, err = tx.Exec(ctx, `UPDATE "url" SET `+strings.Join(set, ", ")+` WHERE short = $1`, args...); err != nil {
+		return URLRecord{}, fmt.Errorf("cannot update url: %w", err)
+	}
+	if edit.Tags != nil {
+		if _, err = tx.Exec(ctx, `DELETE FROM link_tag WHERE short = $1 AND tag <> all($2)`, short, *edit.Tags); err != nil {
+			return URLRecord{}, fmt.Errorf("cannot update tags: %w", err)
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO link_tag (short, tag) SELECT $1, unnest($2::text[])
+			ON CONFLICT DO NOTHING`, short, *edit.Tags)
+		if err != nil {
+			return URLRecord{}, fmt.Errorf("cannot update tags: %w", err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return URLRecord{}, fmt.Errorf("commit transaction: %w", err)
+	}
+	d.recentWrites.mark(userID, short)
+	return d.GetURLInfo(short)
+}
+
+// FillUserURLPreview меняет только пустые поля одним UPDATE; updated_at триггер трогает лишь при удалении.
+func (d *PG) FillUserURLPreview(ctx context.Context, userID string, short URL, title string, imageURL string) error {
+	tag, err := d.db.Exec(ctx, `UPDATE "url" SET
+		title = CASE WHEN "url".title = '' THEN $3 ELSE "url".title END,
+		image_url = CASE WHEN "url".image_url = '' THEN $4 ELSE "url".image_url END
+		FROM "user" WHERE "url".short = $1 AND "user".id = "url".user_id AND "user".uuid = $2`,
+		short, userID, title, imageURL)
+	if err != nil {
+		return fmt.Errorf("cannot fill url preview: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFoundURL
+	}
+	d.recentWrites.mark(userID, short)
+	return nil
+}
+
+// quotaCleanupInterval - как часто удалять счетчики квот прошедших суток.
+const quotaCleanupInterval = time.Hour
+
+// ConsumeDailyQuota увеличивает счетчик одним upsert: при превышении строка не меняется
+// и RETURNING ничего не возвращает.
+func (d *PG) ConsumeDailyQuota(ctx context.Context, key string, day time.Time, n int, limit int) (int, error) {
+	if n > limit {
+		return 0, quotaExceeded(key, n, limit)
+	}
+	var used int
+	err := d.db.QueryRow(ctx, `INSERT INTO quota (key, day, used) VALUES ($1, $2::date, GREATEST($3, 0))
+		ON CONFLICT (key, day) DO UPDATE SET used = GREATEST(quota.used + $3, 0)
+		WHERE $3 <= 0 OR quota.used + $3 <= $4
+		RETURNING used`, key, quotaDay(day), n, limit).Scan(&used)
+	if errors.Is(err, ErrNoRows) {
+		return 0, quotaExceeded(key, n, limit)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot consume quota: %w", err)
+	}
+	d.cleanupQuota(day)
+	return used, nil
+}
+
+// cleanupQuota раз в quotaCleanupInterval удаляет счетчики старше вчерашних суток, как PGRateStore.cleanup.
+// Вчерашние остаются: в них еще возвращают списанное запросы, начатые до полуночи.
+func (d *PG) cleanupQuota(now time.Time) {
+	last := atomic.LoadInt64(&d.lastQuotaCleanup)
+	if now.Sub(time.Unix(last, 0)) < quotaCleanupInterval ||
+		!atomic.CompareAndSwapInt64(&d.lastQuotaCleanup, last, now.Unix()) {
+		return
+	}
+	yesterday := quotaDay(now.AddDate(0, 0, -1))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), quotaCleanupInterval)
+		defer cancel()
+		if _, err := d.db.Exec(ctx, `DELETE FROM quota WHERE day < $1::date`, yesterday); err != nil {
+			log.Println("cannot delete old quotas", err)
+		}
+	}()
+}
+
 func (d *PG) Ping() bool {
 	return d.db.Ping(context.Background()) == nil
 }
@@ -235,27 +697,45 @@ func (d *PG) DeleteUsersURLs(userUUID string, shortUrls ...URL) (err error) {
 	}
 	_, err = d.db.Exec(context.Background(),
 		`UPDATE "url" SET is_deleted = true WHERE short = any($1) and user_id = $2`, shortUrls, userPK)
-	//tag.RowsAffected()
-	return err
+	if err != nil {
+		return err
+	}
+	d.recentWrites.mark(userUUID, shortUrls...)
+	return nil
 }
 
-func (d *delayedUserUrlsDeleter) makeChan(db *PG, userPK int64, userUUID string) chan URL {
-	channel := make(chan URL)
+func (d *PG) RestoreUsersURLs(userUUID string, shortUrls ...URL) error {
+	userPK, err := d.getOrCreateUser(userUUID)
+	if err != nil {
+		return fmt.Errorf("cannot get or create user: %w", err)
+	}
+	_, err = d.db.Exec(context.Background(),
+		`UPDATE "url" SET is_deleted = false WHERE short = any($1) and user_id = $2`, shortUrls, userPK)
+	if err != nil {
+		return err
+	}
+	d.recentWrites.mark(userUUID, shortUrls...)
+	return nil
+}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.userChan[userPK] = channel
+// makeChan запускает горутину, которая копит ссылки пользователя и удаляет их пачками.
+// Вызывается под d.mu. Канал не закрывается: горутина выходит по d.done, удалив то, что успела получить.
+func (d *delayedUserUrlsDeleter) makeChan(db *PG, userUUID string) chan URL {
+	channel := make(chan URL)
 
+	d.workers.Add(1)
 	go func() {
+		defer d.workers.Done()
 		urls := make([]URL, 0, 1000)
 		ticker := time.NewTicker(time.Second * 2)
+		defer ticker.Stop()
 		for {
 			// собираем url из канала и либо, по таймауту либо, по достижении 1000 шт отправляем в базу
 			select {
 			case url := <-channel:
 				urls = append(urls, url)
 				if len(urls) >= 1000 {
-					err := db.DeleteUsersURLs(userUUID, urls...)
+					err := d.flush(db, userUUID, urls)
 					if err != nil {
 						log.Printf("error in delayed delete: %v", err)
 						continue
@@ -267,7 +747,7 @@ func (d *delayedUserUrlsDeleter) makeChan(db *PG, userPK int64, userUUID string)
 					//TODO: можно удалять канал если он долго пустой
 					continue
 				}
-				err := db.DeleteUsersURLs(userUUID, urls...)
+				err := d.flush(db, userUUID, urls)
 				if err != nil {
 					log.Printf("error in delayed delete: %v", err)
 					continue
@@ -275,7 +755,12 @@ func (d *delayedUserUrlsDeleter) makeChan(db *PG, userPK int64, userUUID string)
 				urls = urls[:0]
 
 			case <-d.done:
-				close(channel)
+				// к этому моменту все отправители закончили, других ссылок не будет
+				if len(urls) > 0 {
+					if err := d.flush(db, userUUID, urls); err != nil {
+						log.Printf("error in delayed delete on stop, %v urls lost: %v", len(urls), err)
+					}
+				}
 				return
 			}
 
@@ -285,22 +770,47 @@ func (d *delayedUserUrlsDeleter) makeChan(db *PG, userPK int64, userUUID string)
 	return channel
 }
 
-func (d *delayedUserUrlsDeleter) PostUrlsForDelete(db *PG, userPK int64, userUUID string, shortUrls ...URL) {
-	//проверить есть ли канал для userId если нет - создать
+// flush удаляет накопленные ссылки и сообщает о них onDelete.
+func (d *delayedUserUrlsDeleter) flush(db *PG, userUUID string, urls []URL) error {
+	if err := db.DeleteUsersURLs(userUUID, urls...); err != nil {
+		return err
+	}
 	d.mu.RLock()
-	defer d.mu.RUnlock()
-	channel, found := d.userChan[userPK]
+	hooks := d.onDelete
+	d.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(urls...)
+	}
+	return nil
+}
 
+func (d *delayedUserUrlsDeleter) PostUrlsForDelete(db *PG, userPK int64, userUUID string, shortUrls ...URL) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return ErrClosed
+	}
+	//проверить есть ли канал для userId если нет - создать
+	channel, found := d.userChan[userPK]
 	if !found {
-		d.mu.RUnlock()
-		channel = d.makeChan(db, userPK, userUUID)
-		d.mu.RLock()
+		channel = d.makeChan(db, userUUID)
+		d.userChan[userPK] = channel
 	}
+	d.senders.Add(1)
 	go func() {
+		defer d.senders.Done()
 		for _, url := range shortUrls {
 			channel <- url
 		}
 	}()
+	return nil
+}
+
+// OnDelete добавляет fn, которая вызывается после того, как отложенное удаление применено.
+func (d *PG) OnDelete(fn func(shortUrls ...URL)) {
+	d.delayedDeleter.mu.Lock()
+	defer d.delayedDeleter.mu.Unlock()
+	d.delayedDeleter.onDelete = append(d.delayedDeleter.onDelete, fn)
 }
 
 func (d *PG) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) (err error) {
@@ -308,6 +818,174 @@ func (d *PG) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) (err error)
 	if err != nil {
 		return fmt.Errorf("cannot get or create user: %w", err)
 	}
-	d.delayedDeleter.PostUrlsForDelete(d, userPK, userID, shortUrls...)
+	return d.delayedDeleter.PostUrlsForDelete(d, userPK, userID, shortUrls...)
+}
+
+// pgExportBatch - сколько строк выгрузка читает за один запрос.
+const pgExportBatch = 1000
+
+func (d *PG) ExportURLs(ctx context.Context, fn func(URLRecord) error) error {
+	var after URL
+	for {
+		records, err := d.scanURLs(ctx, after, pgExportBatch)
+		if err != nil {
+			return fmt.Errorf("cannot scan urls: %w", err)
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, rec := range records {
+			if err = fn(rec); err != nil {
+				return err
+			}
+		}
+		after = records[len(records)-1].ShortURL
+	}
+}
+
+// importTags заменяет теги перезаписанных ссылок и добавляет теги сохраненных из tmp_import.
+func importTags(ctx context.Context, tx pgx.Tx, records []URLRecord, applied, overwritten []URL) error {
+	if len(overwritten) > 0 {
+		if _, err := tx.Exec(ctx, `DELETE FROM link_tag WHERE short = any($1)`, overwritten); err != nil {
+			return fmt.Errorf("cannot remove overwritten tags: %w", err)
+		}
+	}
+	hasTags := false
+	for _, rec := range records {
+		hasTags = hasTags || len(rec.Tags) > 0
+	}
+	if !hasTags || len(applied) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `INSERT INTO link_tag (short, tag)
+SELECT DISTINCT tmp_import.short, tag FROM tmp_import, unnest(tmp_import.tags) tag
+WHERE tmp_import.short = any($1)
+ON CONFLICT DO NOTHING`, applied)
+	if err != nil {
+		return fmt.Errorf("cannot insert tags: %w", err)
+	}
 	return nil
 }
+
+// ImportURLs сохраняет пачку одной транзакцией через COPY во временную таблицу,
+// как SaveLongBatchURL. При ConflictFail пачка откатывается целиком.
+func (d *PG) ImportURLs(ctx context.Context, records []URLRecord, policy ConflictPolicy) (ImportResult, error) {
+	var result ImportResult
+	if policy == ConflictFail {
+		// DISTINCT ON ниже молча оставил бы одну запись из повторов
+		if err := repeatedShortError(records); err != nil {
+			return result, err
+		}
+	}
+	userPKs := make(map[string]interface{})
+	for _, rec := range records {
+		if _, found := userPKs[rec.UserID]; found || rec.UserID == "" {
+			continue
+		}
+		userPK, err := d.getOrCreateUser(rec.UserID)
+		if err != nil {
+			return result, fmt.Errorf("cannot get or create user: %w", err)
+		}
+		userPKs[rec.UserID] = userPK
+	}
+
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return result, fmt.Errorf("cannot begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if policy == ConflictFail {
+		shorts := make([]URL, 0, len(records))
+		for _, rec := range records {
+			shorts = append(shorts, rec.ShortURL)
+		}
+		var existing URL
+		err = tx.QueryRow(ctx, `SELECT short FROM "url" WHERE short = any($1) LIMIT 1`, shorts).Scan(&existing)
+		if err == nil {
+			return result, fmt.Errorf("%w: %v", ErrImportConflict, existing)
+		}
+		if !errors.Is(err, ErrNoRows) {
+			return result, fmt.Errorf("cannot check existing urls: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `CREATE TEMP TABLE tmp_import ON COMMIT DROP AS
+SELECT "short", "long", "user_id", "is_deleted", "created_at", "updated_at", "folder", "title", "notes",
+"image_url", NULL::text[] AS "tags" FROM "url" WITH NO DATA`)
+	if err != nil {
+		return result, fmt.Errorf("cannot create temp table: %w", err)
+	}
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{"tmp_import"},
+		[]string{"short", "long", "user_id", "is_deleted", "created_at", "updated_at", "folder", "title", "notes",
+			"image_url", "tags"},
+		pgx.CopyFromSlice(len(records), func(i int) ([]interface{}, error) {
+			rec := records[i]
+			var createdAt, updatedAt interface{}
+			if !rec.CreatedAt.IsZero() {
+				createdAt = rec.CreatedAt
+			}
+			if !rec.UpdatedAt.IsZero() {
+				updatedAt = rec.UpdatedAt
+			}
+			return []interface{}{rec.ShortURL.S(), rec.LongURL.S(), userPKs[rec.UserID], rec.Deleted, createdAt,
+				updatedAt, rec.Folder, rec.Title, rec.Notes, rec.ImageURL, rec.Tags}, nil
+		}),
+	)
+	if err != nil {
+		return result, fmt.Errorf("cannot insert rows to temp table: %w", err)
+	}
+
+	onConflict := `DO NOTHING`
+	if policy == ConflictOverwrite {
+		onConflict = `DO UPDATE SET long = EXCLUDED.long, user_id = EXCLUDED.user_id,
+is_deleted = EXCLUDED.is_deleted, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at,
+folder = EXCLUDED.folder, title = EXCLUDED.title, notes = EXCLUDED.notes,
+image_url = EXCLUDED.image_url`
+	}
+	// xmax = 0 только у только что вставленной строки
+	rows, err := tx.Query(ctx, `INSERT INTO "url" ("short", "long", "user_id", "is_deleted", "created_at", "updated_at",
+"folder", "title", "notes", "image_url")
+SELECT DISTINCT ON (short) "short", "long", "user_id", "is_deleted", COALESCE("created_at", now()),
+COALESCE("updated_at", "created_at", now()), "folder", "title", "notes", "image_url"
+FROM tmp_import
+ON CONFLICT ("short") `+onConflict+`
+RETURNING "short", (xmax = 0)`)
+	if err != nil {
+		return result, fmt.Errorf("cannot insert rows from temp table: %w", err)
+	}
+	var batch ImportResult
+	var applied, overwritten []URL
+	for rows.Next() {
+		var short URL
+		var inserted bool
+		if err = rows.Scan(&short, &inserted); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("cannot insert rows from temp table: %w", err)
+		}
+		applied = append(applied, short)
+		if inserted {
+			batch.Created++
+		} else {
+			batch.Overwritten++
+			overwritten = append(overwritten, short)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return result, fmt.Errorf("cannot insert rows from temp table: %w", err)
+	}
+	if err = importTags(ctx, tx, records, applied, overwritten); err != nil {
+		return result, err
+	}
+	// повторы внутри пачки и существующие ссылки при ConflictSkip
+	batch.Skipped = len(records) - batch.Created - batch.Overwritten
+
+	if err = tx.Commit(ctx); err != nil {
+		return result, fmt.Errorf("commit transaction: %w", err)
+	}
+	result.Add(batch)
+	return result, nil
+}
@@ -1,9 +1,13 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/pashagolub/pgxmock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -105,7 +109,7 @@ func TestPG_GetUsersURLs(t *testing.T) {
 				db: mock,
 			},
 			args: args{userUUID},
-			want: []URLPair{{expectedShortURL, longURL}},
+			want: []URLPair{{ShortURL: expectedShortURL, LongURL: longURL}},
 		},
 	}
 	for _, tt := range tests {
@@ -173,6 +177,8 @@ func TestPG_DelayedDeleteUsersURLs(t *testing.T) {
 				db:             tt.fields.db,
 				delayedDeleter: newDeleteUserUrls(),
 			}
+			deleted := make(chan []URL, 1)
+			d.OnDelete(func(shortUrls ...URL) { deleted <- shortUrls })
 			err := d.DelayedDeleteUsersURLs(tt.args.userID, tt.args.shortUrls...)
 			assert.ErrorIs(t, tt.wantErr, err, "DelayedDeleteUsersURLs(%v, %v)", tt.args.userID, tt.args.shortUrls)
 
@@ -187,6 +193,243 @@ func TestPG_DelayedDeleteUsersURLs(t *testing.T) {
 			if err := mock.ExpectationsWereMet(); err != nil {
 				t.Errorf("there were unfulfilled expectations: %s", err)
 			}
+			select {
+			case shortUrls := <-deleted:
+				assert.Equal(t, tt.args.shortUrls, shortUrls)
+			case <-time.After(time.Second):
+				t.Error("OnDelete was not called")
+			}
+		})
+	}
+}
+
+func TestPG_DelayedDeleteStop(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	userUUID := "882de4ff-11d0-48ea-9674-7ac516c89baa"
+	expectUser := func() {
+		mock.ExpectQuery(`SELECT id FROM \"user\" WHERE \"uuid\"\=\$1 LIMIT 1`).
+			WithArgs(userUUID).
+			WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int64(123)))
+	}
+	expectUser()
+	expectUser()
+	mock.ExpectExec(`UPDATE "url" SET is_deleted = true WHERE short = any\(\$1\) and user_id = \$2`).
+		WithArgs([]URL{"6db64c5d", "6db64c5e"}, int64(123)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+
+	d := &PG{db: mock, delayedDeleter: newDeleteUserUrls()}
+	require.NoError(t, d.DelayedDeleteUsersURLs(userUUID, "6db64c5d", "6db64c5e"))
+	// остановка удаляет накопленное, не дожидаясь таймера
+	d.delayedDeleter.Stop()
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	expectUser()
+	assert.ErrorIs(t, d.DelayedDeleteUsersURLs(userUUID, "6db64c5f"), ErrClosed)
+	d.delayedDeleter.Stop()
+}
+
+func TestPG_DeleteRestoreUsersURLs_RecentWrites(t *testing.T) {
+	userUUID := "882de4ff-11d0-48ea-9674-7ac516c89baa"
+	userPK := int64(123)
+	shortURL := URL("6db64c5d")
+
+	tests := []struct {
+		name     string
+		deleted  bool
+		execErr  error
+		wantMark bool
+	}{
+		{name: "Test #1 delete marks url", deleted: true, wantMark: true},
+		{name: "Test #2 failed delete does not mark url", deleted: true, execErr: errors.New("connection lost")},
+		{name: "Test #3 restore marks url", wantMark: true},
+		{name: "Test #4 failed restore does not mark url", execErr: errors.New("connection lost")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			require.NoError(t, err)
+			defer mock.Close()
+
+			mock.ExpectQuery(`SELECT id FROM \"user\" WHERE \"uuid\"\=\$1 LIMIT 1`).WithArgs(userUUID).
+				WillReturnRows(mock.NewRows([]string{"id"}).AddRow(userPK))
+			exec := mock.ExpectExec(`UPDATE "url" SET is_deleted = `+strconv.FormatBool(tt.deleted)).
+				WithArgs([]URL{shortURL}, userPK)
+			if tt.execErr != nil {
+				exec.WillReturnError(tt.execErr)
+			} else {
+				exec.WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			}
+
+			d := &PG{db: mock, recentWrites: newRecentWrites(time.Minute)}
+			if tt.deleted {
+				err = d.DeleteUsersURLs(userUUID, shortURL)
+			} else {
+				err = d.RestoreUsersURLs(userUUID, shortURL)
+			}
+			assert.ErrorIs(t, err, tt.execErr)
+			assert.Equal(t, tt.wantMark, d.recentWrites.hasShort(shortURL))
+			assert.Equal(t, tt.wantMark, d.recentWrites.hasUser(userUUID))
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPG_GetLongURL_Replicas(t *testing.T) {
+	primary, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	replica, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	longURL := URL("long_url")
+	shortURL := URL("6db64c5d")
+	selectLong := `SELECT long, is_deleted FROM url WHERE short = \$1 LIMIT 1`
+
+	tests := []struct {
+		name    string
+		prepare func(d *PG, r *pgReplica)
+	}{
+		{
+			name: "Test #1 read goes to replica",
+			prepare: func(d *PG, r *pgReplica) {
+				replica.ExpectQuery(selectLong).WithArgs(shortURL).
+					WillReturnRows(replica.NewRows([]string{"long", "is_deleted"}).AddRow(longURL, false))
+			},
+		},
+		{
+			name: "Test #2 recently written url is read from primary",
+			prepare: func(d *PG, r *pgReplica) {
+				d.recentWrites.mark("some_user", shortURL)
+				primary.ExpectQuery(selectLong).WithArgs(shortURL).
+					WillReturnRows(primary.NewRows([]string{"long", "is_deleted"}).AddRow(longURL, false))
+			},
+		},
+		{
+			name: "Test #3 unhealthy replica is skipped",
+			prepare: func(d *PG, r *pgReplica) {
+				r.setHealthy(false)
+				primary.ExpectQuery(selectLong).WithArgs(shortURL).
+					WillReturnRows(primary.NewRows([]string{"long", "is_deleted"}).AddRow(longURL, false))
+			},
+		},
+		{
+			name: "Test #4 not yet replicated url is read from primary",
+			prepare: func(d *PG, r *pgReplica) {
+				replica.ExpectQuery(selectLong).WithArgs(shortURL).
+					WillReturnError(ErrNoRows)
+				primary.ExpectQuery(selectLong).WithArgs(shortURL).
+					WillReturnRows(primary.NewRows([]string{"long", "is_deleted"}).AddRow(longURL, false))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &pgReplica{db: replica, name: "#0", healthy: 1}
+			d := &PG{
+				db:           primary,
+				replicas:     newReplicaSet(r),
+				recentWrites: newRecentWrites(time.Minute),
+			}
+			tt.prepare(d, r)
+
+			got, err := d.GetLongURL(shortURL)
+			assert.NoError(t, err)
+			assert.Equal(t, longURL, got)
+			assert.NoError(t, primary.ExpectationsWereMet())
+			assert.NoError(t, replica.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPG_ImportURLs(t *testing.T) {
+	userUUID := "882de4ff-11d0-48ea-9674-7ac516c89baa"
+	records := []URLRecord{
+		{ShortURL: "s1", LongURL: "https://ya.ru/1", UserID: userUUID},
+		{ShortURL: "s2", LongURL: "https://ya.ru/2", UserID: userUUID},
+		{ShortURL: "s2", LongURL: "https://ya.ru/2", UserID: userUUID},
+	}
+	tests := []struct {
+		name    string
+		policy  ConflictPolicy
+		records []URLRecord
+		prepare func(mock pgxmock.PgxPoolIface)
+		want    ImportResult
+		wantErr error
+	}{
+		{
+			name:   "Test #1 skip counts existing and repeated rows as skipped",
+			policy: ConflictSkip,
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectExec(`CREATE TEMP TABLE tmp_import`).WillReturnResult(pgxmock.NewResult("CREATE", 0))
+				mock.ExpectCopyFrom(`"tmp_import"`, []string{"short", "long", "user_id", "is_deleted", "created_at", "updated_at",
+					"folder", "title", "notes", "image_url", "tags"}).
+					WillReturnResult(3)
+				mock.ExpectQuery(`INSERT INTO "url" (.*) ON CONFLICT \("short"\) DO NOTHING RETURNING "short", \(xmax = 0\)`).
+					WillReturnRows(mock.NewRows([]string{"short", "inserted"}).AddRow(URL("s1"), true))
+				mock.ExpectCommit()
+			},
+			want: ImportResult{Created: 1, Skipped: 2},
+		},
+		{
+			name:   "Test #2 overwrite",
+			policy: ConflictOverwrite,
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectExec(`CREATE TEMP TABLE tmp_import`).WillReturnResult(pgxmock.NewResult("CREATE", 0))
+				mock.ExpectCopyFrom(`"tmp_import"`, []string{"short", "long", "user_id", "is_deleted", "created_at", "updated_at",
+					"folder", "title", "notes", "image_url", "tags"}).
+					WillReturnResult(3)
+				mock.ExpectQuery(`INSERT INTO "url" (.*) ON CONFLICT \("short"\) DO UPDATE SET (.*) RETURNING "short", \(xmax = 0\)`).
+					WillReturnRows(mock.NewRows([]string{"short", "inserted"}).AddRow(URL("s1"), false).AddRow(URL("s2"), true))
+				mock.ExpectExec(`DELETE FROM link_tag WHERE short = any\(\$1\)`).WithArgs([]URL{"s1"}).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mock.ExpectCommit()
+			},
+			want: ImportResult{Created: 1, Overwritten: 1, Skipped: 1},
+		},
+		{
+			name:    "Test #3 fail rolls back without writing",
+			policy:  ConflictFail,
+			records: records[:2],
+			prepare: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery(`SELECT short FROM "url" WHERE short = any\(\$1\) LIMIT 1`).
+					WillReturnRows(mock.NewRows([]string{"short"}).AddRow(URL("s2")))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrImportConflict,
+		},
+		{
+			name:    "Test #4 fail on code repeated in batch without queries",
+			policy:  ConflictFail,
+			wantErr: ErrImportConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer mock.Close()
+			if tt.prepare != nil {
+				mock.ExpectQuery(`SELECT id FROM \"user\" WHERE \"uuid\"\=\$1 LIMIT 1`).
+					WithArgs(userUUID).
+					WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int64(123)))
+				mock.ExpectBegin()
+				tt.prepare(mock)
+			}
+			if tt.records == nil {
+				tt.records = records
+			}
+
+			d := &PG{db: mock}
+			got, err := d.ImportURLs(context.Background(), tt.records, tt.policy)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
 }
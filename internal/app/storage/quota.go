@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+// quotaDay - сутки счетчика квоты, всегда по UTC.
+func quotaDay(day time.Time) string {
+	return day.UTC().Format("2006-01-02")
+}
+
+func quotaExceeded(key string, n int, limit int) error {
+	return fmt.Errorf("%w: %v cannot add %v over %v per day", ErrQuotaExceeded, key, n, limit)
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func testConsumeDailyQuota(t *testing.T, d Repository) {
+	ctx := context.Background()
+	day := time.Date(2022, 5, 1, 23, 0, 0, 0, time.UTC)
+
+	used, err := d.ConsumeDailyQuota(ctx, "user:u1", day, 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 2, used)
+	_, err = d.ConsumeDailyQuota(ctx, "user:u1", day, 2, 3)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	used, err = d.ConsumeDailyQuota(ctx, "user:u1", day, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, used)
+	// у другого ключа свой счетчик
+	used, err = d.ConsumeDailyQuota(ctx, "ip:127.0.0.1", day, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 1, used)
+	// в следующие сутки по UTC счет заново
+	used, err = d.ConsumeDailyQuota(ctx, "user:u1", day.Add(2*time.Hour), 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 1, used)
+	// возврат не проверяется по квоте и не опускает счетчик ниже нуля
+	used, err = d.ConsumeDailyQuota(ctx, "user:u1", day.Add(2*time.Hour), -5, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, used)
+}
+
+func TestMemoryMap_ConsumeDailyQuota(t *testing.T) {
+	testConsumeDailyQuota(t, NewMemoryMap())
+}
+
+func TestRedis_ConsumeDailyQuota(t *testing.T) {
+	d, mr := newTestRedis(t, 0)
+	testConsumeDailyQuota(t, d)
+	assert.True(t, mr.Exists("test:quota:2022-05-01:user:u1"))
+	assert.Equal(t, 48*time.Hour, mr.TTL("test:quota:2022-05-01:user:u1"))
+}
+
+func TestPG_ConsumeDailyQuota(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	day := time.Date(2022, 5, 1, 23, 0, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+	query := `INSERT INTO quota (.+) ON CONFLICT \(key, day\) DO UPDATE SET used = GREATEST\(quota.used \+ \$3, 0\)\s+` +
+		`WHERE \$3 <= 0 OR quota.used \+ \$3 <= \$4\s+RETURNING used`
+	mock.ExpectQuery(query).WithArgs("user:u1", "2022-05-01", 2, 3).
+		WillReturnRows(mock.NewRows([]string{"used"}).AddRow(2))
+	mock.ExpectQuery(query).WithArgs("user:u1", "2022-05-01", 2, 3).
+		WillReturnError(ErrNoRows)
+
+	mock.ExpectQuery(query).WithArgs("user:u1", "2022-05-01", -2, 3).
+		WillReturnRows(mock.NewRows([]string{"used"}).AddRow(0))
+
+	d := &PG{db: mock, lastQuotaCleanup: day.Unix()}
+	used, err := d.ConsumeDailyQuota(context.Background(), "user:u1", day, 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 2, used)
+	_, err = d.ConsumeDailyQuota(context.Background(), "user:u1", day, 2, 3)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	// больше квоты сразу - без запроса
+	_, err = d.ConsumeDailyQuota(context.Background(), "user:u1", day, 4, 3)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	// возврат списанного
+	used, err = d.ConsumeDailyQuota(context.Background(), "user:u1", day, -2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 0, used)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPG_CleanupQuota(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	now := time.Date(2022, 5, 3, 0, 30, 0, 0, time.UTC)
+	mock.ExpectExec(`DELETE FROM quota WHERE day < \$1::date`).WithArgs("2022-05-02").
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+
+	d := &PG{db: mock}
+	d.cleanupQuota(now)
+	// второй вызов в том же интервале ничего не удаляет
+	d.cleanupQuota(now.Add(time.Minute))
+	assert.Eventually(t, func() bool { return mock.ExpectationsWereMet() == nil }, time.Second, 10*time.Millisecond)
+}
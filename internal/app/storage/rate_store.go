@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"go-url-shortener/internal/app/ratelimit"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRateStoreTimeout - сколько ждать postgres, прежде чем пропустить запрос без лимита.
+	DefaultRateStoreTimeout = 200 * time.Millisecond
+	// rateCleanupInterval - как часто удалять истекшие окна.
+	rateCleanupInterval = time.Minute
+)
+
+// PGRateStore - ratelimit.Store в postgres, общий для всех инстансов сервиса.
+// Счет идет в окнах длиной rate.Per: одно атомарное upsert на запрос, без блокировок.
+// На границе окон можно успеть сделать до 2N запросов - это цена одного запроса к базе.
+type PGRateStore struct {
+	db      PgxIface
+	timeout time.Duration
+	// lastCleanup - unix-время последней очистки, меняется через atomic.
+	lastCleanup int64
+}
+
+// NewPGRateStore подключается к postgres и готовит схему, как NewPG.
+func NewPGRateStore(dsn string, opts PGOptions) (*PGRateStore, error) {
+	ctx := context.Background()
+	conn, err := connectPool(ctx, dsn, opts.MaxConns)
+	if err != nil {
+		return nil, err
+	}
+	if err = migrateSchema(ctx, conn, opts.MigrateMode); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &PGRateStore{db: conn, timeout: DefaultRateStoreTimeout}, nil
+}
+
+func (s *PGRateStore) Take(ctx context.Context, key string, rate ratelimit.Rate, now time.Time) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	windowStart := now.Truncate(rate.Per)
+	windowEnd := windowStart.Add(rate.Per)
+	var hits int
+	err := s.db.QueryRow(ctx, `INSERT INTO rate_limit (key, window_start, hits, expires_at) VALUES ($1, $2, 1, $3)
+		ON CONFLICT (key, window_start) DO UPDATE SET hits = rate_limit.hits + 1
+		RETURNING hits`, key, windowStart, windowEnd).Scan(&hits)
+	if err != nil {
+		return false, 0, fmt.Errorf("cannot count request: %w", err)
+	}
+	s.cleanup(now)
+	if hits > rate.N {
+		return false, windowEnd.Sub(now), nil
+	}
+	return true, 0, nil
+}
+
+// cleanup раз в rateCleanupInterval удаляет истекшие окна. Удаляет один запрос инстанса,
+// остальные в это время не ждут.
+func (s *PGRateStore) cleanup(now time.Time) {
+	last := atomic.LoadInt64(&s.lastCleanup)
+	if now.Sub(time.Unix(last, 0)) < rateCleanupInterval ||
+		!atomic.CompareAndSwapInt64(&s.lastCleanup, last, now.Unix()) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), rateCleanupInterval)
+		defer cancel()
+		if _, err := s.db.Exec(ctx, `DELETE FROM rate_limit WHERE expires_at < $1`, now); err != nil {
+			log.Println("cannot delete expired rate limits", err)
+		}
+	}()
+}
+
+func (s *PGRateStore) Close() {
+	s.db.Close()
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-url-shortener/internal/app/ratelimit"
+	"testing"
+	"time"
+)
+
+func TestPGRateStore_Take(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	rate := ratelimit.Rate{N: 2, Per: time.Minute}
+	now := time.Date(2022, 5, 1, 12, 0, 45, 0, time.UTC)
+	windowStart := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	query := `INSERT INTO rate_limit (.+) ON CONFLICT \(key, window_start\) DO UPDATE SET hits = rate_limit.hits \+ 1\s+RETURNING hits`
+	for _, hits := range []int{2, 3} {
+		mock.ExpectQuery(query).WithArgs("shorten:ip:10.0.0.1", windowStart, windowStart.Add(time.Minute)).
+			WillReturnRows(mock.NewRows([]string{"hits"}).AddRow(hits))
+	}
+	mock.ExpectQuery(query).WillReturnError(errors.New("connection refused"))
+
+	// очистка уже была, в тесте не запускается
+	s := &PGRateStore{db: mock, timeout: time.Second, lastCleanup: now.Unix()}
+	ok, _, err := s.Take(context.Background(), "shorten:ip:10.0.0.1", rate, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, wait, err := s.Take(context.Background(), "shorten:ip:10.0.0.1", rate, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 15*time.Second, wait)
+	_, _, err = s.Take(context.Background(), "shorten:ip:10.0.0.1", rate, now)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPGRateStore_Cleanup(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectExec(`DELETE FROM rate_limit WHERE expires_at < \$1`).WithArgs(now).
+		WillReturnResult(pgxmock.NewResult("DELETE", 3))
+
+	s := &PGRateStore{db: mock, timeout: time.Second}
+	s.cleanup(now)
+	// второй вызов в том же интервале ничего не удаляет
+	s.cleanup(now.Add(time.Second))
+	assert.Eventually(t, func() bool { return mock.ExpectationsWereMet() == nil }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newTestRedis(t *testing.T, ttl time.Duration) (*Redis, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	d := newRedisWithClient(client, "test:", ttl)
+	t.Cleanup(func() { d.Close() })
+	return d, mr
+}
+
+func TestRedis_SaveLongURL(t *testing.T) {
+	userUUID := "882de4ff-11d0-48ea-9674-7ac516c89baa"
+	longURL := URL("long_url")
+	expectedShortURL := URL("6db64c5d")
+
+	tests := []struct {
+		name    string
+		prepare func(d *Redis)
+		userID  string
+		want    URL
+		wantErr error
+	}{
+		{
+			name:   "Test #1 Success post long and get short",
+			userID: userUUID,
+			want:   expectedShortURL,
+		},
+		{
+			name: "Test #2 Conflict with existing url",
+			prepare: func(d *Redis) {
+				_, err := d.SaveLongURL(longURL, "another-user")
+				require.NoError(t, err)
+			},
+			userID:  userUUID,
+			want:    expectedShortURL,
+			wantErr: ErrConflictURL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, mr := newTestRedis(t, 0)
+			if tt.prepare != nil {
+				tt.prepare(d)
+			}
+
+			got, err := d.SaveLongURL(longURL, tt.userID)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == nil {
+				assert.True(t, mr.Exists("test:url:"+expectedShortURL.S()))
+				members, err := mr.Members("test:user:" + tt.userID)
+				require.NoError(t, err)
+				assert.Equal(t, []string{expectedShortURL.S()}, members)
+			}
+		})
+	}
+}
+
+func TestRedis_GetLongURL(t *testing.T) {
+	d, mr := newTestRedis(t, time.Hour)
+	userUUID := "882de4ff-11d0-48ea-9674-7ac516c89baa"
+
+	short, err := d.SaveLongURL("https://ya.ru", userUUID)
+	require.NoError(t, err)
+
+	long, err := d.GetLongURL(short)
+	assert.NoError(t, err)
+	assert.Equal(t, URL("https://ya.ru"), long)
+
+	_, err = d.GetLongURL("unknown")
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+
+	require.NoError(t, d.DeleteUsersURLs("another-user", short))
+	_, err = d.GetLongURL(short)
+	assert.NoError(t, err, "url of another user must not be deleted")
+
+	require.NoError(t, d.DeleteUsersURLs(userUUID, short))
+	_, err = d.GetLongURL(short)
+	assert.ErrorIs(t, err, ErrDeletedURL)
+
+	mr.FastForward(2 * time.Hour)
+	_, err = d.GetLongURL(short)
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+	assert.Empty(t, d.GetUsersURLs(userUUID))
+}
+
+func TestRedis_SaveLongBatchURL(t *testing.T) {
+	d, _ := newTestRedis(t, 0)
+	userUUID := "370230df-159e-4aec-9f18-922f9c0be328"
+
+	got, err := d.SaveLongBatchURL([]CorrelationLongPair{
+		{CorrelationID: "1", LongURL: "https://ya.ru/1123333"},
+		{CorrelationID: "2", LongURL: "https://ya.ru/1123"},
+	}, userUUID)
+	require.NoError(t, err)
+	assert.Equal(t, []CorrelationShortPair{
+		{CorrelationID: "1", ShortURL: "ac5a78ac", Status: BatchCreated},
+		{CorrelationID: "2", ShortURL: "b3f51159", Status: BatchCreated},
+	}, got)
+
+	assert.ElementsMatch(t, []URLPair{
+		{ShortURL: "ac5a78ac", LongURL: "https://ya.ru/1123333"},
+		{ShortURL: "b3f51159", LongURL: "https://ya.ru/1123"},
+	}, d.GetUsersURLs(userUUID))
+
+	// повторная пачка восстанавливает удаленные ссылки пользователя
+	require.NoError(t, d.DeleteUsersURLs(userUUID, "ac5a78ac"))
+	got, err = d.SaveLongBatchURL([]CorrelationLongPair{
+		{CorrelationID: "1", LongURL: "https://ya.ru/1123333"},
+		{CorrelationID: "3", LongURL: "https://ya.ru/1123333"},
+	}, userUUID)
+	require.NoError(t, err)
+	assert.Equal(t, []CorrelationShortPair{
+		{CorrelationID: "1", ShortURL: "ac5a78ac", Status: BatchConflict, Owner: OwnerSameUser},
+		{CorrelationID: "3", ShortURL: "ac5a78ac", Status: BatchConflict, Owner: OwnerSameUser},
+	}, got)
+	long, err := d.GetLongURL("ac5a78ac")
+	assert.NoError(t, err)
+	assert.Equal(t, URL("https://ya.ru/1123333"), long)
+}
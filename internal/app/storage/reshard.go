@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// scanURLs возвращает до limit записей с короткой ссылкой больше after, упорядоченных по ней.
+func (d *PG) scanURLs(ctx context.Context, after URL, limit int) ([]URLRecord, error) {
+	return d.queryURLs(ctx, `WHERE "url".short > $1 ORDER BY "url".short LIMIT $2`, after, limit)
+}
+
+// urlsByShort - записи с перечисленными короткими ссылками, какие есть.
+func (d *PG) urlsByShort(ctx context.Context, shortUrls []URL) (map[URL]URLRecord, error) {
+	records, err := d.queryURLs(ctx, `WHERE "url".short = any($1)`, shortUrls)
+	if err != nil {
+		return nil, err
+	}
+	byShort := make(map[URL]URLRecord, len(records))
+	for _, rec := range records {
+		byShort[rec.ShortURL] = rec
+	}
+	return byShort, nil
+}
+
+func (d *PG) queryURLs(ctx context.Context, where string, args ...interface{}) ([]URLRecord, error) {
+	rows, err := d.db.Query(ctx,
+		`SELECT "url".short, "url".long, COALESCE("user".uuid::text, ''), COALESCE("url".is_deleted, false),
+		"url".created_at, `+pgTags+`, "url".folder, "url".updated_at, "url".title, "url".notes, "url".image_url
+		FROM "url" LEFT JOIN "user" ON "user".id = "url".user_id
+		`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []URLRecord
+	for rows.Next() {
+		var rec URLRecord
+		if err = rows.Scan(&rec.ShortURL, &rec.LongURL, &rec.UserID, &rec.Deleted, &rec.CreatedAt,
+			&rec.Tags, &rec.Folder, &rec.UpdatedAt, &rec.Title, &rec.Notes, &rec.ImageURL); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (d *PG) removeURLs(ctx context.Context, shortUrls []URL) error {
+	_, err := d.db.Exec(ctx, `DELETE FROM "url" WHERE short = any($1)`, shortUrls)
+	return err
+}
+
+// Reshard переносит строки между шардами так, чтобы каждая ссылка лежала
+// в шарде, который ей назначает кольцо из всех переданных шардов.
+// Запускается после добавления шарда в конфигурацию; повторный запуск безопасен.
+// Из исходного шарда удаляются только строки, лежащие в целевом так же; если там
+// под тем же кодом другая ссылка, владелец или удаленность - перенос останавливается
+// с ErrImportConflict и списком кодов, исходные строки остаются на месте.
+func Reshard(ctx context.Context, shards map[string]*PG, batchSize int) (moved int, err error) {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	ring := newHashRing(names...)
+
+	for name, source := range shards {
+		var after URL
+		for {
+			records, err := source.scanURLs(ctx, after, batchSize)
+			if err != nil {
+				return moved, fmt.Errorf("shard %v: cannot scan urls: %w", name, err)
+			}
+			if len(records) == 0 {
+				break
+			}
+			after = records[len(records)-1].ShortURL
+
+			misplaced := make(map[string][]URLRecord)
+			for _, rec := range records {
+				if target := ring.get(rec.ShortURL); target != name {
+					misplaced[target] = append(misplaced[target], rec)
+				}
+			}
+			for target, recs := range misplaced {
+				if _, err = shards[target].ImportURLs(ctx, recs, ConflictSkip); err != nil {
+					return moved, fmt.Errorf("shard %v: %w", target, err)
+				}
+				// пропущенная при импорте строка могла остаться чужой - такую удалять нельзя
+				stored, err := shards[target].urlsByShort(ctx, shortsOf(recs))
+				if err != nil {
+					return moved, fmt.Errorf("shard %v: cannot read imported urls: %w", target, err)
+				}
+				shorts, conflicts := splitMoved(recs, stored)
+				if len(shorts) > 0 {
+					if err = source.removeURLs(ctx, shorts); err != nil {
+						return moved, fmt.Errorf("shard %v: cannot remove moved urls: %w", name, err)
+					}
+					moved += len(shorts)
+					log.Printf("moved %v urls from shard %v to %v", len(shorts), name, target)
+				}
+				if len(conflicts) > 0 {
+					return moved, fmt.Errorf("shard %v: %w: %v already stored differently, left in shard %v",
+						target, ErrImportConflict, conflicts, name)
+				}
+			}
+		}
+	}
+	return moved, nil
+}
+
+func shortsOf(records []URLRecord) []URL {
+	shorts := make([]URL, 0, len(records))
+	for _, rec := range records {
+		shorts = append(shorts, rec.ShortURL)
+	}
+	return shorts
+}
+
+// splitMoved делит перенесенные записи на те, что лежат в целевом шарде так же,
+// как в исходном (владелец, ссылка, удаленность), и конфликтующие.
+func splitMoved(records []URLRecord, stored map[URL]URLRecord) (moved []URL, conflicts []URL) {
+	for _, rec := range records {
+		got, found := stored[rec.ShortURL]
+		if found && got.UserID == rec.UserID && got.LongURL == rec.LongURL && got.Deleted == rec.Deleted {
+			moved = append(moved, rec.ShortURL)
+		} else {
+			conflicts = append(conflicts, rec.ShortURL)
+		}
+	}
+	return moved, conflicts
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitMoved(t *testing.T) {
+	records := []URLRecord{
+		{ShortURL: "s1", LongURL: "https://ya.ru/1", UserID: "u1"},
+		{ShortURL: "s2", LongURL: "https://ya.ru/2", UserID: "u1", Deleted: true},
+	}
+	tests := []struct {
+		name          string
+		stored        map[URL]URLRecord
+		wantMoved     []URL
+		wantConflicts []URL
+	}{
+		{
+			name: "Test #1 same rows are moved",
+			stored: map[URL]URLRecord{
+				"s1": {ShortURL: "s1", LongURL: "https://ya.ru/1", UserID: "u1", Title: "edited"},
+				"s2": records[1],
+			},
+			wantMoved: []URL{"s1", "s2"},
+		},
+		{
+			name: "Test #2 other owner is a conflict",
+			stored: map[URL]URLRecord{
+				"s1": {ShortURL: "s1", LongURL: "https://ya.ru/1", UserID: "u2"},
+				"s2": records[1],
+			},
+			wantMoved:     []URL{"s2"},
+			wantConflicts: []URL{"s1"},
+		},
+		{
+			name: "Test #3 other long url or deleted state is a conflict",
+			stored: map[URL]URLRecord{
+				"s1": {ShortURL: "s1", LongURL: "https://ya.ru/other", UserID: "u1"},
+				"s2": {ShortURL: "s2", LongURL: "https://ya.ru/2", UserID: "u1"},
+			},
+			wantConflicts: []URL{"s1", "s2"},
+		},
+		{
+			name:          "Test #4 missing row is a conflict",
+			stored:        map[URL]URLRecord{"s2": records[1]},
+			wantMoved:     []URL{"s2"},
+			wantConflicts: []URL{"s1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moved, conflicts := splitMoved(records, tt.stored)
+			assert.Equal(t, tt.wantMoved, moved)
+			assert.Equal(t, tt.wantConflicts, conflicts)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DefaultSearchLimit - сколько результатов поиска возвращать, если limit не задан.
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+)
+
+var ErrEmptyQuery = errors.New("empty search query")
+
+// SearchResult - найденная ссылка и ее релевантность: чем больше Rank, тем выше в выдаче.
+type SearchResult struct {
+	URLRecord
+	Rank float64
+}
+
+// SearchTerms разбивает текст на слова в нижнем регистре: буквы и цифры,
+// остальное - разделители. Так же разбивает текст postgres (см. url_search_document).
+func SearchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchQuery - слова запроса без повторов. Пустой запрос - ErrEmptyQuery.
+func searchQuery(query string) ([]string, error) {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, term := range SearchTerms(query) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	return terms, nil
+}
+
+func searchLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		return MaxSearchLimit
+	}
+	return limit
+}
+
+// searchTagWeight - во сколько раз слово тега или заголовка важнее слова ссылки или заметки.
+const searchTagWeight = 2
+
+// searchDocument - веса слов ссылки: частота слова, нормированная на длину текста,
+// слова тегов и заголовка - с весом searchTagWeight.
+func searchDocument(rec URLRecord) map[string]float64 {
+	terms := SearchTerms(rec.LongURL.S() + " " + rec.Notes)
+	tagTerms := SearchTerms(strings.Join(rec.Tags, " ") + " " + rec.Title)
+	doc := make(map[string]float64, len(terms)+len(tagTerms))
+	norm := 1 / math.Sqrt(float64(len(terms)+len(tagTerms)))
+	for _, term := range terms {
+		doc[term] += norm
+	}
+	for _, term := range tagTerms {
+		doc[term] += searchTagWeight * norm
+	}
+	return doc
+}
+
+// searchIndex - обратный индекс: слово -> ссылки с весом слова в них.
+type searchIndex struct {
+	postings map[string]map[URL]float64
+	// docs - слова каждой ссылки, чтобы убрать их из postings при изменении
+	docs map[URL][]string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[URL]float64),
+		docs:     make(map[URL][]string),
+	}
+}
+
+// put индексирует запись заново.
+func (ix *searchIndex) put(rec URLRecord) {
+	ix.remove(rec.ShortURL)
+	doc := searchDocument(rec)
+	terms := make([]string, 0, len(doc))
+	for term, weight := range doc {
+		posting, found := ix.postings[term]
+		if !found {
+			posting = make(map[URL]float64)
+			ix.postings[term] = posting
+		}
+		posting[rec.ShortURL] = weight
+		terms = append(terms, term)
+	}
+	ix.docs[rec.ShortURL] = terms
+}
+
+func (ix *searchIndex) remove(short URL) {
+	for _, term := range ix.docs[short] {
+		delete(ix.postings[term], short)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	delete(ix.docs, short)
+}
+
+// search возвращает релевантность ссылок, в которых есть все слова запроса.
+// Слово запроса совпадает со словами ссылки, которые с него начинаются, как prefix:* в postgres.
+func (ix *searchIndex) search(terms []string) map[URL]float64 {
+	var scores map[URL]float64
+	total := float64(len(ix.docs))
+	for _, queryTerm := range terms {
+		matched := make(map[URL]float64)
+		for term, posting := range ix.postings {
+			if !strings.HasPrefix(term, queryTerm) {
+				continue
+			}
+			// редкие слова важнее частых
+			idf := math.Log(1 + total/float64(len(posting)))
+			for short, weight := range posting {
+				matched[short] += weight * idf
+			}
+		}
+		if scores == nil {
+			scores = matched
+		} else {
+			for short, score := range scores {
+				if m, found := matched[short]; found {
+					scores[short] = score + m
+				} else {
+					delete(scores, short)
+				}
+			}
+		}
+		if len(scores) == 0 {
+			return nil
+		}
+	}
+	return scores
+}
+
+// sortSearchResults упорядочивает результаты по убыванию релевантности,
+// при равной - сначала новые, и обрезает до limit.
+func sortSearchResults(results []SearchResult, limit int) []SearchResult {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ShortURL < b.ShortURL
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// searchRecords ищет среди уже загруженных записей:
+// для хранилищ, которые не держат индекс сами.
+func searchRecords(records []URLRecord, query string, limit int) ([]SearchResult, error) {
+	terms, err := searchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	ix := newSearchIndex()
+	byShort := make(map[URL]URLRecord, len(records))
+	for _, rec := range records {
+		if rec.Deleted {
+			continue
+		}
+		ix.put(rec)
+		byShort[rec.ShortURL] = rec
+	}
+	var results []SearchResult
+	for short, rank := range ix.search(terms) {
+		results = append(results, SearchResult{URLRecord: byShort[short], Rank: rank})
+	}
+	return sortSearchResults(results, searchLimit(limit)), nil
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"github.com/pashagolub/pgxmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func searchTestRecords(userID string) []URLRecord {
+	base := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	return []URLRecord{
+		{ShortURL: "deck", LongURL: "https://docs.example.com/presentation/q3-deck", UserID: userID, CreatedAt: base},
+		{ShortURL: "deck2", LongURL: "https://docs.example.com/q3-deck-draft/q3-deck-notes", UserID: userID, CreatedAt: base},
+		{ShortURL: "old", LongURL: "https://docs.example.com/q3-deck-old", UserID: userID, CreatedAt: base, Deleted: true},
+		{ShortURL: "q4", LongURL: "https://docs.example.com/q4-plan", UserID: userID, CreatedAt: base.Add(time.Hour)},
+		{ShortURL: "other", LongURL: "https://docs.example.com/q3-deck", UserID: "other-user", CreatedAt: base},
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	assert.Equal(t, []string{"https", "ya", "ru", "q3", "deck", "слайды"}, SearchTerms("https://Ya.ru/Q3_deck?Слайды"))
+}
+
+func TestMemoryMap_SearchUserURLs(t *testing.T) {
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	tests := []struct {
+		name    string
+		query   string
+		limit   int
+		want    []URL
+		wantErr error
+	}{
+		{name: "Test #1 all words, more matches first", query: "Q3 deck", want: []URL{"deck2", "deck"}},
+		{name: "Test #2 word prefix", query: "pres", want: []URL{"deck"}},
+		{name: "Test #3 shorter links first", query: "docs", want: []URL{"q4", "deck", "deck2"}},
+		{name: "Test #4 limit", query: "docs", limit: 1, want: []URL{"q4"}},
+		{name: "Test #5 no match", query: "q3 plan"},
+		{name: "Test #6 empty query", query: " /?- ", wantErr: ErrEmptyQuery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewMemoryMap()
+			_, err := d.ImportURLs(context.Background(), searchTestRecords(userID), ConflictFail)
+			require.NoError(t, err)
+
+			results, err := d.SearchUserURLs(context.Background(), userID, tt.query, tt.limit)
+			require.ErrorIs(t, err, tt.wantErr)
+			var got []URL
+			for i, result := range results {
+				if i > 0 {
+					assert.LessOrEqual(t, result.Rank, results[i-1].Rank)
+				}
+				got = append(got, result.ShortURL)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMemoryMap_SearchReindex(t *testing.T) {
+	d := NewMemoryMap()
+	_, err := d.ImportURLs(context.Background(), searchTestRecords("u"), ConflictFail)
+	require.NoError(t, err)
+	_, err = d.ImportURLs(context.Background(), []URLRecord{
+		{ShortURL: "deck", LongURL: "https://ya.ru/budget", UserID: "u"},
+	}, ConflictOverwrite)
+	require.NoError(t, err)
+
+	results, err := d.SearchUserURLs(context.Background(), "u", "presentation", 0)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+	results, err = d.SearchUserURLs(context.Background(), "u", "budget", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, URL("deck"), results[0].ShortURL)
+}
+
+func TestRedis_SearchUserURLs(t *testing.T) {
+	d, _ := newTestRedis(t, 0)
+	_, err := d.ImportURLs(context.Background(), searchTestRecords("u"), ConflictFail)
+	require.NoError(t, err)
+
+	results, err := d.SearchUserURLs(context.Background(), "u", "deck q3", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, URL("deck2"), results[0].ShortURL)
+	assert.Equal(t, URL("deck"), results[1].ShortURL)
+}
+
+func TestPG_SearchUserURLs(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+	created := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`to_tsquery\('simple', \$2\) q(.+)"url".search @@ q(.+)LIMIT \$3`).
+		WithArgs(userID, "q3:* & deck:*", DefaultSearchLimit).
+		WillReturnRows(mock.NewRows([]string{"short", "long", "created_at", "tags", "folder",
+			"updated_at", "title", "notes", "image_url", "rank"}).
+			AddRow(URL("deck"), URL("https://ya.ru/q3-deck"), created, []string{"slides"}, "q3",
+				created, "Quarterly deck", "", "", 0.5))
+
+	d := &PG{db: mock}
+	results, err := d.SearchUserURLs(context.Background(), userID, "Q3, deck q3", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []SearchResult{{
+		URLRecord: URLRecord{ShortURL: "deck", LongURL: "https://ya.ru/q3-deck", UserID: userID, CreatedAt: created,
+			UpdatedAt: created, Tags: []string{"slides"}, Folder: "q3", Title: "Quarterly deck"},
+		Rank: 0.5,
+	}}, results)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
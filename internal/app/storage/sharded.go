@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shardVirtualNodes - сколько точек на кольце получает каждый шард.
+// Чем больше, тем равномернее распределение ключей.
+const shardVirtualNodes = 128
+
+// ringHash равномерно раскладывает и похожие строки (имена шардов, короткие коды),
+// на которых fnv дает заметный перекос.
+func ringHash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard string
+}
+
+// hashRing - консистентное хэширование: при добавлении шарда переезжает
+// только примерно 1/N ключей.
+type hashRing struct {
+	points []ringPoint
+}
+
+func newHashRing(shards ...string) *hashRing {
+	ring := &hashRing{points: make([]ringPoint, 0, len(shards)*shardVirtualNodes)}
+	for _, shard := range shards {
+		for i := 0; i < shardVirtualNodes; i++ {
+			ring.points = append(ring.points, ringPoint{ringHash(shard + "#" + strconv.Itoa(i)), shard})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash == ring.points[j].hash {
+			return ring.points[i].shard < ring.points[j].shard
+		}
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+func (r *hashRing) get(short URL) string {
+	h := ringHash(short.S())
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// ParseShards разбирает записи вида "name=dsn" в карту шардов.
+func ParseShards(entries []string) (map[string]string, error) {
+	shards := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		name, dsn, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || name == "" || dsn == "" {
+			return nil, fmt.Errorf("bad shard %q: expected name=dsn", entry)
+		}
+		if _, exists := shards[name]; exists {
+			return nil, fmt.Errorf("duplicate shard %q", name)
+		}
+		shards[name] = dsn
+	}
+	return shards, nil
+}
+
+// Sharded распределяет ссылки по нескольким Repository по короткому коду.
+// Списки пользователя собираются со всех шардов.
+type Sharded struct {
+	shards map[string]Repository
+	names  []string
+	ring   *hashRing
+}
+
+func NewSharded(shards map[string]Repository) *Sharded {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &Sharded{
+		shards: shards,
+		names:  names,
+		ring:   newHashRing(names...),
+	}
+}
+
+// ShardFor возвращает имя шарда, в котором хранится короткая ссылка.
+func (d *Sharded) ShardFor(short URL) string {
+	return d.ring.get(short)
+}
+
+func (d *Sharded) shardFor(short URL) Repository {
+	return d.shards[d.ring.get(short)]
+}
+
+func (d *Sharded) SaveLongURL(long URL, userID string) (URL, error) {
+	shortURL, err := makeShort(long)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate short url: %w", err)
+	}
+	return d.shardFor(shortURL).SaveLongURL(long, userID)
+}
+
+func (d *Sharded) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]CorrelationShortPair, error) {
+	result := make([]CorrelationShortPair, len(longURLS))
+	// perShard - индексы ссылок пачки по шардам
+	perShard := make(map[string][]int)
+	for i, p := range longURLS {
+		shortURL, err := makeShort(p.LongURL)
+		if err != nil {
+			result[i] = batchFailure(p.CorrelationID, BatchError, err)
+			continue
+		}
+		name := d.ring.get(shortURL)
+		perShard[name] = append(perShard[name], i)
+	}
+
+	// шарды пишут в разные элементы result, поэтому без блокировки
+	var wg sync.WaitGroup
+	for name, indexes := range perShard {
+		wg.Add(1)
+		go func(name string, indexes []int) {
+			defer wg.Done()
+			batch := make([]CorrelationLongPair, len(indexes))
+			for j, i := range indexes {
+				batch[j] = longURLS[i]
+			}
+			saved, err := d.shards[name].SaveLongBatchURL(batch, userID)
+			if err == nil && len(saved) != len(batch) {
+				err = fmt.Errorf("got %v results for %v urls", len(saved), len(batch))
+			}
+			// недоступный шард не мешает сохранить ссылки других шардов
+			for j, i := range indexes {
+				if err != nil {
+					result[i] = batchFailure(longURLS[i].CorrelationID, BatchError, fmt.Errorf("shard %v: %w", name, err))
+					continue
+				}
+				result[i] = saved[j]
+			}
+		}(name, indexes)
+	}
+	wg.Wait()
+	return result, nil
+}
+
+func (d *Sharded) GetLongURL(short URL) (URL, error) {
+	return d.shardFor(short).GetLongURL(short)
+}
+
+func (d *Sharded) GetUsersURLs(userID string) (result []URLPair) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range d.names {
+		wg.Add(1)
+		go func(repo Repository) {
+			defer wg.Done()
+			pairs := repo.GetUsersURLs(userID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			result = append(result, pairs...)
+		}(d.shards[name])
+	}
+	wg.Wait()
+	return
+}
+
+// ListUserURLs запрашивает страницу у каждого шарда и сливает их: курсор - ключ сортировки,
+// поэтому следующая страница каждого шарда начинается после него же.
+func (d *Sharded) ListUserURLs(ctx context.Context, userID string, opts ListOptions) (URLPage, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	var records []URLRecord
+	more := false
+	for _, name := range d.names {
+		wg.Add(1)
+		go func(name string, repo Repository) {
+			defer wg.Done()
+			page, err := repo.ListUserURLs(ctx, userID, opts)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("shard %v: %w", name, err)
+				}
+				return
+			}
+			records = append(records, page.Records...)
+			more = more || page.NextCursor != ""
+		}(name, d.shards[name])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return URLPage{}, firstErr
+	}
+
+	sort.Slice(records, func(i, j int) bool { return opts.less(records[i], records[j]) })
+	page := opts.page(records)
+	if more && page.NextCursor == "" && len(page.Records) > 0 {
+		// ровно Limit записей, но у какого-то шарда есть еще
+		page.NextCursor = opts.encodeCursor(page.Records[len(page.Records)-1])
+	}
+	return page, nil
+}
+
+// SearchUserURLs ищет на всех шардах и оставляет лучшие limit результатов.
+func (d *Sharded) SearchUserURLs(ctx context.Context, userID string, query string, limit int) ([]SearchResult, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	var results []SearchResult
+	for _, name := range d.names {
+		wg.Add(1)
+		go func(name string, repo Repository) {
+			defer wg.Done()
+			found, err := repo.SearchUserURLs(ctx, userID, query, limit)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("shard %v: %w", name, err)
+				}
+				return
+			}
+			results = append(results, found...)
+		}(name, d.shards[name])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return sortSearchResults(results, searchLimit(limit)), nil
+}
+
+func (d *Sharded) EditUserURL(ctx context.Context, userID string, short URL, edit URLEdit) (URLRecord, error) {
+	return d.shardFor(short).EditUserURL(ctx, userID, short, edit)
+}
+
+func (d *Sharded) FillUserURLPreview(ctx context.Context, userID string, short URL, title string, imageURL string) error {
+	return d.shardFor(short).FillUserURLPreview(ctx, userID, short, title, imageURL)
+}
+
+func (d *Sharded) groupByShard(shortUrls []URL) map[string][]URL {
+	perShard := make(map[string][]URL)
+	for _, short := range shortUrls {
+		name := d.ring.get(short)
+		perShard[name] = append(perShard[name], short)
+	}
+	return perShard
+}
+
+func (d *Sharded) DeleteUsersURLs(userID string, shortUrls ...URL) error {
+	for name, shorts := range d.groupByShard(shortUrls) {
+		if err := d.shards[name].DeleteUsersURLs(userID, shorts...); err != nil {
+			return fmt.Errorf("shard %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Sharded) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) error {
+	for name, shorts := range d.groupByShard(shortUrls) {
+		if err := d.shards[name].DelayedDeleteUsersURLs(userID, shorts...); err != nil {
+			return fmt.Errorf("shard %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// OnDelete передает fn шардам, которые удаляют отложенно.
+func (d *Sharded) OnDelete(fn func(shortUrls ...URL)) {
+	for _, name := range d.names {
+		if notifier, ok := d.shards[name].(DeleteNotifier); ok {
+			notifier.OnDelete(fn)
+		}
+	}
+}
+
+func (d *Sharded) RestoreUsersURLs(userID string, shortUrls ...URL) error {
+	for name, shorts := range d.groupByShard(shortUrls) {
+		if err := d.shards[name].RestoreUsersURLs(userID, shorts...); err != nil {
+			return fmt.Errorf("shard %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Sharded) GetURLInfo(short URL) (URLRecord, error) {
+	return d.shardFor(short).GetURLInfo(short)
+}
+
+// ExportURLs выгружает шарды по очереди, в порядке имен.
+func (d *Sharded) ExportURLs(ctx context.Context, fn func(URLRecord) error) error {
+	for _, name := range d.names {
+		shard, ok := d.shards[name].(Transferable)
+		if !ok {
+			return fmt.Errorf("shard %v does not support export", name)
+		}
+		if err := shard.ExportURLs(ctx, fn); err != nil {
+			return fmt.Errorf("shard %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ImportURLs раскладывает записи по шардам кольца. Атомарность ConflictFail - в пределах шарда.
+func (d *Sharded) ImportURLs(ctx context.Context, records []URLRecord, policy ConflictPolicy) (ImportResult, error) {
+	perShard := make(map[string][]URLRecord)
+	for _, rec := range records {
+		name := d.ring.get(rec.ShortURL)
+		perShard[name] = append(perShard[name], rec)
+	}
+
+	var result ImportResult
+	for _, name := range d.names {
+		if len(perShard[name]) == 0 {
+			continue
+		}
+		shard, ok := d.shards[name].(Transferable)
+		if !ok {
+			return result, fmt.Errorf("shard %v does not support import", name)
+		}
+		shardResult, err := shard.ImportURLs(ctx, perShard[name], policy)
+		result.Add(shardResult)
+		if err != nil {
+			return result, fmt.Errorf("shard %v: %w", name, err)
+		}
+	}
+	return result, nil
+}
+
+func (d *Sharded) Close() error {
+	var firstErr error
+	for _, name := range d.names {
+		if closer, ok := d.shards[name].(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("shard %v: %w", name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// ConsumeDailyQuota хранит счетчик в шарде, выбранном по ключу, как короткую ссылку.
+func (d *Sharded) ConsumeDailyQuota(ctx context.Context, key string, day time.Time, n int, limit int) (int, error) {
+	return d.shardFor(URL(key)).ConsumeDailyQuota(ctx, key, day, n, limit)
+}
+
+func (d *Sharded) Ping() bool {
+	for _, name := range d.names {
+		if !d.shards[name].Ping() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestHashRing_AddShardMovesFewKeys(t *testing.T) {
+	before := newHashRing("s1", "s2", "s3")
+	after := newHashRing("s1", "s2", "s3", "s4")
+
+	const keys = 10000
+	moved := 0
+	perShard := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		short, err := makeShort(URL(fmt.Sprintf("https://ya.ru/%v", i)))
+		require.NoError(t, err)
+		from, to := before.get(short), after.get(short)
+		if from != to {
+			moved++
+			assert.Equal(t, "s4", to, "keys may move only to the new shard")
+		}
+		perShard[from]++
+	}
+	// в идеале переезжает четверть ключей
+	assert.InDelta(t, keys/4, moved, keys/10)
+	for shard, n := range perShard {
+		assert.InDelta(t, keys/3, n, keys/10, "shard %v is unbalanced", shard)
+	}
+}
+
+func TestParseShards(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "Test #1 name=dsn pairs",
+			entries: []string{"s1=postgres://a/db?sslmode=disable", " s2=postgres://b/db"},
+			want:    map[string]string{"s1": "postgres://a/db?sslmode=disable", "s2": "postgres://b/db"},
+		},
+		{
+			name:    "Test #2 missing name",
+			entries: []string{"postgres://a/db"},
+			wantErr: true,
+		},
+		{
+			name:    "Test #3 duplicate name",
+			entries: []string{"s1=postgres://a/db", "s1=postgres://b/db"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseShards(tt.entries)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSharded(t *testing.T) {
+	shards := map[string]*MemoryMap{"s1": NewMemoryMap(), "s2": NewMemoryMap(), "s3": NewMemoryMap()}
+	d := NewSharded(map[string]Repository{"s1": shards["s1"], "s2": shards["s2"], "s3": shards["s3"]})
+	userID := "370230df-159e-4aec-9f18-922f9c0be328"
+
+	var batch []CorrelationLongPair
+	var want []URLPair
+	for i := 0; i < 20; i++ {
+		long := URL(fmt.Sprintf("https://ya.ru/%v", i))
+		batch = append(batch, CorrelationLongPair{CorrelationID: fmt.Sprint(i), LongURL: long})
+		short, err := makeShort(long)
+		require.NoError(t, err)
+		want = append(want, URLPair{ShortURL: short, LongURL: long})
+	}
+
+	result, err := d.SaveLongBatchURL(batch, userID)
+	require.NoError(t, err)
+	require.Len(t, result, len(batch))
+	for i, p := range result {
+		assert.Equal(t, batch[i].CorrelationID, p.CorrelationID, "results must keep request order")
+		assert.Equal(t, want[i].ShortURL, p.ShortURL)
+
+		// ссылка лежит ровно в одном, назначенном ей шарде
+		for name, shard := range shards {
+			_, err := shard.GetLongURL(p.ShortURL)
+			if name == d.ShardFor(p.ShortURL) {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrNotFoundURL)
+			}
+		}
+		long, err := d.GetLongURL(p.ShortURL)
+		assert.NoError(t, err)
+		assert.Equal(t, want[i].LongURL, long)
+	}
+
+	used := 0
+	for _, shard := range shards {
+		if len(shard.GetUsersURLs(userID)) > 0 {
+			used++
+		}
+	}
+	assert.Equal(t, len(shards), used, "20 urls should spread over all shards")
+	assert.ElementsMatch(t, want, d.GetUsersURLs(userID))
+
+	short, err := d.SaveLongURL("https://ya.ru/single", userID)
+	require.NoError(t, err)
+	long, err := shards[d.ShardFor(short)].GetLongURL(short)
+	assert.NoError(t, err)
+	assert.Equal(t, URL("https://ya.ru/single"), long)
+}
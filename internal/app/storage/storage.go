@@ -1,10 +1,12 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"strconv"
+	"time"
 )
 
 type URL string
@@ -14,18 +16,89 @@ func (u *URL) S() string {
 }
 
 type URLPair struct {
-	ShortURL URL `json:"short_url"`
-	LongURL  URL `json:"original_url"`
+	ShortURL  URL        `json:"short_url"`
+	LongURL   URL        `json:"original_url"`
+	Title     string     `json:"title,omitempty"`
+	Notes     string     `json:"notes,omitempty"`
+	ImageURL  string     `json:"image_url,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Folder    string     `json:"folder,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// URLRecord - полная запись о ссылке вместе с владельцем.
+type URLRecord struct {
+	ShortURL  URL
+	LongURL   URL
+	UserID    string
+	Deleted   bool
+	CreatedAt time.Time
+	// UpdatedAt - время последнего изменения: правки, удаления или восстановления.
+	UpdatedAt time.Time
+	// Tags - нормализованные (NormalizeTags) теги ссылки.
+	Tags   []string
+	Folder string
+	Title  string
+	Notes  string
+	// ImageURL - картинка страницы (og:image), ее находит preview.Fetcher.
+	ImageURL string
 }
 
 type CorrelationLongPair struct {
-	CorrelationID string `json:"correlation_id"`
-	LongURL       URL    `json:"original_url"`
+	CorrelationID string   `json:"correlation_id"`
+	LongURL       URL      `json:"original_url"`
+	Title         string   `json:"title,omitempty"`
+	Notes         string   `json:"notes,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Folder        string   `json:"folder,omitempty"`
 }
 
+// BatchStatus - итог сохранения одной ссылки из пачки.
+type BatchStatus string
+
+const (
+	// BatchCreated - ссылка создана.
+	BatchCreated BatchStatus = "created"
+	// BatchConflict - ссылка уже была (в том числе раньше в той же пачке), ShortURL - существующая.
+	BatchConflict BatchStatus = "conflict"
+	// BatchInvalid - ссылка не прошла проверку и не сохранялась.
+	BatchInvalid BatchStatus = "invalid"
+	// BatchError - ссылку не удалось сохранить.
+	BatchError BatchStatus = "error"
+)
+
+// Owner - чья ссылка уже была, когда ее пытались создать.
+type Owner string
+
+const (
+	// OwnerSameUser - ссылку раньше создал тот же пользователь.
+	OwnerSameUser Owner = "same_user"
+	// OwnerOtherUser - ссылка принадлежит другому пользователю и не менялась.
+	OwnerOtherUser Owner = "other_user"
+)
+
+// ownerOf - Owner существующей ссылки владельца recordUserID для пользователя userID.
+func ownerOf(recordUserID, userID string) Owner {
+	if recordUserID == userID {
+		return OwnerSameUser
+	}
+	return OwnerOtherUser
+}
+
+// CorrelationShortPair - итог по одной ссылке пачки. SaveLongBatchURL возвращает их
+// по одному на каждую ссылку запроса, в том же порядке. Owner заполняется только у BatchConflict.
 type CorrelationShortPair struct {
-	CorrelationID string `json:"correlation_id"`
-	ShortURL      URL    `json:"short_url"`
+	CorrelationID string      `json:"correlation_id"`
+	ShortURL      URL         `json:"short_url,omitempty"`
+	Status        BatchStatus `json:"status,omitempty"`
+	Owner         Owner       `json:"owner,omitempty"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// batchFailure - итог ссылки, которую не удалось сохранить.
+func batchFailure(correlationID string, status BatchStatus, err error) CorrelationShortPair {
+	return CorrelationShortPair{CorrelationID: correlationID, Status: status, Error: err.Error()}
 }
 
 type Repository interface {
@@ -33,8 +106,26 @@ type Repository interface {
 	SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]CorrelationShortPair, error)
 	GetLongURL(short URL) (URL, error)
 	GetUsersURLs(userID string) []URLPair
+	// ListUserURLs возвращает страницу ссылок пользователя, включая удаленные,
+	// с сортировкой и фильтрами из opts.
+	ListUserURLs(ctx context.Context, userID string, opts ListOptions) (URLPage, error)
+	// SearchUserURLs ищет действующие ссылки пользователя по словам query, самые релевантные первыми.
+	SearchUserURLs(ctx context.Context, userID string, query string, limit int) ([]SearchResult, error)
+	// EditUserURL применяет нормализованную правку к ссылке пользователя и возвращает ее.
+	// Чужая или несуществующая ссылка - ErrNotFoundURL.
+	EditUserURL(ctx context.Context, userID string, short URL, edit URLEdit) (URLRecord, error)
+	// FillUserURLPreview заполняет пустые заголовок и картинку ссылки пользователя нормализованными
+	// title и imageURL ("" - не трогать). Заданное уже не перезаписывается, время изменения остается прежним.
+	// Чужая или несуществующая ссылка - ErrNotFoundURL.
+	FillUserURLPreview(ctx context.Context, userID string, short URL, title string, imageURL string) error
 	DeleteUsersURLs(userID string, shortUrls ...URL) error
 	DelayedDeleteUsersURLs(userID string, shortUrls ...URL) error
+	RestoreUsersURLs(userID string, shortUrls ...URL) error
+	GetURLInfo(short URL) (URLRecord, error)
+	// ConsumeDailyQuota прибавляет n к счетчику key за сутки day (UTC), если итог не больше limit,
+	// и возвращает итог. Иначе счетчик не меняется, а ошибка - ErrQuotaExceeded.
+	// Отрицательное n возвращает списанное и не проверяется по limit; ниже нуля счетчик не опускается.
+	ConsumeDailyQuota(ctx context.Context, key string, day time.Time, n int, limit int) (int, error)
 	Ping() bool
 }
 
@@ -55,6 +146,7 @@ func makeShort(long URL) (URL, error) {
 
 var ErrConflictURL = errors.New("url already exists")
 var ErrDeletedURL = errors.New("url deleted")
+var ErrNotFoundURL = errors.New("short url not registered")
 
 type ConflictURLError struct {
 	Err      error
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ConflictPolicy - что делать при импорте ссылки, короткий код которой уже занят.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip оставляет существующую ссылку.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite заменяет существующую ссылку импортируемой, вместе с владельцем.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictFail прерывает импорт пачки, ничего из нее не сохранив. Код, повторяющийся
+	// внутри пачки, - такой же конфликт, как уже занятый.
+	ConflictFail ConflictPolicy = "fail"
+)
+
+var ErrImportConflict = errors.New("short url already exists")
+
+// repeatedShortError - ErrImportConflict, если код встречается в пачке дважды.
+func repeatedShortError(records []URLRecord) error {
+	seen := make(map[URL]bool, len(records))
+	for _, rec := range records {
+		if seen[rec.ShortURL] {
+			return fmt.Errorf("%w: %v repeats in batch", ErrImportConflict, rec.ShortURL)
+		}
+		seen[rec.ShortURL] = true
+	}
+	return nil
+}
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q: expected skip, overwrite or fail", s)
+}
+
+// ImportResult - сколько записей импорта создано, пропущено и перезаписано.
+type ImportResult struct {
+	Created     int
+	Skipped     int
+	Overwritten int
+}
+
+func (r *ImportResult) Add(other ImportResult) {
+	r.Created += other.Created
+	r.Skipped += other.Skipped
+	r.Overwritten += other.Overwritten
+}
+
+// Transferable - хранилище, умеющее выгружать и загружать ссылки целиком,
+// включая удаленные, с владельцами и временем создания.
+// Через него данные переносятся между любыми хранилищами.
+type Transferable interface {
+	// ExportURLs по очереди передает в fn все ссылки. Ошибка fn прерывает выгрузку.
+	ExportURLs(ctx context.Context, fn func(URLRecord) error) error
+	// ImportURLs сохраняет записи как есть. Нулевое CreatedAt заменяется текущим временем.
+	ImportURLs(ctx context.Context, records []URLRecord, policy ConflictPolicy) (ImportResult, error)
+}
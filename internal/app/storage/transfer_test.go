@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemoryMap_ImportURLs(t *testing.T) {
+	createdAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []URLRecord{
+		{ShortURL: "s1", LongURL: "https://ya.ru/imported", UserID: "u2", Deleted: true, CreatedAt: createdAt,
+			UpdatedAt: createdAt.Add(time.Hour)},
+		{ShortURL: "s2", LongURL: "https://ya.ru/2", UserID: "u2", CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+
+	tests := []struct {
+		name       string
+		policy     ConflictPolicy
+		records    []URLRecord
+		want       ImportResult
+		wantErr    error
+		wantS1     URLRecord
+		wantS2     bool
+		wantOwners map[string]int
+	}{
+		{
+			name:       "Test #1 skip keeps existing url",
+			policy:     ConflictSkip,
+			want:       ImportResult{Created: 1, Skipped: 1},
+			wantS1:     URLRecord{ShortURL: "s1", LongURL: "https://ya.ru/1", UserID: "u1"},
+			wantS2:     true,
+			wantOwners: map[string]int{"u1": 1, "u2": 1},
+		},
+		{
+			name:       "Test #2 overwrite replaces url and owner",
+			policy:     ConflictOverwrite,
+			want:       ImportResult{Created: 1, Overwritten: 1},
+			wantS1:     records[0],
+			wantS2:     true,
+			wantOwners: map[string]int{"u1": 0, "u2": 2},
+		},
+		{
+			name:       "Test #3 fail imports nothing",
+			policy:     ConflictFail,
+			wantErr:    ErrImportConflict,
+			wantS1:     URLRecord{ShortURL: "s1", LongURL: "https://ya.ru/1", UserID: "u1"},
+			wantOwners: map[string]int{"u1": 1, "u2": 0},
+		},
+		{
+			name:       "Test #4 fail on code repeated in batch",
+			policy:     ConflictFail,
+			records:    []URLRecord{records[1], records[1]},
+			wantErr:    ErrImportConflict,
+			wantS1:     URLRecord{ShortURL: "s1", LongURL: "https://ya.ru/1", UserID: "u1"},
+			wantOwners: map[string]int{"u1": 1, "u2": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewMemoryMap()
+			d.SetLongURL("https://ya.ru/1", "s1", "u1")
+
+			if tt.records == nil {
+				tt.records = records
+			}
+			got, err := d.ImportURLs(context.Background(), tt.records, tt.policy)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+
+			s1, err := d.GetURLInfo("s1")
+			require.NoError(t, err)
+			if tt.wantS1.CreatedAt.IsZero() {
+				s1.CreatedAt, s1.UpdatedAt = time.Time{}, time.Time{}
+			}
+			assert.Equal(t, tt.wantS1, s1)
+			_, err = d.GetURLInfo("s2")
+			assert.Equal(t, tt.wantS2, err == nil)
+			for userID, count := range tt.wantOwners {
+				assert.Len(t, d.GetUsersURLs(userID), count, userID)
+			}
+		})
+	}
+}
+
+func TestFileStorage_ImportURLs(t *testing.T) {
+	buffer := bytes.Buffer{}
+	d := &FileStorage{memMap: NewMemoryMap(), encoder: json.NewEncoder(&buffer)}
+	_, err := d.SaveLongURL("https://ya.ru", "u1")
+	require.NoError(t, err)
+
+	records := []URLRecord{
+		{ShortURL: "7d7cbdab", LongURL: "https://ya.ru/moved", UserID: "u2", Deleted: true,
+			CreatedAt: time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC), UpdatedAt: time.Date(2022, 5, 2, 12, 0, 0, 0, time.UTC),
+			Title: "Moved", Notes: "imported from backup"},
+	}
+	got, err := d.ImportURLs(context.Background(), records, ConflictOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Overwritten: 1}, got)
+
+	// после перезапуска файл дает то же состояние
+	reloaded := &FileStorage{memMap: NewMemoryMap()}
+	require.NoError(t, reloaded.LoadFromBuff(&buffer))
+	var exported []URLRecord
+	err = reloaded.ExportURLs(context.Background(), func(rec URLRecord) error {
+		exported = append(exported, rec)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, records, exported)
+	assert.Empty(t, reloaded.GetUsersURLs("u1"))
+}
+
+func TestRedis_ExportImport(t *testing.T) {
+	src, _ := newTestRedis(t, 0)
+	_, err := src.SaveLongURL("https://ya.ru/1", "u1")
+	require.NoError(t, err)
+	short, err := src.SaveLongURL("https://ya.ru/2", "u1")
+	require.NoError(t, err)
+	require.NoError(t, src.DeleteUsersURLs("u1", short))
+
+	var records []URLRecord
+	err = src.ExportURLs(context.Background(), func(rec URLRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	dst, _ := newTestRedis(t, 0)
+	got, err := dst.ImportURLs(context.Background(), records, ConflictSkip)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Created: 2}, got)
+	for _, rec := range records {
+		info, err := dst.GetURLInfo(rec.ShortURL)
+		require.NoError(t, err)
+		assert.Equal(t, rec, info)
+	}
+
+	got, err = dst.ImportURLs(context.Background(), records, ConflictSkip)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Skipped: 2}, got)
+
+	_, err = dst.ImportURLs(context.Background(), records, ConflictFail)
+	assert.ErrorIs(t, err, ErrImportConflict)
+	// повтор кода внутри пачки - тоже конфликт, а не пропуск
+	repeated := []URLRecord{{ShortURL: "r1", LongURL: "https://ya.ru/r", UserID: "u1"},
+		{ShortURL: "r1", LongURL: "https://ya.ru/r2", UserID: "u1"}}
+	_, err = dst.ImportURLs(context.Background(), repeated, ConflictFail)
+	assert.ErrorIs(t, err, ErrImportConflict)
+	_, err = dst.GetURLInfo("r1")
+	assert.ErrorIs(t, err, ErrNotFoundURL)
+
+	records[0].UserID = "u2"
+	got, err = dst.ImportURLs(context.Background(), records[:1], ConflictOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Overwritten: 1}, got)
+	assert.Len(t, dst.GetUsersURLs("u1"), 1)
+	assert.Len(t, dst.GetUsersURLs("u2"), 1)
+}
+
+func TestRedis_ImportStaleOwner(t *testing.T) {
+	d, _ := newTestRedis(t, 0)
+	short, err := d.SaveLongURL("https://ya.ru/1", "u1")
+	require.NoError(t, err)
+	rec := URLRecord{ShortURL: short, LongURL: "https://ya.ru/moved", UserID: "u2"}
+
+	// владелец сменился после чтения - скрипт ничего не пишет
+	pipe := d.client.Pipeline()
+	cmd := d.importRecord(context.Background(), pipe, rec, ConflictOverwrite, urlOwner{found: true, userID: "u3"})
+	_, err = pipe.Exec(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), cmd.Val())
+	long, err := d.GetLongURL(short)
+	require.NoError(t, err)
+	assert.Equal(t, URL("https://ya.ru/1"), long)
+
+	got, err := d.ImportURLs(context.Background(), []URLRecord{rec}, ConflictOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Overwritten: 1}, got)
+	assert.Empty(t, d.GetUsersURLs("u1"))
+	assert.Len(t, d.GetUsersURLs("u2"), 1)
+}
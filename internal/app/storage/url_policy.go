@@ -0,0 +1,439 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/idna"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBlockedURL = errors.New("url blocked by policy")
+
+// PolicyConfig - откуда URLPolicy берет правила. Правило хоста - одно из:
+//
+//	example.com    - только этот хост;
+//	.example.com   - хост и все его поддомены;
+//	*.example.com  - шаблон по меткам хоста: "*" заменяет часть одной метки,
+//	                 a.example.com подходит, a.b.example.com - нет.
+//
+// В файлах одно правило на строку, после "#" - комментарий.
+type PolicyConfig struct {
+	Blocklist     []string
+	BlocklistFile string
+	// Allowlist и AllowlistFile, если заданы, разрешают сокращать только ссылки на эти хосты.
+	Allowlist     []string
+	AllowlistFile string
+	// ThreatFeed - файл с опасными ссылками и хостами: полная ссылка блокируется точно,
+	// хост (в том числе строкой hosts-файла "0.0.0.0 host") - вместе с поддоменами.
+	ThreatFeed string
+}
+
+// IsEmpty - ни одного источника правил, политика не нужна.
+func (c PolicyConfig) IsEmpty() bool {
+	return len(c.Blocklist) == 0 && c.BlocklistFile == "" && len(c.Allowlist) == 0 &&
+		c.AllowlistFile == "" && c.ThreatFeed == ""
+}
+
+// URLPolicy - декоратор Repository, который не дает сокращать и восстанавливать ссылки
+// на запрещенные хосты. Reload перечитывает правила и отключает (удаляет) уже сохраненные
+// ссылки, которые под них попали.
+type URLPolicy struct {
+	repo Repository
+	// records - откуда брать все ссылки для перепроверки, nil - перепроверка невозможна.
+	records Transferable
+	cfg     PolicyConfig
+	mu      sync.RWMutex
+	rules   *policyRules
+}
+
+// NewURLPolicy загружает правила из cfg и оборачивает repo.
+// Ссылки для перепроверки читаются из records, обычно это хранилище под repo без кэша.
+func NewURLPolicy(repo Repository, records Transferable, cfg PolicyConfig) (*URLPolicy, error) {
+	rules, err := loadPolicyRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &URLPolicy{repo: repo, records: records, cfg: cfg, rules: rules}, nil
+}
+
+// Check возвращает ErrBlockedURL, если ссылку сокращать нельзя.
+func (p *URLPolicy) Check(long URL) error {
+	p.mu.RLock()
+	rules := p.rules
+	p.mu.RUnlock()
+	return rules.check(long)
+}
+
+// Reload перечитывает файлы правил и перепроверяет сохраненные ссылки.
+// Если правила не загрузились, остаются прежние.
+func (p *URLPolicy) Reload(ctx context.Context) (int, error) {
+	rules, err := loadPolicyRules(p.cfg)
+	if err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+	return p.Recheck(ctx)
+}
+
+// Recheck отключает действующие ссылки, которые запрещены текущими правилами,
+// и возвращает, сколько отключено.
+func (p *URLPolicy) Recheck(ctx context.Context) (int, error) {
+	if p.records == nil {
+		return 0, errors.New("repository cannot list all urls")
+	}
+	blocked := make(map[string][]URL)
+	err := p.records.ExportURLs(ctx, func(record URLRecord) error {
+		if record.Deleted {
+			return nil
+		}
+		if err := p.Check(record.LongURL); errors.Is(err, ErrBlockedURL) {
+			log.Printf("disable %v (%v): %v", record.ShortURL, record.LongURL, err)
+			blocked[record.UserID] = append(blocked[record.UserID], record.ShortURL)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot list urls: %w", err)
+	}
+	disabled := 0
+	for userID, shorts := range blocked {
+		if err := p.repo.DeleteUsersURLs(userID, shorts...); err != nil {
+			return disabled, fmt.Errorf("cannot disable urls: %w", err)
+		}
+		disabled += len(shorts)
+	}
+	return disabled, nil
+}
+
+func (p *URLPolicy) SaveLongURL(long URL, userID string) (URL, error) {
+	if err := p.Check(long); err != nil {
+		return "", err
+	}
+	return p.repo.SaveLongURL(long, userID)
+}
+
+// SaveLongBatchURL сохраняет только разрешенные ссылки, запрещенные получают BatchInvalid.
+func (p *URLPolicy) SaveLongBatchURL(longURLS []CorrelationLongPair, userID string) ([]CorrelationShortPair, error) {
+	result := make([]CorrelationShortPair, len(longURLS))
+	allowed := make([]CorrelationLongPair, 0, len(longURLS))
+	indexes := make([]int, 0, len(longURLS))
+	for i, pair := range longURLS {
+		if err := p.Check(pair.LongURL); err != nil {
+			result[i] = batchFailure(pair.CorrelationID, BatchInvalid, err)
+			continue
+		}
+		allowed = append(allowed, pair)
+		indexes = append(indexes, i)
+	}
+	if len(allowed) == 0 {
+		return result, nil
+	}
+	saved, err := p.repo.SaveLongBatchURL(allowed, userID)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range indexes {
+		result[i] = saved[j]
+	}
+	return result, nil
+}
+
+func (p *URLPolicy) GetLongURL(short URL) (URL, error) {
+	return p.repo.GetLongURL(short)
+}
+
+func (p *URLPolicy) GetUsersURLs(userID string) []URLPair {
+	return p.repo.GetUsersURLs(userID)
+}
+
+func (p *URLPolicy) ListUserURLs(ctx context.Context, userID string, opts ListOptions) (URLPage, error) {
+	return p.repo.ListUserURLs(ctx, userID, opts)
+}
+
+func (p *URLPolicy) SearchUserURLs(ctx context.Context, userID string, query string, limit int) ([]SearchResult, error) {
+	return p.repo.SearchUserURLs(ctx, userID, query, limit)
+}
+
+func (p *URLPolicy) EditUserURL(ctx context.Context, userID string, short URL, edit URLEdit) (URLRecord, error) {
+	return p.repo.EditUserURL(ctx, userID, short, edit)
+}
+
+func (p *URLPolicy) FillUserURLPreview(ctx context.Context, userID string, short URL, title string, imageURL string) error {
+	return p.repo.FillUserURLPreview(ctx, userID, short, title, imageURL)
+}
+
+func (p *URLPolicy) DeleteUsersURLs(userID string, shortUrls ...URL) error {
+	return p.repo.DeleteUsersURLs(userID, shortUrls...)
+}
+
+func (p *URLPolicy) DelayedDeleteUsersURLs(userID string, shortUrls ...URL) error {
+	return p.repo.DelayedDeleteUsersURLs(userID, shortUrls...)
+}
+
+// RestoreUsersURLs не восстанавливает ничего, если хотя бы одна ссылка запрещена:
+// иначе отключенную ссылку можно было бы вернуть.
+func (p *URLPolicy) RestoreUsersURLs(userID string, shortUrls ...URL) error {
+	for _, short := range shortUrls {
+		record, err := p.repo.GetURLInfo(short)
+		if err != nil {
+			continue
+		}
+		if err = p.Check(record.LongURL); errors.Is(err, ErrBlockedURL) {
+			return fmt.Errorf("%v: %w", short, err)
+		}
+	}
+	return p.repo.RestoreUsersURLs(userID, shortUrls...)
+}
+
+func (p *URLPolicy) GetURLInfo(short URL) (URLRecord, error) {
+	return p.repo.GetURLInfo(short)
+}
+
+func (p *URLPolicy) ConsumeDailyQuota(ctx context.Context, key string, day time.Time, n int, limit int) (int, error) {
+	return p.repo.ConsumeDailyQuota(ctx, key, day, n, limit)
+}
+
+func (p *URLPolicy) Ping() bool {
+	return p.repo.Ping()
+}
+
+// policyRules - разобранные правила, после загрузки не меняются.
+type policyRules struct {
+	block hostRules
+	// allow == nil - allowlist не задан.
+	allow       *hostRules
+	threatHosts hostRules
+	threatURLs  map[URL]bool
+}
+
+func loadPolicyRules(cfg PolicyConfig) (*policyRules, error) {
+	rules := &policyRules{threatURLs: make(map[URL]bool)}
+
+	block, err := readRuleLines(cfg.Blocklist, cfg.BlocklistFile)
+	if err != nil {
+		return nil, err
+	}
+	if rules.block, err = parseHostRules(block); err != nil {
+		return nil, fmt.Errorf("blocklist: %w", err)
+	}
+
+	allow, err := readRuleLines(cfg.Allowlist, cfg.AllowlistFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) > 0 {
+		allowRules, err := parseHostRules(allow)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist: %w", err)
+		}
+		rules.allow = &allowRules
+	}
+
+	if cfg.ThreatFeed != "" {
+		if err = rules.loadThreatFeed(cfg.ThreatFeed); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// loadThreatFeed читает файл угроз. Чужие фиды бывают с мусором, поэтому плохие строки
+// пропускаются, а не ломают загрузку.
+func (r *policyRules) loadThreatFeed(name string) error {
+	lines, err := readRuleLines(nil, name)
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	skipped := 0
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && net.ParseIP(fields[0]) != nil:
+			hosts = append(hosts, "."+strings.TrimPrefix(fields[1], "."))
+		case len(fields) != 1:
+			skipped++
+		case strings.Contains(line, "://"):
+			long, err := NormalizeLongURL(URL(line))
+			if err != nil {
+				skipped++
+				continue
+			}
+			r.threatURLs[long] = true
+		default:
+			hosts = append(hosts, "."+strings.TrimPrefix(line, "."))
+		}
+	}
+	for _, host := range hosts {
+		if err := r.threatHosts.add(host); err != nil {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		log.Printf("threat feed %v: skipped %v bad lines", name, skipped)
+	}
+	return nil
+}
+
+func (r *policyRules) check(long URL) error {
+	long, err := NormalizeLongURL(long)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(long.S())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	host := u.Hostname()
+	switch {
+	case r.threatURLs[long] || r.threatHosts.match(host):
+		return fmt.Errorf("%w: %v is listed in threat feed", ErrBlockedURL, host)
+	case r.block.match(host):
+		return fmt.Errorf("%w: host %v is blocked", ErrBlockedURL, host)
+	case r.allow != nil && !r.allow.match(host):
+		return fmt.Errorf("%w: host %v is not allowed", ErrBlockedURL, host)
+	}
+	return nil
+}
+
+// readRuleLines объединяет правила из списка и файла, без пустых строк и комментариев.
+func readRuleLines(rules []string, name string) ([]string, error) {
+	var lines []string
+	for _, rule := range rules {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			lines = append(lines, rule)
+		}
+	}
+	if name == "" {
+		return lines, nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open rules: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read rules %v: %w", name, err)
+	}
+	return lines, nil
+}
+
+// hostRules - набор правил хостов в формате PolicyConfig.
+type hostRules struct {
+	exact    map[string]bool
+	suffixes map[string]bool
+	// wildcards - шаблоны, разбитые на метки.
+	wildcards [][]string
+}
+
+func parseHostRules(rules []string) (hostRules, error) {
+	var r hostRules
+	for _, rule := range rules {
+		if err := r.add(rule); err != nil {
+			return hostRules{}, err
+		}
+	}
+	return r, nil
+}
+
+// add разбирает и добавляет одно правило.
+func (r *hostRules) add(rule string) error {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	switch {
+	case strings.Contains(rule, "*"):
+		labels := strings.Split(strings.TrimSuffix(rule, "."), ".")
+		for i, label := range labels {
+			if strings.Contains(label, "*") {
+				if _, err := path.Match(label, ""); err != nil || label == "" {
+					return fmt.Errorf("bad host rule %q", rule)
+				}
+				continue
+			}
+			ascii, err := idna.Lookup.ToASCII(label)
+			if err != nil || ascii == "" {
+				return fmt.Errorf("bad host rule %q", rule)
+			}
+			labels[i] = ascii
+		}
+		r.wildcards = append(r.wildcards, labels)
+	case strings.HasPrefix(rule, "."):
+		host, err := normalizeHost(rule[1:])
+		if err != nil {
+			return fmt.Errorf("bad host rule %q", rule)
+		}
+		if r.suffixes == nil {
+			r.suffixes = make(map[string]bool)
+		}
+		r.suffixes[host] = true
+	default:
+		host, err := normalizeHost(strings.Trim(rule, "[]"))
+		if err != nil {
+			return fmt.Errorf("bad host rule %q", rule)
+		}
+		if r.exact == nil {
+			r.exact = make(map[string]bool)
+		}
+		r.exact[host] = true
+	}
+	return nil
+}
+
+// match проверяет нормализованный (normalizeHost) хост.
+func (r *hostRules) match(host string) bool {
+	if r.exact[host] {
+		return true
+	}
+	// хост и все родительские домены
+	for parent := host; parent != ""; {
+		if r.suffixes[parent] {
+			return true
+		}
+		i := strings.Index(parent, ".")
+		if i < 0 {
+			break
+		}
+		parent = parent[i+1:]
+	}
+	if len(r.wildcards) > 0 {
+		labels := strings.Split(host, ".")
+		for _, pattern := range r.wildcards {
+			if matchLabels(pattern, labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchLabels(pattern []string, labels []string) bool {
+	if len(pattern) != len(labels) {
+		return false
+	}
+	for i := range pattern {
+		if ok, _ := path.Match(pattern[i], labels[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostRules(t *testing.T) {
+	rules, err := parseHostRules([]string{"Evil.com", ".phish.net", "*.cdn.example.org", "login-*.*.io", "пример.рф", "[2001:db8::1]"})
+	require.NoError(t, err)
+	for host, want := range map[string]bool{
+		"evil.com":              true,
+		"www.evil.com":          false,
+		"phish.net":             true,
+		"a.b.phish.net":         true,
+		"notphish.net":          false,
+		"x.cdn.example.org":     true,
+		"cdn.example.org":       false,
+		"x.y.cdn.example.org":   false,
+		"login-bank.secure.io":  true,
+		"login.secure.io":       false,
+		"xn--e1afmkfd.xn--p1ai": true,
+		"2001:db8::1":           true,
+		"ya.ru":                 false,
+	} {
+		assert.Equal(t, want, rules.match(host), host)
+	}
+
+	for _, rule := range []string{"bad host", "*.[a", "."} {
+		_, err = parseHostRules([]string{rule})
+		assert.Error(t, err, rule)
+	}
+}
+
+func writeRules(t *testing.T, name string, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	return file
+}
+
+func TestURLPolicy_Check(t *testing.T) {
+	feed := writeRules(t, "feed.txt", `# test feed
+https://ya.ru/phish?id=1
+0.0.0.0 malware.example   # hosts format
+bad.example
+not a line at all
+`)
+	tests := []struct {
+		name    string
+		cfg     PolicyConfig
+		long    URL
+		wantErr error
+	}{
+		{name: "Test #1 no rules", long: "https://ya.ru/"},
+		{name: "Test #2 blocklist", cfg: PolicyConfig{Blocklist: []string{".evil.com"}}, long: "https://WWW.evil.com/login", wantErr: ErrBlockedURL},
+		{name: "Test #3 allowlist miss", cfg: PolicyConfig{Allowlist: []string{".corp.example"}}, long: "https://ya.ru/", wantErr: ErrBlockedURL},
+		{name: "Test #4 allowlist hit", cfg: PolicyConfig{Allowlist: []string{".corp.example"}}, long: "https://wiki.corp.example/"},
+		{name: "Test #5 blocklist wins over allowlist", cfg: PolicyConfig{Allowlist: []string{".corp.example"}, Blocklist: []string{"old.corp.example"}},
+			long: "https://old.corp.example/", wantErr: ErrBlockedURL},
+		{name: "Test #6 feed url", cfg: PolicyConfig{ThreatFeed: feed}, long: "HTTPS://ya.ru:443/phish?id=1", wantErr: ErrBlockedURL},
+		{name: "Test #7 feed other url of same host", cfg: PolicyConfig{ThreatFeed: feed}, long: "https://ya.ru/phish?id=2"},
+		{name: "Test #8 feed hosts format", cfg: PolicyConfig{ThreatFeed: feed}, long: "http://cdn.malware.example/x", wantErr: ErrBlockedURL},
+		{name: "Test #9 feed host", cfg: PolicyConfig{ThreatFeed: feed}, long: "http://bad.example", wantErr: ErrBlockedURL},
+		{name: "Test #10 invalid url", long: "ya.ru", wantErr: ErrInvalidURL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewURLPolicy(NewMemoryMap(), nil, tt.cfg)
+			require.NoError(t, err)
+			assert.ErrorIs(t, p.Check(tt.long), tt.wantErr)
+		})
+	}
+
+	_, err := NewURLPolicy(NewMemoryMap(), nil, PolicyConfig{BlocklistFile: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+	_, err = NewURLPolicy(NewMemoryMap(), nil, PolicyConfig{Blocklist: []string{"bad host"}})
+	assert.Error(t, err)
+}
+
+func TestURLPolicy_Save(t *testing.T) {
+	repo := NewMemoryMap()
+	p, err := NewURLPolicy(repo, repo, PolicyConfig{Blocklist: []string{".evil.com"}})
+	require.NoError(t, err)
+
+	_, err = p.SaveLongURL("https://evil.com/login", "u1")
+	assert.ErrorIs(t, err, ErrBlockedURL)
+	// запрещенная ссылка не мешает сохранить остальные
+	result, err := p.SaveLongBatchURL([]CorrelationLongPair{
+		{CorrelationID: "1", LongURL: "https://a.evil.com/1"},
+		{CorrelationID: "2", LongURL: "https://ya.ru/1"},
+	}, "u1")
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+	assert.Equal(t, CorrelationShortPair{CorrelationID: "2", ShortURL: "2e82f047", Status: BatchCreated}, result[1])
+	assert.Equal(t, BatchInvalid, result[0].Status)
+	assert.Contains(t, result[0].Error, ErrBlockedURL.Error())
+	assert.Len(t, repo.GetUsersURLs("u1"), 1)
+
+	short, err := p.SaveLongURL("https://ya.ru/1", "u1")
+	require.NoError(t, err)
+	long, err := p.GetLongURL(short)
+	require.NoError(t, err)
+	assert.Equal(t, URL("https://ya.ru/1"), long)
+}
+
+func TestURLPolicy_Reload(t *testing.T) {
+	blocklist := writeRules(t, "blocklist.txt", "")
+	repo := NewMemoryMap()
+	p, err := NewURLPolicy(repo, repo, PolicyConfig{BlocklistFile: blocklist})
+	require.NoError(t, err)
+
+	phish, err := p.SaveLongURL("https://login.phish.net/bank", "u1")
+	require.NoError(t, err)
+	other, err := p.SaveLongURL("https://phish.net.ya.ru/", "u2")
+	require.NoError(t, err)
+	ok, err := p.SaveLongURL("https://ya.ru/ok", "u2")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(blocklist, []byte(".phish.net\n*.net.ya.ru\n"), 0o600))
+	disabled, err := p.Reload(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, disabled)
+	for short, wantErr := range map[URL]error{phish: ErrDeletedURL, other: ErrDeletedURL, ok: nil} {
+		_, err = p.GetLongURL(short)
+		assert.ErrorIs(t, err, wantErr, short)
+	}
+	// отключенную ссылку нельзя ни восстановить, ни сократить заново
+	assert.ErrorIs(t, p.RestoreUsersURLs("u1", phish), ErrBlockedURL)
+	_, err = p.SaveLongURL("https://login.phish.net/bank", "u1")
+	assert.ErrorIs(t, err, ErrBlockedURL)
+
+	// битый файл не сбрасывает прежние правила
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad host\n"), 0o600))
+	_, err = p.Reload(context.Background())
+	assert.Error(t, err)
+	assert.ErrorIs(t, p.Check("https://phish.net/"), ErrBlockedURL)
+
+	disabled, err = p.Recheck(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, disabled)
+
+	p, err = NewURLPolicy(repo, nil, PolicyConfig{})
+	require.NoError(t, err)
+	_, err = p.Recheck(context.Background())
+	assert.Error(t, err)
+}